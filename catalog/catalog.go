@@ -0,0 +1,430 @@
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jinpan/stuffdb/database"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/table"
+)
+
+const (
+	// a truncated table is built empty in a directory with this suffix...
+	TRUNCATE_SUFFIX = ".truncate"
+	// ...and swapped in for the old one, which is moved aside with this one
+	// and then removed.  Table names cannot contain a dot, so neither
+	// directory clashes with a table.
+	TRUNCATED_SUFFIX = ".truncated"
+
+	// a dropped table is moved aside with this suffix before the catalog
+	// forgets it, and removed once it has
+	DROPPED_SUFFIX = ".dropped"
+)
+
+/*
+The catalog tracks every table in a database along with its schema.  It is
+persisted in the database's catalog file, which is rewritten atomically after
+every change.  A table being renamed is recorded there before its directory
+moves, so that opening the catalog after a crash can finish the move.
+
+The catalog is the only way to open a table, and it keeps a single handle on
+each table it opens: every reader and writer of a table must go through the
+same handle for its locks to keep them apart.  A catalog is safe for
+concurrent use.
+*/
+type Catalog struct {
+	Tables  map[string]*schema.Schema `json:"tables"`
+	Renames map[string]string         `json:"renames,omitempty"` // the old name of each table being renamed, by its new one
+	db      *database.Database
+
+	mu     sync.Mutex              // guards Tables, Renames and loaded
+	loaded map[string]*table.Table // the handles given out, by table name
+}
+
+// Open the catalog of the database, starting an empty one if there is none
+func Open(db *database.Database) (*Catalog, error) {
+	c := &Catalog{
+		Tables:  make(map[string]*schema.Schema),
+		Renames: make(map[string]string),
+		db:      db,
+		loaded:  make(map[string]*table.Table),
+	}
+
+	bytes, read_err := ioutil.ReadFile(db.CatalogPath())
+	if os.IsNotExist(read_err) {
+		return c, c.store()
+	} else if read_err != nil {
+		return nil, read_err
+	}
+
+	if err := json.Unmarshal(bytes, c); err != nil {
+		return nil, fmt.Errorf("Unable to read catalog %s: %s", db.CatalogPath(), err.Error())
+	}
+	if c.Renames == nil {
+		c.Renames = make(map[string]string)
+	}
+	if len(c.Renames) > 0 {
+		for new_name, old_name := range c.Renames {
+			if err := c.recoverRename(new_name, old_name); err != nil {
+				return nil, fmt.Errorf("Unable to recover table %s: %s", new_name, err.Error())
+			}
+		}
+		if err := c.store(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.recoverDrops(); err != nil {
+		return nil, fmt.Errorf("Unable to recover dropped tables: %s", err.Error())
+	}
+	for name, s := range c.Tables {
+		if err := s.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid schema for table %s: %s", name, err.Error())
+		}
+		if err := c.recoverTruncate(name); err != nil {
+			return nil, fmt.Errorf("Unable to recover table %s: %s", name, err.Error())
+		}
+	}
+	return c, nil
+}
+
+// Finish a rename of the table that a crash interrupted, moving its directory
+// to the new name if it is still under the old one
+func (c *Catalog) recoverRename(new_name, old_name string) error {
+	path := c.db.TablePath(new_name)
+	if _, stat_err := os.Stat(path); os.IsNotExist(stat_err) {
+		if err := os.Rename(c.db.TablePath(old_name), path); err != nil {
+			return err
+		}
+		if err := database.SyncDir(c.db.GetRoot()); err != nil {
+			return err
+		}
+	} else if stat_err != nil {
+		return stat_err
+	}
+	delete(c.Renames, new_name)
+	return nil
+}
+
+// Remove the directories of dropped tables that a crash left behind, moving
+// back those of tables the catalog still lists
+func (c *Catalog) recoverDrops() error {
+	entries, err := ioutil.ReadDir(c.db.GetRoot())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), DROPPED_SUFFIX)
+		if name == entry.Name() {
+			continue
+		}
+		path := c.db.TablePath(name)
+		if _, ok := c.Tables[name]; ok {
+			if _, stat_err := os.Stat(path); os.IsNotExist(stat_err) {
+				// the table was moved aside but the catalog never forgot it
+				if err := os.Rename(path+DROPPED_SUFFIX, path); err != nil {
+					return err
+				}
+				continue
+			} else if stat_err != nil {
+				return stat_err
+			}
+		}
+		if err := os.RemoveAll(path + DROPPED_SUFFIX); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finish or undo a truncation of the table that a crash interrupted
+func (c *Catalog) recoverTruncate(name string) error {
+	path := c.db.TablePath(name)
+	if _, stat_err := os.Stat(path); os.IsNotExist(stat_err) {
+		// the old table was moved aside but the empty one not yet moved in
+		if err := os.Rename(path+TRUNCATE_SUFFIX, path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if stat_err != nil {
+		return stat_err
+	}
+	if err := os.RemoveAll(path + TRUNCATE_SUFFIX); err != nil {
+		return err
+	}
+	return os.RemoveAll(path + TRUNCATED_SUFFIX)
+}
+
+// Write the catalog to a temporary file and move it into place, so a crash
+// leaves either the old or the new catalog, and flush the root so the move
+// itself survives one
+func (c *Catalog) store() error {
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp_filename := c.db.CatalogPath() + ".tmp"
+	f, create_err := os.OpenFile(tmp_filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if create_err != nil {
+		return create_err
+	}
+	if _, write_err := f.Write(bytes); write_err != nil {
+		f.Close()
+		return write_err
+	}
+	if sync_err := f.Sync(); sync_err != nil {
+		f.Close()
+		return sync_err
+	}
+	if close_err := f.Close(); close_err != nil {
+		return close_err
+	}
+	if err := os.Rename(tmp_filename, c.db.CatalogPath()); err != nil {
+		return err
+	}
+	return database.SyncDir(c.db.GetRoot())
+}
+
+func (c *Catalog) CreateTable(name string, s *schema.Schema) (*table.Table, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	if _, ok := c.Tables[name]; ok {
+		return nil, fmt.Errorf("Table %s already exists", name)
+	}
+	if _, stat_err := os.Stat(c.db.TablePath(name)); stat_err == nil {
+		return nil, fmt.Errorf("Table %s is not in the catalog but %s exists",
+			name, c.db.TablePath(name))
+	}
+
+	t, err := table.NewTable(c.db, name, s)
+	if err != nil {
+		os.RemoveAll(c.db.TablePath(name))
+		return nil, err
+	}
+	if err := t.Store(); err != nil {
+		os.RemoveAll(c.db.TablePath(name))
+		return nil, err
+	}
+
+	c.Tables[name] = s
+	if err := c.store(); err != nil {
+		return nil, err
+	}
+	c.loaded[name] = t
+	return t, nil
+}
+
+// The handle on a table in the catalog, loading the table if no handle was
+// given out yet
+func (c *Catalog) GetTable(name string) (*table.Table, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getTable(name)
+}
+
+// Called with c.mu held
+func (c *Catalog) getTable(name string) (*table.Table, error) {
+	if _, ok := c.Tables[name]; !ok {
+		return nil, fmt.Errorf("Table %s does not exist", name)
+	}
+	if t, ok := c.loaded[name]; ok {
+		return t, nil
+	}
+	t, err := table.Load(c.db, name)
+	if err != nil {
+		return nil, err
+	}
+	c.loaded[name] = t
+	return t, nil
+}
+
+// Close the handle on the table, if one was given out, so that its files can
+// be removed.  The handle is forgotten even if closing fails.  Called with
+// c.mu held.
+func (c *Catalog) closeTable(name string) error {
+	t, ok := c.loaded[name]
+	if !ok {
+		return nil
+	}
+	delete(c.loaded, name)
+	return t.Close()
+}
+
+// The names of all tables, in sorted order
+func (c *Catalog) ListTables() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	names := make([]string, 0, len(c.Tables))
+	for name := range c.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Remove the table and all of its files.  Its handle refuses writes from
+// then on.
+//
+// The table's directory is moved aside before the catalog forgets the table,
+// so a crash leaves either the table in place or a directory that opening the
+// catalog removes.
+func (c *Catalog) DropTable(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.Tables[name]; !ok {
+		return fmt.Errorf("Table %s does not exist", name)
+	}
+	if err := c.closeTable(name); err != nil {
+		return err
+	}
+
+	path := c.db.TablePath(name)
+	if err := os.RemoveAll(path + DROPPED_SUFFIX); err != nil {
+		return err
+	}
+	if err := os.Rename(path, path+DROPPED_SUFFIX); err != nil {
+		return err
+	}
+	if err := database.SyncDir(c.db.GetRoot()); err != nil {
+		return err
+	}
+
+	delete(c.Tables, name)
+	if err := c.store(); err != nil {
+		return err
+	}
+	return os.RemoveAll(path + DROPPED_SUFFIX)
+}
+
+// Rename the table.  Its handle carries on under the new name.
+//
+// The rename is stored in the catalog before the table's directory moves, and
+// forgotten once it has, so a crash in between is finished when the catalog is
+// opened again.
+func (c *Catalog) RenameTable(old_name, new_name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := checkName(new_name); err != nil {
+		return err
+	}
+	s, ok := c.Tables[old_name]
+	if !ok {
+		return fmt.Errorf("Table %s does not exist", old_name)
+	}
+	if _, ok := c.Tables[new_name]; ok {
+		return fmt.Errorf("Table %s already exists", new_name)
+	}
+
+	t, err := c.getTable(old_name)
+	if err != nil {
+		return err
+	}
+
+	delete(c.Tables, old_name)
+	c.Tables[new_name] = s
+	c.Renames[new_name] = old_name
+	undo := func() {
+		delete(c.Renames, new_name)
+		delete(c.Tables, new_name)
+		c.Tables[old_name] = s
+	}
+	if err := c.store(); err != nil {
+		undo()
+		return err
+	}
+	if err := t.Rename(new_name); err != nil {
+		if _, stat_err := os.Stat(c.db.TablePath(old_name)); stat_err == nil {
+			// the directory did not move, so neither does the table
+			undo()
+			c.store()
+		}
+		return err
+	}
+	delete(c.loaded, old_name)
+	c.loaded[new_name] = t
+
+	delete(c.Renames, new_name)
+	return c.store()
+}
+
+// Remove every row of the table, keeping its schema, and return the handle on
+// the empty table.  The old handle refuses writes from then on.
+//
+// The empty table is built next to the old one and swapped in for it, so a
+// crash leaves either table in place once the catalog is opened again.
+func (c *Catalog) TruncateTable(name string) (*table.Table, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.Tables[name]
+	if !ok {
+		return nil, fmt.Errorf("Table %s does not exist", name)
+	}
+	if err := c.closeTable(name); err != nil {
+		return nil, err
+	}
+
+	path := c.db.TablePath(name)
+	if err := os.RemoveAll(path + TRUNCATE_SUFFIX); err != nil {
+		return nil, err
+	}
+	empty, err := table.NewTable(c.db, name+TRUNCATE_SUFFIX, s)
+	if err != nil {
+		return nil, err
+	}
+	if err := empty.Store(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(path, path+TRUNCATED_SUFFIX); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path+TRUNCATE_SUFFIX, path); err != nil {
+		return nil, err
+	}
+	if err := database.SyncDir(c.db.GetRoot()); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(path + TRUNCATED_SUFFIX); err != nil {
+		return nil, err
+	}
+
+	t, err := c.getTable(name)
+	if err != nil {
+		return nil, err
+	}
+	// record the table's name in its metadata, which has the temporary one
+	if err := t.Store(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Table names double as directory names, so keep them to lower case letters,
+// digits and underscores
+func checkName(name string) error {
+	if name == "" {
+		return fmt.Errorf("Table name must not be empty")
+	}
+	if name == database.CATALOG_FILE {
+		return fmt.Errorf("Table name %s is reserved", name)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_') {
+			return fmt.Errorf("Table name %q may only contain a-z, 0-9 and _", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,426 @@
+package catalog
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/jinpan/stuffdb/database"
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+)
+
+func setup(t *testing.T) (*database.Database, *Catalog) {
+	db, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, c
+}
+
+func makeSchema(t *testing.T) *schema.Schema {
+	s, err := schema.NewSchema(
+		[]string{"a", "b"},
+		[]datatypes.DatumType{datatypes.INT64_TYPE, datatypes.FLOAT64_TYPE},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCreateList(t *testing.T) {
+	db, c := setup(t)
+
+	for _, name := range []string{"person", "household"} {
+		if _, err := c.CreateTable(name, makeSchema(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.CreateTable("person", makeSchema(t)); err == nil {
+		t.Errorf("Expected an error creating a duplicate table")
+	}
+	for _, name := range []string{"", "Person", "../person", database.CATALOG_FILE} {
+		if _, err := c.CreateTable(name, makeSchema(t)); err == nil {
+			t.Errorf("Expected an error creating table %q", name)
+		}
+	}
+
+	expected := []string{"household", "person"}
+	if names := c.ListTables(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+
+	// the catalog survives reopening
+	c2, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := c2.ListTables(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+	tbl, err := c2.GetTable("person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tbl.Schema.GetType(1) != datatypes.FLOAT64_TYPE {
+		t.Errorf("Expected the schema to survive reopening")
+	}
+}
+
+func TestDrop(t *testing.T) {
+	db, c := setup(t)
+
+	tbl, err := c.CreateTable("person", makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if insert_err := tbl.Insert([]interface{}{int64(1), 1.5}); insert_err != nil {
+		t.Fatal(insert_err)
+	}
+
+	if err := c.DropTable("person"); err != nil {
+		t.Fatal(err)
+	}
+	if _, stat_err := os.Stat(db.TablePath("person")); !os.IsNotExist(stat_err) {
+		t.Errorf("Expected the table directory to be removed")
+	}
+	if len(c.ListTables()) != 0 {
+		t.Errorf("Expected no tables, got %v", c.ListTables())
+	}
+	if err := c.DropTable("person"); err == nil {
+		t.Errorf("Expected an error dropping a missing table")
+	}
+
+	// the name can be reused
+	if _, err := c.CreateTable("person", makeSchema(t)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	db, c := setup(t)
+
+	tbl, err := c.CreateTable("person", makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if insert_err := tbl.Insert([]interface{}{int64(1), 1.5}); insert_err != nil {
+		t.Fatal(insert_err)
+	}
+	if _, err := c.CreateTable("household", makeSchema(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.RenameTable("person", "household"); err == nil {
+		t.Errorf("Expected an error renaming onto an existing table")
+	}
+	if err := c.RenameTable("person", "people"); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"household", "people"}
+	if names := c2.ListTables(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+	renamed, err := c2.GetTable("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.GetName() != "people" || renamed.N_entries != 1 {
+		t.Errorf("Expected table people with 1 entry, got %s with %d",
+			renamed.GetName(), renamed.N_entries)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	_, c := setup(t)
+
+	tbl, err := c.CreateTable("person", makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1100; i++ {
+		if insert_err := tbl.Insert([]interface{}{int64(i), 1.5}); insert_err != nil {
+			t.Fatal(insert_err)
+		}
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.TruncateTable("person"); err != nil {
+		t.Fatal(err)
+	}
+	truncated, err := c.GetTable("person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	scan := truncated.Scan(context.Background(), 0, 1)
+	for rows := range scan.C {
+		count += len(rows)
+	}
+	if err := scan.Err(); err != nil {
+		t.Error(err)
+	}
+	if count != 0 || truncated.N_entries != 0 {
+		t.Errorf("Expected an empty table, got %d rows", count)
+	}
+}
+
+func TestSingleHandle(t *testing.T) {
+	db, c := setup(t)
+	if _, err := c.CreateTable("person", makeSchema(t)); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// handles fetched separately share their locks, so writes through them
+	// all land
+	done := make(chan error)
+	for k := 0; k < 2; k++ {
+		go func() {
+			tbl, err := c2.GetTable("person")
+			if err != nil {
+				done <- err
+				return
+			}
+			for i := 0; i < 3000; i++ {
+				if err := tbl.Insert([]interface{}{int64(i), 1.5}); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- tbl.Flush()
+		}()
+	}
+	for k := 0; k < 2; k++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	tbl, err := c2.GetTable("person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := c2.GetTable("person"); again != tbl {
+		t.Errorf("Expected the same handle on every call")
+	}
+
+	reloaded, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tbl, err = reloaded.GetTable("person"); err != nil {
+		t.Fatal(err)
+	}
+	if tbl.N_entries != 6000 {
+		t.Errorf("Expected 6000 entries, got %d", tbl.N_entries)
+	}
+}
+
+func TestDropClosesHandle(t *testing.T) {
+	_, c := setup(t)
+	tbl, err := c.CreateTable("person", makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1100; i++ {
+		if insert_err := tbl.Insert([]interface{}{int64(i), 1.5}); insert_err != nil {
+			t.Fatal(insert_err)
+		}
+	}
+
+	if err := c.DropTable("person"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Insert([]interface{}{int64(1), 1.5}); err == nil {
+		t.Errorf("Expected an error inserting into a dropped table")
+	}
+}
+
+func TestRenameKeepsHandle(t *testing.T) {
+	_, c := setup(t)
+	tbl, err := c.CreateTable("person", makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1100; i++ {
+		if insert_err := tbl.Insert([]interface{}{int64(i), 1.5}); insert_err != nil {
+			t.Fatal(insert_err)
+		}
+	}
+
+	if err := c.RenameTable("person", "people"); err != nil {
+		t.Fatal(err)
+	}
+	if renamed, err := c.GetTable("people"); err != nil || renamed != tbl {
+		t.Fatalf("Expected the same handle under the new name, got %v", err)
+	}
+	if err := tbl.Insert([]interface{}{int64(1100), 1.5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if datum, err := tbl.GetDatum(1100, 0); err != nil || datum != int64(1100) {
+		t.Errorf("Expected 1100, got %v (%v)", datum, err)
+	}
+}
+
+func TestTruncateRecovery(t *testing.T) {
+	db, c := setup(t)
+	tbl, err := c.CreateTable("person", makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if insert_err := tbl.Insert([]interface{}{int64(1), 1.5}); insert_err != nil {
+		t.Fatal(insert_err)
+	}
+	if _, err := c.TruncateTable("person"); err != nil {
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{TRUNCATE_SUFFIX, TRUNCATED_SUFFIX} {
+		if _, stat_err := os.Stat(db.TablePath("person") + suffix); !os.IsNotExist(stat_err) {
+			t.Errorf("Expected no %s directory to be left, got %v", suffix, stat_err)
+		}
+	}
+
+	// a crash after the old table was moved aside, before the new one moved in
+	path := db.TablePath("person")
+	if err := os.Rename(path, path+TRUNCATE_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path+TRUNCATED_SUFFIX, 0700); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := c2.GetTable("person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.N_entries != 0 {
+		t.Errorf("Expected an empty table, got %d entries", recovered.N_entries)
+	}
+	if _, stat_err := os.Stat(path + TRUNCATED_SUFFIX); !os.IsNotExist(stat_err) {
+		t.Errorf("Expected the old table to be removed, got %v", stat_err)
+	}
+}
+
+func TestDropRecovery(t *testing.T) {
+	db, c := setup(t)
+	for _, name := range []string{"person", "household"} {
+		tbl, err := c.CreateTable(name, makeSchema(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if insert_err := tbl.Insert([]interface{}{int64(1), 1.5}); insert_err != nil {
+			t.Fatal(insert_err)
+		}
+	}
+	if err := c.DropTable("household"); err != nil {
+		t.Fatal(err)
+	}
+	if _, stat_err := os.Stat(db.TablePath("household") + DROPPED_SUFFIX); !os.IsNotExist(stat_err) {
+		t.Errorf("Expected no %s directory to be left, got %v", DROPPED_SUFFIX, stat_err)
+	}
+
+	// a crash after person was moved aside, before the catalog forgot it
+	person := db.TablePath("person")
+	if err := os.Rename(person, person+DROPPED_SUFFIX); err != nil {
+		t.Fatal(err)
+	}
+	// and one after the catalog forgot household, before its directory went
+	if err := os.Mkdir(db.TablePath("household")+DROPPED_SUFFIX, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := c2.ListTables(); !reflect.DeepEqual(names, []string{"person"}) {
+		t.Errorf("Expected [person], got %v", names)
+	}
+	recovered, err := c2.GetTable("person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.N_entries != 1 {
+		t.Errorf("Expected 1 entry, got %d", recovered.N_entries)
+	}
+	for _, name := range []string{"person", "household"} {
+		if _, stat_err := os.Stat(db.TablePath(name) + DROPPED_SUFFIX); !os.IsNotExist(stat_err) {
+			t.Errorf("Expected the %s directory of %s to be gone, got %v", DROPPED_SUFFIX, name, stat_err)
+		}
+	}
+}
+
+func TestRenameRecovery(t *testing.T) {
+	db, c := setup(t)
+	tbl, err := c.CreateTable("person", makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if insert_err := tbl.Insert([]interface{}{int64(1), 1.5}); insert_err != nil {
+		t.Fatal(insert_err)
+	}
+
+	// a crash after the rename was stored, before the directory moved
+	c.mu.Lock()
+	c.Tables["people"] = c.Tables["person"]
+	delete(c.Tables, "person")
+	c.Renames["people"] = "person"
+	store_err := c.store()
+	c.mu.Unlock()
+	if store_err != nil {
+		t.Fatal(store_err)
+	}
+
+	c2, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := c2.ListTables(); !reflect.DeepEqual(names, []string{"people"}) {
+		t.Errorf("Expected [people], got %v", names)
+	}
+	if len(c2.Renames) != 0 {
+		t.Errorf("Expected the rename to be finished, got %v", c2.Renames)
+	}
+	if _, stat_err := os.Stat(db.TablePath("person")); !os.IsNotExist(stat_err) {
+		t.Errorf("Expected the old directory to be moved, got %v", stat_err)
+	}
+	renamed, err := c2.GetTable("people")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.GetName() != "people" || renamed.N_entries != 1 {
+		t.Errorf("Expected table people with 1 entry, got %s with %d",
+			renamed.GetName(), renamed.N_entries)
+	}
+
+	// the finished rename was stored
+	c3, err := Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c3.Renames) != 0 {
+		t.Errorf("Expected no rename to be left, got %v", c3.Renames)
+	}
+}
@@ -0,0 +1,132 @@
+package column
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+
+	"github.com/jinpan/stuffdb/datatypes"
+)
+
+const (
+	BLOOM_SUFFIX = ".bloom"
+
+	// about a 1% false positive rate
+	BLOOM_BITS_PER_KEY = 10
+	BLOOM_N_HASHES     = 7
+
+	// the most hashes a stored filter may claim, well past any useful count
+	BLOOM_MAX_HASHES = 32
+)
+
+/*
+	A Bloom filter of the values of an int64 physical column tells lookups
+	of a key which runs cannot hold it.  It is only kept for the columns the
+	schema asks for, stored next to the data file with BLOOM_SUFFIX appended
+	and sealed like it, its body holding the number of hashes as a
+	little-endian uint32 followed by the bits, bit k of the filter being bit
+	k%8 of byte k/8.  Nulls are not added.
+*/
+
+type BloomFilter struct {
+	n_hashes int
+	bits     []byte
+}
+
+// An empty filter sized for n keys
+func newBloomFilter(n int) *BloomFilter {
+	n_bytes := (n*BLOOM_BITS_PER_KEY + 63) / 64 * 8
+	if n_bytes == 0 {
+		n_bytes = 8
+	}
+	return &BloomFilter{
+		n_hashes: BLOOM_N_HASHES,
+		bits:     make([]byte, n_bytes),
+	}
+}
+
+// The bits a key sets, by double hashing
+func (b *BloomFilter) positions(key int64, f func(bit uint64) bool) bool {
+	h := mix(uint64(key))
+	h1, h2 := h&0xffffffff, h>>32|1
+	n_bits := uint64(len(b.bits)) * 8
+	for i := uint64(0); i < uint64(b.n_hashes); i++ {
+		if !f((h1 + i*h2) % n_bits) {
+			return false
+		}
+	}
+	return true
+}
+
+// The finalizer of splitmix64, spreading the bits of a key over the hash
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (b *BloomFilter) add(key int64) {
+	b.positions(key, func(bit uint64) bool {
+		b.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+// Whether the column may hold the key.  A key that is not an int64 is never
+// ruled out.
+func (b *BloomFilter) MayContain(key interface{}) bool {
+	x, ok := key.(int64)
+	if !ok {
+		return true
+	}
+	return b.positions(x, func(bit uint64) bool {
+		return b.bits[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+// Write out the filter for the data file of a run of rows
+func (b *BloomFilter) store(filename string, rows int) error {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(b.n_hashes))
+	buf.Write(b.bits)
+
+	return writeCompanion(filename+BLOOM_SUFFIX, datatypes.INT64_TYPE, rows, buf.Bytes())
+}
+
+// Read the filter of the data file of a run of rows, which is nil if it has
+// none
+func readBloomFilter(filename string, rows int) (*BloomFilter, error) {
+	data, err := readCompanion(filename+BLOOM_SUFFIX, datatypes.INT64_TYPE, rows)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	if len(data) < 4+8 || (len(data)-4)%8 != 0 {
+		return nil, corruptFile(filename+BLOOM_SUFFIX, "unexpected size %d", len(data))
+	}
+	// no hashes would rule nothing out, and too many would make every lookup
+	// crawl
+	n_hashes := binary.LittleEndian.Uint32(data)
+	if n_hashes < 1 || n_hashes > BLOOM_MAX_HASHES {
+		return nil, corruptFile(filename+BLOOM_SUFFIX, "invalid number of hashes %d", n_hashes)
+	}
+	return &BloomFilter{
+		n_hashes: int(n_hashes),
+		bits:     data[4:],
+	}, nil
+}
+
+func hasBloomFilter(filename string) bool {
+	_, err := os.Stat(filename + BLOOM_SUFFIX)
+	return err == nil
+}
+
+// The Bloom filter of a physical column, nil if it has none
+func bloomFilterOf(p Physical) (*BloomFilter, error) {
+	if p, ok := p.(interface{ BloomFilter() (*BloomFilter, error) }); ok {
+		return p.BloomFilter()
+	}
+	return nil, nil
+}
@@ -0,0 +1,159 @@
+package column
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+)
+
+// Write the values from, from+step, ... below to to a new physical column
+func writeInt64s(t *testing.T, filename string, from, to, step int64, with_bloom bool) *PhysicalInt64 {
+	ch := make(chan interface{})
+	size := 0
+	for i := from; i < to; i += step {
+		size++
+	}
+	go func() {
+		for i := from; i < to; i += step {
+			ch <- i
+		}
+		close(ch)
+	}()
+	var physical *PhysicalInt64
+	var err error
+	if with_bloom {
+		physical, err = NewPhysicalInt64WithBloomFilter(filename, ch, size)
+	} else {
+		physical, err = NewPhysicalInt64(filename, ch, size)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return physical
+}
+
+func TestBloomFilter(t *testing.T) {
+	dir := t.TempDir()
+	evens := writeInt64s(t, filepath.Join(dir, "evens"), 0, 20000, 2, true)
+	plain := writeInt64s(t, filepath.Join(dir, "plain"), 1, 101, 2, false)
+
+	bloom, err := evens.BloomFilter()
+	if err != nil || bloom == nil {
+		t.Fatalf("Expected a Bloom filter, got %v", err)
+	}
+	false_positives := 0
+	for i := int64(0); i < 20000; i++ {
+		if i%2 == 0 && !bloom.MayContain(i) {
+			t.Fatalf("Expected the filter to hold %d", i)
+		}
+		if i%2 == 1 && bloom.MayContain(i) {
+			false_positives++
+		}
+	}
+	if false_positives > 10000/20 {
+		t.Errorf("Expected about 1%% false positives, got %d of %d", false_positives, 10000)
+	}
+	if bloom, err := plain.BloomFilter(); err != nil || bloom != nil {
+		t.Errorf("Expected no Bloom filter, got %v (%v)", bloom, err)
+	}
+
+	// merging rebuilds the filter over the rows of both
+	merged, err := evens.Merge(plain, filepath.Join(dir, "merged"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bloom, err := merged.BloomFilter(); err != nil || bloom == nil || !bloom.MayContain(int64(99)) || !bloom.MayContain(int64(0)) {
+		t.Errorf("Expected the merged filter to hold the keys of both, got %v", err)
+	}
+	if err := merged.Move(filepath.Join(dir, "moved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := merged.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved") + BLOOM_SUFFIX); !os.IsNotExist(err) {
+		t.Errorf("Expected the Bloom filter to be deleted, got %v", err)
+	}
+}
+
+func TestBloomFilterHashCount(t *testing.T) {
+	physical := writeInt64s(t, filepath.Join(t.TempDir(), "keys"), 0, 100, 1, true)
+	contents, err := readCompanion(physical.filename+BLOOM_SUFFIX, datatypes.INT64_TYPE, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n_hashes := range []uint32{0, BLOOM_MAX_HASHES + 1, math.MaxUint32} {
+		// a filter sealed with a bad count, rather than damaged on disk
+		binary.LittleEndian.PutUint32(contents, n_hashes)
+		if err := os.Remove(physical.filename + BLOOM_SUFFIX); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeCompanion(physical.filename+BLOOM_SUFFIX, datatypes.INT64_TYPE, 100, contents); err != nil {
+			t.Fatal(err)
+		}
+		var corrupt *CorruptionError
+		if _, err := physical.BloomFilter(); !errors.As(err, &corrupt) {
+			t.Errorf("Expected a corruption error for %d hashes, got %v", n_hashes, err)
+		}
+	}
+}
+
+func TestPruneWithBloomFilter(t *testing.T) {
+	db := column_setup(t)
+	s, err := schema.NewSchema([]string{"a"}, []datatypes.DatumType{datatypes.INT64_TYPE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = s.WithBloomFilters("a"); err != nil {
+		t.Fatal(err)
+	}
+	col, err := NewColumn(db, "bloomed", s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the even keys in one run and the odd ones in the next, so the zone maps
+	// of both cover every key
+	for first := 0; first < 2; first++ {
+		ch := make(chan interface{})
+		go func() {
+			for i := first; i < 2*ZONE_BLOCK_SIZE; i += 2 {
+				ch <- int64(i)
+			}
+			close(ch)
+		}()
+		if err := col.Insert(ch, ZONE_BLOCK_SIZE); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := col.Snapshot()
+	spans, err := snapshot.Prune(Point(int64(10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spans, []Span{{0, ZONE_BLOCK_SIZE}}) {
+		t.Errorf("Expected only the run of even keys, got %v", spans)
+	}
+	spans, err = snapshot.PruneKeys([]interface{}{int64(11), int64(13), nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spans, []Span{{ZONE_BLOCK_SIZE, 2 * ZONE_BLOCK_SIZE}}) {
+		t.Errorf("Expected only the run of odd keys, got %v", spans)
+	}
+	spans, err = snapshot.PruneKeys([]interface{}{int64(-1), int64(2 * ZONE_BLOCK_SIZE)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 0 {
+		t.Errorf("Expected keys out of every zone to rule out every run, got %v", spans)
+	}
+}
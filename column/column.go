@@ -2,35 +2,85 @@ package column
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 
+	"github.com/jinpan/stuffdb/database"
 	"github.com/jinpan/stuffdb/datatypes"
 	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/tableview"
 )
 
+const (
+	// runs are merged this many at a time
+	COMPACTION_FANOUT = 4
+)
+
+/*
+A column is a list of runs, each a physical column holding a stretch of the
+column's rows.  Insert appends a new run, and the runs are compacted with a
+size-tiered policy: a run's tier is the base COMPACTION_FANOUT logarithm of its
+size, and once the newest COMPACTION_FANOUT runs share a tier they are merged
+into a single run of a higher tier, which may in turn complete a group of the
+next tier.  A row is therefore rewritten at most once per tier, bounding the
+write amplification by the number of tiers, about log4 of the column's size.
+
+Runs are numbered by the inserts they hold: the file of a run holding size
+rows from inserts lo to hi is named lo_hi_size.
+*/
 type Column struct {
 	tablename string
 	base_dir  string
 	schema    *schema.Schema
 	rank      int
-	primary   *list.List // list of columns ordered by the primary key
+	primary   *list.List // list of runs ordered by the primary key
+
+	// counters since the column was loaded
+	rows_appended int64
+	rows_written  int64
+}
+
+// A run of a column along with the inserts it holds
+type run struct {
+	Physical
+	lo, hi int
 }
 
-func NewColumn(tablename string, schema *schema.Schema, rank int) *Column {
-	base_dir := filepath.Join(
-		"/var",
-		"stuffdb",
-		tablename,
-		fmt.Sprintf("c%d", rank),
-	)
+// Counters of the writes to a column since it was loaded
+type Stats struct {
+	Runs          int   // the runs currently making up the column
+	Rows_appended int64 // rows appended by inserts
+	Rows_written  int64 // rows written to runs, counting every rewrite
+}
+
+// The number of times each appended row has been written, on average
+func (s Stats) WriteAmplification() float64 {
+	if s.Rows_appended == 0 {
+		return 0
+	}
+	return float64(s.Rows_written) / float64(s.Rows_appended)
+}
+
+// Add the counters of another column
+func (s Stats) Add(other Stats) Stats {
+	return Stats{
+		Runs:          s.Runs + other.Runs,
+		Rows_appended: s.Rows_appended + other.Rows_appended,
+		Rows_written:  s.Rows_written + other.Rows_written,
+	}
+}
+
+func NewColumn(db *database.Database, tablename string, schema *schema.Schema, rank int) (*Column, error) {
+	base_dir := db.ColumnPath(tablename, rank)
 	mkdir_err := os.MkdirAll(base_dir, 0700)
 	if mkdir_err != nil {
-		panic(mkdir_err.Error())
+		return nil, mkdir_err
 	}
 	return &Column{
 		tablename: tablename,
@@ -38,16 +88,11 @@ func NewColumn(tablename string, schema *schema.Schema, rank int) *Column {
 		schema:    schema,
 		rank:      rank,
 		primary:   list.New(),
-	}
+	}, nil
 }
 
-func Load(tablename string, s *schema.Schema, rank int) *Column {
-	base_dir := filepath.Join(
-		"/var",
-		"stuffdb",
-		tablename,
-		fmt.Sprintf("c%d", rank),
-	)
+func Load(db *database.Database, tablename string, s *schema.Schema, rank int) (*Column, error) {
+	base_dir := db.ColumnPath(tablename, rank)
 	c := Column{
 		tablename: tablename,
 		base_dir:  base_dir,
@@ -58,160 +103,623 @@ func Load(tablename string, s *schema.Schema, rank int) *Column {
 
 	files, err := ioutil.ReadDir(base_dir)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
-	file_map := make(map[int]string)
+	var runs []*run
 	for _, fi := range files {
 		fname := fi.Name()
-		iname, err := strconv.Atoi(fname)
+		if dataFileName(fname) != fname {
+			continue // owned by the physical column of the same name
+		}
+		lo, hi, size, ok := parseRunName(fname)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected file %s in column %d of table %s",
+				fname, rank, tablename)
+		}
+		physical, err := c.loadPhysical(filepath.Join(base_dir, fname), size)
 		if err != nil {
-			panic(err.Error())
+			return nil, err
 		}
-		file_map[iname] = fname
-	}
-	sizes := make([]int, len(file_map))
-	for iname, _ := range file_map {
-		sizes = append(sizes, iname)
+		runs = append(runs, &run{Physical: physical, lo: lo, hi: hi})
 	}
-	sort.Ints(sizes)
-	for _, size := range sizes {
-		col := LoadPhysicalInt64(filepath.Join(base_dir, file_map[size]), size)
-		c.primary.PushBack(col)
+	// a run covering the inserts of another replaced it, and the replaced
+	// run was only kept for snapshots that are gone now
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].lo != runs[j].lo {
+			return runs[i].lo < runs[j].lo
+		}
+		return runs[i].hi > runs[j].hi
+	})
+	hi := -1
+	for _, r := range runs {
+		if r.hi <= hi {
+			if err := r.Delete(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		hi = r.hi
+		c.primary.PushBack(r)
 	}
 
-	return &c
+	return &c, nil
 }
 
-func (c *Column) Scan() chan []interface{} {
-	ch := make(chan []interface{})
+// Stream the whole column, stopping early once ctx is cancelled.  Every run
+// is opened before Scan returns, so the scan sees the column as it was at the
+// call even if the column is rewritten in the meantime.
+func (c *Column) Scan(ctx context.Context) *tableview.ColumnView {
+	return c.Snapshot().Scan(ctx)
+}
+
+func (c *Column) GetDatum(i int) (interface{}, error) {
+	return c.Snapshot().GetDatum(i)
+}
+
+/*
+The runs making up a column at one point in time.  A snapshot goes on reading
+those runs after the column is appended to or compacted, as long as the
+runs' files are kept until the snapshot is no longer used; see Pending.
+*/
+type Snapshot struct {
+	runs []*run
+
+	// the column, for errors
+	tablename string
+	rank      int
+}
+
+func (c *Column) Snapshot() *Snapshot {
+	s := &Snapshot{
+		runs:      make([]*run, 0, c.primary.Len()),
+		tablename: c.tablename,
+		rank:      c.rank,
+	}
+	for node := c.primary.Front(); node != nil; node = node.Next() {
+		s.runs = append(s.runs, node.Value.(*run))
+	}
+	return s
+}
+
+// Stream the column as of the snapshot, stopping early once ctx is cancelled.
+func (s *Snapshot) Scan(ctx context.Context) *tableview.ColumnView {
+	cv := tableview.NewColumnView()
+
+	pcvs := make([]*tableview.ColumnView, 0, len(s.runs))
+	var open_err error
+	for _, r := range s.runs {
+		pcv, err := r.ReadAll(ctx)
+		if err != nil {
+			open_err = err
+			break
+		}
+		pcvs = append(pcvs, pcv)
+	}
 
 	go func() {
-		defer close(ch)
+		defer close(cv.C)
+		// let the readers of the runs not yet streamed finish
+		defer func() {
+			for _, pcv := range pcvs {
+				for range pcv.C {
+				}
+			}
+		}()
 
-		for node := c.primary.Front(); node != nil; node = node.Next() {
-			physical := node.Value.(Physical)
-			pch := physical.ReadAll()
-			for datum := range pch {
-				ch <- datum
+		if open_err != nil {
+			cv.Fail(inColumn(open_err, s.tablename, s.rank))
+			return
+		}
+		for len(pcvs) > 0 {
+			pcv := pcvs[0]
+			for data := range pcv.C {
+				if !cv.Send(ctx, data) {
+					return // pcv gives up too, as it shares ctx
+				}
+			}
+			if err := pcv.Err(); err != nil {
+				cv.Fail(inColumn(err, s.tablename, s.rank))
+				return
 			}
+			pcvs = pcvs[1:]
 		}
 	}()
 
-	return ch
+	return cv
 }
 
-func (c *Column) GetDatum(i int) (interface{}, error) {
-	for node := c.primary.Front(); node != nil; node = node.Next() {
-		physical := node.Value.(Physical)
-		if i < physical.GetSize() {
-			return physical.ReadOne(i)
-			break
+// The rows [Lo, Hi) of a column
+type Span struct {
+	Lo, Hi int
+}
+
+// The spans of rows that may hold a value in r, in order, according to the
+// zone maps of the runs and, if r holds a single value, their Bloom filters.
+// The runs and blocks that cannot are left out.
+func (s *Snapshot) Prune(r Range) ([]Span, error) {
+	point, is_point := r.point()
+	return s.prune(func(p Physical) (func(Zone) bool, error) {
+		if is_point {
+			bloom, err := bloomFilterOf(p)
+			if err != nil || (bloom != nil && !bloom.MayContain(point)) {
+				return nil, err
+			}
+		}
+		return r.Overlaps, nil
+	})
+}
+
+// The spans of rows that may hold one of the keys, in order, according to the
+// Bloom filters and zone maps of the runs
+func (s *Snapshot) PruneKeys(keys []interface{}) ([]Span, error) {
+	return s.prune(func(p Physical) (func(Zone) bool, error) {
+		bloom, err := bloomFilterOf(p)
+		if err != nil {
+			return nil, err
+		}
+		var candidates []interface{}
+		for _, key := range keys {
+			if isValue(key) && (bloom == nil || bloom.MayContain(key)) {
+				candidates = append(candidates, key)
+			}
+		}
+		if len(candidates) == 0 {
+			return nil, nil
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return compare(candidates[i], candidates[j]) < 0
+		})
+		return func(z Zone) bool {
+			if z.Count == 0 {
+				return false
+			}
+			i := sort.Search(len(candidates), func(i int) bool {
+				return compare(candidates[i], z.Min) >= 0
+			})
+			return i < len(candidates) && compare(candidates[i], z.Max) <= 0
+		}, nil
+	})
+}
+
+// The spans of rows in the blocks that overlaps, given for each run, picks.
+// A nil overlaps rules out the whole run, and a run without a zone map is
+// kept whole.
+func (s *Snapshot) prune(overlaps func(Physical) (func(Zone) bool, error)) ([]Span, error) {
+	var spans []Span
+	add := func(lo, hi int) {
+		if n := len(spans); n > 0 && spans[n-1].Hi == lo {
+			spans[n-1].Hi = hi
 		} else {
-			i -= physical.GetSize()
+			spans = append(spans, Span{Lo: lo, Hi: hi})
 		}
 	}
 
-	return nil, fmt.Errorf("out of bounds")
+	start := 0
+	for _, run := range s.runs {
+		size := run.GetSize()
+		run_overlaps, err := overlaps(run.Physical)
+		if err != nil {
+			return nil, err
+		}
+		if run_overlaps == nil {
+			start += size
+			continue
+		}
+		zone_map, err := run.ZoneMap()
+		if err != nil {
+			return nil, err
+		}
+		if zone_map == nil {
+			add(start, start+size)
+		} else if run_overlaps(zone_map.Whole()) {
+			for k, zone := range zone_map.Zones {
+				if run_overlaps(zone) {
+					add(start+k*ZONE_BLOCK_SIZE, start+minInt((k+1)*ZONE_BLOCK_SIZE, size))
+				}
+			}
+		}
+		start += size
+	}
+	return spans, nil
 }
 
-func (c *Column) Insert(data <-chan interface{}, size int) {
-	old_size := 0
-	for node := c.primary.Front(); node != nil; node = node.Next() {
-		old_size += node.Value.(Physical).GetSize()
+func minInt(a, b int) int {
+	if a < b {
+		return a
 	}
-	new_size := old_size + size
+	return b
+}
 
-	ch := c.Scan()
+// Stream the given spans of the column as of the snapshot, stopping early
+// once ctx is cancelled.  No vector straddles two spans.  Unlike Scan, the
+// runs are opened as the scan reaches them, so their files must be kept until
+// the scan is over.
+func (s *Snapshot) ScanSpans(ctx context.Context, spans []Span) *tableview.ColumnView {
+	cv := tableview.NewColumnView()
 
-	new_nodes := list.New()
+	go func() {
+		defer close(cv.C)
 
-	for col_size := 0; new_size > 0; new_size -= col_size {
-		col_size = 1
-		for new_size_tmp := new_size; new_size_tmp > 0; new_size_tmp >>= 1 {
-			col_size <<= 1
+		idx, start := 0, 0 // the run holding the next row, and its first row
+		for _, span := range spans {
+			for lo := span.Lo; lo < span.Hi; {
+				for idx < len(s.runs) && start+s.runs[idx].GetSize() <= lo {
+					start += s.runs[idx].GetSize()
+					idx++
+				}
+				if idx == len(s.runs) || lo < start {
+					cv.Fail(fmt.Errorf("Span [%d, %d) is out of bounds", span.Lo, span.Hi))
+					return
+				}
+				hi := minInt(span.Hi, start+s.runs[idx].GetSize())
+				pcv, err := s.runs[idx].Read(ctx, lo-start, hi-start)
+				if err != nil {
+					cv.Fail(inColumn(err, s.tablename, s.rank))
+					return
+				}
+				for data := range pcv.C {
+					if !cv.Send(ctx, data) {
+						for range pcv.C {
+						}
+						return
+					}
+				}
+				if err := pcv.Err(); err != nil {
+					cv.Fail(inColumn(err, s.tablename, s.rank))
+					return
+				}
+				lo = hi
+			}
 		}
-		col_size >>= 1
-		col_ch := make(chan interface{})
+	}()
 
-		go func() {
-			var old_copy int
-			if col_size > old_size {
-				old_copy = old_size
-			} else {
-				old_copy = col_size
-			}
+	return cv
+}
 
-			for i := 0; i < old_copy; i++ {
-				rows := <-ch
-				for _, row := range rows {
-					col_ch <- row
-				}
-			}
-			old_size -= old_copy
+func (s *Snapshot) GetDatum(i int) (interface{}, error) {
+	for _, r := range s.runs {
+		if i < r.GetSize() {
+			datum, err := r.ReadOne(i)
+			return datum, inColumn(err, s.tablename, s.rank)
+		}
+		i -= r.GetSize()
+	}
 
-			for i := 0; i < col_size-old_copy; i++ {
-				col_ch <- <-data
-			}
+	return nil, fmt.Errorf("out of bounds")
+}
 
-			close(col_ch)
-		}()
-		filename := filepath.Join(c.base_dir, fmt.Sprintf("%d_tmp", col_size))
-		physical := NewPhysicalInt64(filename, col_ch, col_size)
-		new_nodes.PushBack(physical)
+// The number of rows in the column as of the snapshot
+func (s *Snapshot) GetSize() int {
+	size := 0
+	for _, r := range s.runs {
+		size += r.GetSize()
 	}
+	return size
+}
 
+// The column's write counters
+func (c *Column) Stats() Stats {
+	return Stats{
+		Runs:          c.primary.Len(),
+		Rows_appended: c.rows_appended,
+		Rows_written:  c.rows_written,
+	}
+}
+
+// The number of rows in the column
+func (c *Column) GetSize() int {
+	size := 0
 	for node := c.primary.Front(); node != nil; node = node.Next() {
-		node.Value.(Physical).Delete()
+		size += node.Value.(Physical).GetSize()
 	}
+	return size
+}
 
-	for node := new_nodes.Front(); node != nil; node = node.Next() {
-		size := node.Value.(Physical).GetSize()
-		filename := filepath.Join(c.base_dir, fmt.Sprintf("%d", size))
-		node.Value.(Physical).Move(filename)
+// Append size values from data as a new run, compacting the runs as needed.
+// On error the column is left as it was.
+func (c *Column) Insert(data <-chan interface{}, size int) error {
+	pending, err := c.Prepare(data, size, nil)
+	if err != nil {
+		return err
+	}
+	pending.Retire()
+	if err := pending.Promote(); err != nil {
+		return err
 	}
+	return pending.DeleteRetired()
+}
 
-	c.primary = new_nodes
+/*
+The new run of a column being appended to.  It sits next to the runs it
+replaces, named with TMP_SUFFIX, until Retire takes the replaced runs out of
+the column and Promote moves it into place.  Splitting the append this way
+lets a table commit the appends to all its columns at once.  The files of the
+replaced runs stay until DeleteRetired, for the snapshots still reading them.
+*/
+type Pending struct {
+	column    *Column
+	keep      int        // the leading runs that are left in place
+	start     int        // the position of the first row replaced or appended
+	physicals *list.List // the new runs, which replace the others
+	retired   []Physical
+
+	rows_appended int
+	rows_written  int
+	rows_dropped  int
 }
 
-func (c *Column) insert(data <-chan interface{}, size int) (Physical, error) {
+// Write size values from data as a new run, merged with the runs that the
+// compaction policy picks, without touching the existing runs.  Rows for
+// which dropped, if given, returns true are left out of the new run; it is
+// passed the position of a row in the column, counting the appended rows as
+// following the existing ones.
+func (c *Column) Prepare(data <-chan interface{}, size int, dropped func(int) bool) (*Pending, error) {
+	runs := make([]*run, 0, c.primary.Len())
+	for node := c.primary.Front(); node != nil; node = node.Next() {
+		runs = append(runs, node.Value.(*run))
+	}
+	insert := 0
+	if len(runs) > 0 {
+		insert = runs[len(runs)-1].hi + 1
+	}
 
-	back := c.primary.Back()
-	// check it conflicts with the last node
-	if back == nil || back.Value.(Physical).GetSize() != size { // no conflict
-		switch c.schema.GetType(c.rank) {
-		case datatypes.INT64_TYPE:
-			filename := filepath.Join(c.base_dir, fmt.Sprintf("%d", size))
-			p_col := NewPhysicalInt64(filename, data, size)
-			c.primary.PushBack(p_col)
-			return p_col, nil
-		default:
-			return nil, fmt.Errorf("Invalid schema type")
+	keep := len(runs)
+	if size > 0 {
+		keep = compactFrom(runs, size)
+	}
+	pending := &Pending{
+		column:        c,
+		keep:          keep,
+		physicals:     list.New(),
+		rows_appended: size,
+	}
+	for _, r := range runs[:keep] {
+		pending.start += r.GetSize()
+	}
+	replaced := make([]Physical, 0, len(runs)-keep)
+	n_rows := size
+	for _, r := range runs[keep:] {
+		replaced = append(replaced, r.Physical)
+		n_rows += r.GetSize()
+	}
+	if n_rows == 0 {
+		return pending, nil
+	}
+	if dropped != nil {
+		for pos := pending.start; pos < pending.start+n_rows; pos++ {
+			if dropped(pos) {
+				pending.rows_dropped++
+			}
 		}
-	} else { // merge conflict
-		p_col := back.Value.(Physical)
-		old_data := p_col.ReadAll()
+	}
+	pending.rows_written = n_rows - pending.rows_dropped
 
-		new_size := p_col.GetSize() + size
-		new_data := make(chan interface{})
-		go func() {
-			for datum := range old_data {
-				new_data <- datum
+	// the data of the replaced runs followed by the new data, less the
+	// dropped rows
+	old_data, read_errs := concat(context.Background(), replaced...)
+	all_data := make(chan interface{})
+	go func() {
+		defer close(all_data)
+		pos := pending.start
+		send := func(datum interface{}) {
+			if dropped == nil || !dropped(pos) {
+				all_data <- datum
 			}
-			for datum := range data {
-				new_data <- datum
+			pos++
+		}
+		for datum := range old_data {
+			send(datum)
+		}
+		for i := 0; i < size; i++ {
+			datum, ok := <-data
+			if !ok {
+				break
 			}
-			close(new_data)
-		}()
+			send(datum)
+		}
+	}()
+
+	// a run is written even if every row was dropped, as it records which
+	// runs it replaces
+	if len(replaced) == 0 && pending.rows_written == 0 {
+		drain(all_data)
+		return pending, inColumn(<-read_errs, c.tablename, c.rank)
+	}
+	new_run := &run{lo: insert, hi: insert}
+	if len(replaced) > 0 {
+		new_run.lo = runs[keep].lo
+	}
+	filename := filepath.Join(c.base_dir, runName(new_run.lo, new_run.hi, pending.rows_written)+TMP_SUFFIX)
+	physical, err := c.newPhysical(filename, all_data, pending.rows_written)
+	if err != nil {
+		drain(all_data)
+		if read_err := <-read_errs; read_err != nil {
+			return nil, inColumn(read_err, c.tablename, c.rank) // the underlying cause
+		}
+		return nil, err
+	}
+	new_run.Physical = physical
+	pending.physicals.PushBack(new_run)
+	if read_err := <-read_errs; read_err != nil {
+		pending.Abort()
+		drain(all_data)
+		return nil, inColumn(read_err, c.tablename, c.rank)
+	}
+
+	return pending, nil
+}
+
+// The position in the column of the first row of the new run
+func (p *Pending) Start() int {
+	return p.start
+}
+
+// The number of rows left out of the new run
+func (p *Pending) Dropped() int {
+	return p.rows_dropped
+}
 
-		c.primary.Remove(back)
-		new_p_col, insert_err := c.insert(new_data, new_size)
-		if insert_err != nil {
-			return nil, insert_err
+// The index of the first run to merge with a new run of size rows.  The
+// newest runs are merged once COMPACTION_FANOUT of them share a tier, and the
+// merged run may complete a group of the next tier, like the carries of a
+// counter.
+func compactFrom(runs []*run, size int) int {
+	sizes := make([]int, 0, len(runs)+1)
+	for _, r := range runs {
+		sizes = append(sizes, r.GetSize())
+	}
+	sizes = append(sizes, size)
+
+	keep := len(runs)
+	for {
+		last := len(sizes) - 1
+		first := last
+		for first > 0 && tier(sizes[first-1]) == tier(sizes[last]) {
+			first--
+		}
+		if last-first+1 < COMPACTION_FANOUT {
+			return keep
+		}
+
+		merged := 0
+		for _, size := range sizes[first:] {
+			merged += size
+		}
+		sizes = append(sizes[:first], merged)
+		if first < keep {
+			keep = first
+		}
+	}
+}
+
+// The compaction tier of a run of size rows
+func tier(size int) int {
+	t := 0
+	for ; size >= COMPACTION_FANOUT; size /= COMPACTION_FANOUT {
+		t++
+	}
+	return t
+}
+
+// The file name of a run holding size rows from inserts lo to hi
+func runName(lo, hi, size int) string {
+	return fmt.Sprintf("%d_%d_%d", lo, hi, size)
+}
+
+// The inverse of runName
+func parseRunName(name string) (lo, hi, size int, ok bool) {
+	parts := strings.Split(name, "_")
+	if len(parts) != 3 {
+		return 0, 0, 0, false
+	}
+	numbers := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, 0, 0, false
+		}
+		numbers[i] = n
+	}
+	return numbers[0], numbers[1], numbers[2], true
+}
+
+// Best effort removal of the new runs, leaving the column as it was
+func (p *Pending) Abort() {
+	for node := p.physicals.Front(); node != nil; node = node.Next() {
+		node.Value.(Physical).Delete()
+	}
+	p.physicals.Init()
+}
+
+// Take the runs being replaced out of the column, which reads as truncated
+// until Promote
+func (p *Pending) Retire() {
+	c := p.column
+	node := c.primary.Front()
+	for i := 0; i < p.keep && node != nil; i++ {
+		node = node.Next()
+	}
+	for node != nil {
+		next := node.Next()
+		p.retired = append(p.retired, node.Value.(Physical))
+		c.primary.Remove(node)
+		node = next
+	}
+}
+
+// Remove the files of the retired runs, once no snapshot reads them
+func (p *Pending) DeleteRetired() error {
+	for len(p.retired) > 0 {
+		if err := p.retired[0].Delete(); err != nil {
+			return err
 		}
+		p.retired = p.retired[1:]
+	}
+	return nil
+}
+
+// Move the new runs into place
+func (p *Pending) Promote() error {
+	c := p.column
+	for node := p.physicals.Front(); node != nil; node = node.Next() {
+		r := node.Value.(*run)
+		filename := filepath.Join(c.base_dir, runName(r.lo, r.hi, r.GetSize()))
+		if err := r.Move(filename); err != nil {
+			return err
+		}
+	}
+	if err := database.SyncDir(c.base_dir); err != nil {
+		return err
+	}
 
-		p_col.Delete()
+	c.primary.PushBackList(p.physicals)
+	c.rows_appended += int64(p.rows_appended)
+	c.rows_written += int64(p.rows_written)
+	return nil
+}
 
-		return new_p_col, nil
+// Create a physical column of this column's type from the data on the channel
+func (c *Column) newPhysical(filename string, data <-chan interface{}, size int) (Physical, error) {
+	var physical Physical
+	var err error
+	compression := c.schema.Compression
+	switch c.schema.GetType(c.rank) {
+	case datatypes.INT64_TYPE:
+		physical, err = newInt64Run(filename, data, size, c.schema.HasBloomFilter(c.rank), compression)
+	case datatypes.FLOAT64_TYPE:
+		physical, err = newPhysicalFloat64(filename, data, size, compression)
+	case datatypes.STRING_TYPE:
+		physical, err = newPhysicalString(filename, data, size, compression)
+	default:
+		drain(data)
+		return nil, fmt.Errorf("Invalid data type %s", c.schema.GetType(c.rank))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return physical, nil
+}
+
+// Open an existing physical column of this column's type, checking the header
+// of its data file against it
+func (c *Column) loadPhysical(filename string, size int) (Physical, error) {
+	h, err := checkHeader(filename, c.schema.GetType(c.rank), size)
+	if err != nil {
+		return nil, inColumn(err, c.tablename, c.rank)
+	}
+	switch c.schema.GetType(c.rank) {
+	case datatypes.INT64_TYPE:
+		physical, err := loadInt64Run(filename, size, h)
+		if err != nil {
+			return nil, inColumn(err, c.tablename, c.rank)
+		}
+		return physical, nil
+	case datatypes.FLOAT64_TYPE:
+		return LoadPhysicalFloat64(filename, size), nil
+	case datatypes.STRING_TYPE:
+		return LoadPhysicalString(filename, size), nil
+	default:
+		return nil, fmt.Errorf("Invalid data type %s", c.schema.GetType(c.rank))
 	}
 }
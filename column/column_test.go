@@ -1,38 +1,39 @@
 package column
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
 	"testing"
 
+	"github.com/jinpan/stuffdb/database"
 	"github.com/jinpan/stuffdb/datatypes"
 	"github.com/jinpan/stuffdb/schema"
 )
 
-func column_setup(t *testing.T) {
-	err := os.MkdirAll("/var/stuffdb/test_table/c0", 0700)
+func column_setup(t *testing.T) *database.Database {
+	db, err := database.Open(t.TempDir())
 	if err != nil {
-		t.Error(err.Error())
+		t.Fatal(err)
 	}
+	return db
 }
 
-func column_cleanup(t *testing.T) {
-	testpath := path.Join(
-		"/var",
-		"stuffdb",
-		"test_table",
-	)
-	remove_err := os.RemoveAll(testpath)
-	if remove_err != nil {
-		t.Errorf(remove_err.Error())
+// The files of the runs in dir, leaving out their zone maps
+func runFiles(dir string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	var runs []os.FileInfo
+	for _, fi := range files {
+		if dataFileName(fi.Name()) == fi.Name() {
+			runs = append(runs, fi)
+		}
 	}
+	return runs, err
 }
 
 func TestInsert(t *testing.T) {
-	column_setup(t)
-	defer column_cleanup(t)
+	db := column_setup(t)
 
 	names1 := []string{
 		"a",
@@ -44,12 +45,12 @@ func TestInsert(t *testing.T) {
 	}
 	schema, err := schema.NewSchema(names1, types1)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
 	}
 
-	col := NewColumn("test_table", schema, 0)
-	if col == nil {
-		t.Errorf("Unable to create new column")
+	col, err := NewColumn(db, "test_table", schema, 0)
+	if err != nil {
+		t.Fatalf("Unable to create new column: %s", err.Error())
 	}
 
 	n_records := 4096
@@ -68,7 +69,9 @@ func TestInsert(t *testing.T) {
 		}
 		close(ch1)
 	}()
-	col.Insert(ch1, 1024)
+	if err := col.Insert(ch1, 1024); err != nil {
+		t.Fatal(err)
+	}
 
 	if col.primary.Len() != 1 {
 		t.Errorf("Incorrect number of physical columns")
@@ -77,22 +80,22 @@ func TestInsert(t *testing.T) {
 	for i := 0; i < 1024; i++ {
 		datum, err := col.GetDatum(i)
 		if err != nil {
-			t.Errorf(err.Error())
+			t.Error(err)
 		}
 		if datum.(int64) != data[i] {
 			t.Errorf("Read back the wrong value")
 		}
 	}
 
-	files, err := ioutil.ReadDir(col.base_dir)
+	files, err := runFiles(col.base_dir)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
 	}
 	if len(files) != 1 {
 		t.Errorf("Expected 1 files, got %d", len(files))
 	}
 
-	// test the second insertion (1 merge)
+	// test the second insertion (no merge)
 	ch2 := make(chan interface{})
 	go func() {
 		for i := int64(1024); i < 2048; i++ {
@@ -100,28 +103,30 @@ func TestInsert(t *testing.T) {
 		}
 		close(ch2)
 	}()
-	col.Insert(ch2, 1024)
+	if err := col.Insert(ch2, 1024); err != nil {
+		t.Fatal(err)
+	}
 
-	if col.primary.Len() != 1 {
-		t.Errorf("Expected %d physical columns, got %d", 1, col.primary.Len())
+	if col.primary.Len() != 2 {
+		t.Errorf("Expected %d physical columns, got %d", 2, col.primary.Len())
 	}
 
 	for i := 0; i < 2048; i++ {
 		datum, err := col.GetDatum(i)
 		if err != nil {
-			t.Errorf(err.Error())
+			t.Error(err)
 		}
 		if datum.(int64) != data[i] {
 			t.Errorf("Read back the wrong value")
 		}
 	}
 
-	files, err = ioutil.ReadDir(col.base_dir)
+	files, err = runFiles(col.base_dir)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
 	}
-	if len(files) != 1 {
-		t.Errorf("Expected %d files, got %d", 1, len(files))
+	if len(files) != 2 {
+		t.Errorf("Expected %d files, got %d", 2, len(files))
 	}
 
 	// test the third insertion (no merge)
@@ -132,10 +137,12 @@ func TestInsert(t *testing.T) {
 		}
 		close(ch3)
 	}()
-	col.Insert(ch3, 1024)
+	if err := col.Insert(ch3, 1024); err != nil {
+		t.Fatal(err)
+	}
 
-	if col.primary.Len() != 2 {
-		t.Errorf("Expected %d physical columns, got %d", 2, col.primary.Len())
+	if col.primary.Len() != 3 {
+		t.Errorf("Expected %d physical columns, got %d", 3, col.primary.Len())
 		fmt.Println(col.primary.Front().Value.(Physical).GetSize())
 	}
 
@@ -144,22 +151,22 @@ func TestInsert(t *testing.T) {
 		if err != nil {
 			fmt.Println("XXX", col.primary.Front().Value.(Physical).GetSize())
 			fmt.Println("XXX", col.primary.Front().Next().Value.(Physical).GetSize())
-			t.Errorf(err.Error())
+			t.Error(err)
 		}
 		if datum.(int64) != data[i] {
 			t.Errorf("Read back the wrong value")
 		}
 	}
 
-	files, err = ioutil.ReadDir(col.base_dir)
+	files, err = runFiles(col.base_dir)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
 	}
-	if len(files) != 2 {
-		t.Errorf("Expected %d files, got %d", 2, len(files))
+	if len(files) != 3 {
+		t.Errorf("Expected %d files, got %d", 3, len(files))
 	}
 
-	// test the fourth insertion (2 merge)
+	// test the fourth insertion (merges the four runs)
 	ch4 := make(chan interface{})
 	go func() {
 		for i := int64(3072); i < 4096; i++ {
@@ -167,7 +174,9 @@ func TestInsert(t *testing.T) {
 		}
 		close(ch4)
 	}()
-	col.Insert(ch4, 1024)
+	if err := col.Insert(ch4, 1024); err != nil {
+		t.Fatal(err)
+	}
 
 	if col.primary.Len() != 1 {
 		t.Errorf("Expected %d physical columns, got %d", 1, col.primary.Len())
@@ -176,18 +185,170 @@ func TestInsert(t *testing.T) {
 	for i := 0; i < 4096; i++ {
 		datum, err := col.GetDatum(i)
 		if err != nil {
-			t.Errorf(err.Error())
+			t.Error(err)
 		}
 		if datum.(int64) != data[i] {
 			t.Errorf("Read back the wrong value")
 		}
 	}
 
-	files, err = ioutil.ReadDir(col.base_dir)
+	files, err = runFiles(col.base_dir)
 	if err != nil {
-		t.Errorf(err.Error())
+		t.Error(err)
 	}
 	if len(files) != 1 {
 		t.Errorf("Expected %d files, got %d", 1, len(files))
 	}
 }
+
+// Append the values [from, to) to the column
+func insertRange(t *testing.T, col *Column, from, to int64) {
+	ch := make(chan interface{})
+	go func() {
+		for i := from; i < to; i++ {
+			ch <- i
+		}
+		close(ch)
+	}()
+	if err := col.Insert(ch, int(to-from)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Check that the column holds the values [0, n)
+func checkRange(t *testing.T, col *Column, n int64) {
+	cv := col.Scan(context.Background())
+	i := int64(0)
+	for vector := range cv.C {
+		for k := 0; k < vector.Len(); k++ {
+			if vector.Get(k) != i {
+				t.Fatalf("Expected %d, got %v", i, vector.Get(k))
+			}
+			i++
+		}
+	}
+	if err := cv.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != n {
+		t.Errorf("Expected %d values, got %d", n, i)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	db := column_setup(t)
+	s, err := schema.NewSchema([]string{"a"}, []datatypes.DatumType{datatypes.INT64_TYPE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	col, err := NewColumn(db, "test_table", s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 64 appends of tier 5 end up as a single run of tier 8, each row
+	// written at most once per tier
+	n := int64(0)
+	for i := 0; i < 64; i++ {
+		insertRange(t, col, n, n+1024)
+		n += 1024
+		if runs := col.Stats().Runs; runs > 4*(COMPACTION_FANOUT-1) {
+			t.Errorf("Expected at most %d runs, got %d", 4*(COMPACTION_FANOUT-1), runs)
+		}
+	}
+	stats := col.Stats()
+	if stats.Runs != 1 || stats.Rows_appended != n || stats.WriteAmplification() > 4 {
+		t.Errorf("Unexpected stats %+v (write amplification %f)", stats, stats.WriteAmplification())
+	}
+
+	// a large append is left alone until smaller runs catch up with it
+	insertRange(t, col, n, n+5000)
+	n += 5000
+	for i := 0; i < 3; i++ {
+		insertRange(t, col, n, n+1024)
+		n += 1024
+	}
+	if runs := col.Stats().Runs; runs != 5 {
+		t.Errorf("Expected %d runs, got %d", 5, runs)
+	}
+	checkRange(t, col, n)
+
+	loaded, err := Load(db, "test_table", s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, loaded, n)
+}
+
+func TestRecoverCompaction(t *testing.T) {
+	db := column_setup(t)
+	s, err := schema.NewSchema([]string{"a"}, []datatypes.DatumType{datatypes.STRING_TYPE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	col, err := NewColumn(db, "test_table", s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []interface{}
+	appendStrings := func(n int) *Pending {
+		ch := make(chan interface{})
+		go func() {
+			for i := 0; i < n; i++ {
+				datum := fmt.Sprintf("%d", len(expected)+i)
+				ch <- datum
+			}
+			close(ch)
+		}()
+		pending, err := col.Prepare(ch, n, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			expected = append(expected, fmt.Sprintf("%d", len(expected)))
+		}
+		return pending
+	}
+
+	// a run of tier 6, then three of tier 5
+	for _, n := range []int{4096, 1024, 1024, 1024} {
+		pending := appendStrings(n)
+		pending.Retire()
+		if err := pending.Promote(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the fourth run of tier 5 merges the last three, and the process dies
+	// having deleted just one of them
+	pending := appendStrings(1024)
+	if pending.keep != 1 {
+		t.Fatalf("Expected to keep %d run, kept %d", 1, pending.keep)
+	}
+	if err := col.primary.Back().Value.(Physical).Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteReplaced(db, "test_table", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := PromotePending(db, "test_table", 0); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(db, "test_table", s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.primary.Len() != 2 {
+		t.Errorf("Expected %d runs, got %d", 2, loaded.primary.Len())
+	}
+	for i, datum := range expected {
+		value, err := loaded.GetDatum(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != datum {
+			t.Fatalf("Expected %v at %d, got %v", datum, i, value)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package column
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/jinpan/stuffdb/schema"
+)
+
+const (
+	// the bytes of data compressed together
+	COMPRESSION_BLOCK_SIZE = 64 << 10
+
+	// the size of the data and the block size closing the block index
+	index_trailer_size = 12
+)
+
+/*
+	The data file of a physical column, of any type or encoding, may be
+	compressed as it is written, when its table's schema asks for it.  The
+	data is cut into blocks of COMPRESSION_BLOCK_SIZE bytes, the last one
+	short, and each block is compressed on its own, so that a read only
+	decompresses the blocks it overlaps.  The compressed blocks are followed by the block
+	index: the offset at which each compressed block ends, the size of the
+	uncompressed data and the block size, all little-endian, as uint64s, a
+	uint64 and a uint32.  The header of a compressed file names its codec,
+	and its checksums cover the index along with the blocks.  A block that
+	would not shrink is stored as it is, so incompressible data costs little
+	more than the index.
+
+	The heap of a string column is compressed the same way, apart from its
+	offsets.  Readers open data files and heaps with openData, which hides
+	the compression.
+
+*/
+
+type codec struct {
+	id    uint32
+	name  string
+	write func(w io.Writer, level int) (io.WriteCloser, error)
+	read  func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = []codec{
+	{
+		id:   1,
+		name: schema.CODEC_FLATE,
+		write: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		read: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	},
+	{
+		id:   2,
+		name: schema.CODEC_ZLIB,
+		write: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		read: zlib.NewReader,
+	},
+}
+
+func findCodec(match func(c codec) bool) (codec, bool) {
+	for _, c := range codecs {
+		if match(c) {
+			return c, true
+		}
+	}
+	return codec{}, false
+}
+
+// Compress the block of data being filled into the body.  A block that does
+// not shrink is stored as it is.
+func (w *sealedWriter) compressBlock() error {
+	buf := new(bytes.Buffer)
+	cw, codec_err := w.codec.write(buf, w.level)
+	if codec_err != nil {
+		return codec_err
+	}
+	if _, write_err := cw.Write(w.block); write_err != nil {
+		return write_err
+	}
+	if close_err := cw.Close(); close_err != nil {
+		return close_err
+	}
+	stored := buf.Bytes()
+	if len(stored) >= len(w.block) {
+		stored = w.block
+	}
+	if err := w.writeBody(stored); err != nil {
+		return err
+	}
+	w.size += uint64(len(w.block))
+	w.stored += uint64(len(stored))
+	w.ends = append(w.ends, w.stored)
+	w.block = w.block[:0]
+	return nil
+}
+
+// Compress what is left of the data and close the body with the block index
+func (w *sealedWriter) writeIndex() error {
+	if len(w.block) > 0 {
+		if err := w.compressBlock(); err != nil {
+			return err
+		}
+	}
+	index := new(bytes.Buffer)
+	binary.Write(index, binary.LittleEndian, w.ends)
+	binary.Write(index, binary.LittleEndian, w.size)
+	binary.Write(index, binary.LittleEndian, uint32(COMPRESSION_BLOCK_SIZE))
+	return w.writeBody(index.Bytes())
+}
+
+// The data file of a physical column, read as if it were not compressed
+type dataFile interface {
+	io.ReaderAt
+	io.Closer
+
+	// the size of the uncompressed data
+	Size() int64
+}
+
+type compressedFile struct {
+	body       dataFile // the compressed blocks
+	filename   string
+	codec      codec
+	block_size int
+	size       int64
+	ends       []uint64
+
+	mu     sync.Mutex
+	cached int // the block held by block, or -1
+	block  []byte
+}
+
+// Open a data file for reading, whether or not it is compressed
+func openData(filename string) (dataFile, error) {
+	f, open_err := os.Open(filename)
+	if open_err != nil {
+		return nil, open_err
+	}
+
+	h, header_err := readHeader(f, filename)
+	if header_err != nil {
+		f.Close()
+		return nil, header_err
+	}
+	body, check_err := openChecked(f, filename, h)
+	if check_err != nil {
+		f.Close()
+		return nil, check_err
+	}
+	if h.codec == 0 {
+		return body, nil
+	}
+
+	c, _ := findCodec(func(c codec) bool { return c.id == h.codec })
+	cf, index_err := readBlockIndex(body, filename, c)
+	if index_err != nil {
+		body.Close()
+		return nil, index_err
+	}
+	return cf, nil
+}
+
+// Read the block index at the end of the body of a compressed data file
+func readBlockIndex(body dataFile, filename string, c codec) (*compressedFile, error) {
+	corrupt := corruptFile(filename, "invalid block index")
+	if body.Size() < index_trailer_size {
+		return nil, corrupt
+	}
+	trailer := make([]byte, index_trailer_size)
+	if _, read_err := body.ReadAt(trailer, body.Size()-index_trailer_size); read_err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %w", filename, read_err)
+	}
+	size := binary.LittleEndian.Uint64(trailer)
+	block_size := uint64(binary.LittleEndian.Uint32(trailer[8:]))
+	if block_size == 0 {
+		return nil, corrupt
+	}
+	n_blocks := size/block_size + (size%block_size+block_size-1)/block_size
+	if n_blocks > uint64(body.Size()-index_trailer_size)/8 {
+		return nil, corrupt
+	}
+	index_start := uint64(body.Size()-index_trailer_size) - 8*n_blocks
+
+	index := make([]byte, 8*n_blocks)
+	if _, read_err := body.ReadAt(index, int64(index_start)); read_err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %w", filename, read_err)
+	}
+	cf := &compressedFile{
+		body:       body,
+		filename:   filename,
+		codec:      c,
+		block_size: int(block_size),
+		size:       int64(size),
+		ends:       make([]uint64, n_blocks),
+		cached:     -1,
+	}
+	var end uint64
+	for b := range cf.ends {
+		cf.ends[b] = binary.LittleEndian.Uint64(index[8*b:])
+		if cf.ends[b] < end {
+			return nil, corrupt
+		}
+		end = cf.ends[b]
+	}
+	if end != index_start {
+		return nil, corrupt
+	}
+	return cf, nil
+}
+
+func (cf *compressedFile) Size() int64 {
+	return cf.size
+}
+
+func (cf *compressedFile) Close() error {
+	return cf.body.Close()
+}
+
+// Decompress block b into cf.block, unless it is there already
+func (cf *compressedFile) load(b int) error {
+	if cf.cached == b {
+		return nil
+	}
+	cf.cached = -1
+
+	var start uint64
+	if b > 0 {
+		start = cf.ends[b-1]
+	}
+	compressed := make([]byte, cf.ends[b]-start)
+	if _, read_err := cf.body.ReadAt(compressed, int64(start)); read_err != nil {
+		return read_err
+	}
+
+	size := cf.size - int64(b*cf.block_size)
+	if size > int64(cf.block_size) {
+		size = int64(cf.block_size)
+	}
+	if int64(len(compressed)) == size {
+		// stored as it is, not having shrunk
+		cf.block, cf.cached = append(cf.block[:0], compressed...), b
+		return nil
+	}
+	r, codec_err := cf.codec.read(bytes.NewReader(compressed))
+	if codec_err != nil {
+		return corruptFile(cf.filename, "unable to decompress block %d: %s", b, codec_err.Error())
+	}
+	defer r.Close()
+	cf.block = cf.block[:0]
+	buf := bytes.NewBuffer(cf.block)
+	if _, copy_err := io.Copy(buf, r); copy_err != nil {
+		return corruptFile(cf.filename, "unable to decompress block %d: %s", b, copy_err.Error())
+	}
+	if int64(buf.Len()) != size {
+		return corruptFile(cf.filename, "block %d decompresses to %d bytes instead of %d", b, buf.Len(), size)
+	}
+	cf.block, cf.cached = buf.Bytes(), b
+	return nil
+}
+
+// Read the uncompressed bytes from off on, decompressing the blocks they are in
+func (cf *compressedFile) ReadAt(p []byte, off int64) (int, error) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off >= cf.size {
+			return n, io.EOF
+		}
+		b := int(off / int64(cf.block_size))
+		if err := cf.load(b); err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], cf.block[off-int64(b*cf.block_size):])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
@@ -0,0 +1,248 @@
+package column
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+)
+
+// A column of a single value of the type, compressed with the codec, with one
+// run of the given values
+func insertCompressed(t *testing.T, data_type datatypes.DatumType, codec string, data []interface{}) *Column {
+	db := column_setup(t)
+	s, err := schema.NewSchema([]string{"a"}, []datatypes.DatumType{data_type})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = s.WithCompression(codec, flate.DefaultCompression); err != nil {
+		t.Fatal(err)
+	}
+	col, err := NewColumn(db, "compressed", s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan interface{})
+	go func() {
+		for _, datum := range data {
+			ch <- datum
+		}
+		close(ch)
+	}()
+	if err := col.Insert(ch, len(data)); err != nil {
+		t.Fatal(err)
+	}
+	return col
+}
+
+func physicalFilename(p Physical) string {
+	switch p := p.(type) {
+	case *PhysicalFloat64:
+		return p.filename
+	case *PhysicalString:
+		return p.filename
+	}
+	return ""
+}
+
+func TestCompression(t *testing.T) {
+	floats := make([]interface{}, 3*COMPRESSION_BLOCK_SIZE/8+100)
+	for i := range floats {
+		floats[i] = float64(i%100) / 4
+	}
+	strs := make([]interface{}, 20000)
+	for i := range strs {
+		strs[i] = []string{"red", "green", "blue"}[i%3]
+	}
+
+	for _, codec := range []string{schema.CODEC_FLATE, schema.CODEC_ZLIB} {
+		for _, test := range []struct {
+			data_type datatypes.DatumType
+			data      []interface{}
+		}{{datatypes.FLOAT64_TYPE, floats}, {datatypes.STRING_TYPE, strs}} {
+			col := insertCompressed(t, test.data_type, codec, test.data)
+			physical := col.primary.Front().Value.(*run).Physical
+			fi, err := os.Stat(physicalFilename(physical))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := int64(len(test.data) * 8); fi.Size() >= size/4 {
+				t.Errorf("Expected %s to compress %d bytes of %s well, got %d", codec, size, test.data_type, fi.Size())
+			}
+			if test.data_type == datatypes.STRING_TYPE {
+				heap := physicalFilename(physical) + HEAP_SUFFIX
+				if heap_codec, err := FileCodec(heap); err != nil || heap_codec != codec {
+					t.Errorf("Expected the heap to be compressed with %s, got %q (%v)", codec, heap_codec, err)
+				}
+			}
+
+			checkRead(t, physical, test.data, 0, len(test.data))
+			checkRead(t, physical, test.data, COMPRESSION_BLOCK_SIZE/8-3, COMPRESSION_BLOCK_SIZE/8+3)
+			if datum, err := physical.ReadOne(len(test.data) - 1); err != nil || datum != test.data[len(test.data)-1] {
+				t.Errorf("Expected %v, got %v (%v)", test.data[len(test.data)-1], datum, err)
+			}
+		}
+	}
+}
+
+func TestCompressionStoresIncompressibleBlocks(t *testing.T) {
+	data := make([]interface{}, 2000)
+	for i := range data {
+		data[i] = float64(mix(uint64(i)))
+	}
+	col := insertCompressed(t, datatypes.FLOAT64_TYPE, schema.CODEC_FLATE, data)
+	physical := col.primary.Front().Value.(*run).Physical.(*PhysicalFloat64)
+	h, err := readHeaderOf(physical.filename)
+	if err != nil || h.codec == 0 {
+		t.Fatalf("Expected the data to be compressed, got %+v (%v)", h, err)
+	}
+	// the one block costs no more than if it were stored as it is
+	if limit := int64(len(data)*8 + 8 + index_trailer_size); h.body_size > limit {
+		t.Errorf("Expected a body of at most %d bytes, got %d", limit, h.body_size)
+	}
+	checkRead(t, physical, data, 0, len(data))
+}
+
+func TestCompressedMerge(t *testing.T) {
+	dir := t.TempDir()
+	compression := &schema.Compression{Codec: schema.CODEC_ZLIB, Level: flate.DefaultCompression}
+	send := func(data []interface{}) <-chan interface{} {
+		ch := make(chan interface{})
+		go func() {
+			for _, datum := range data {
+				ch <- datum
+			}
+			close(ch)
+		}()
+		return ch
+	}
+	floats := make([]interface{}, 3000)
+	strs := make([]interface{}, 3000)
+	for i := range floats {
+		floats[i] = float64(i % 10)
+		strs[i] = []string{"red", "green", "blue"}[i%3]
+	}
+
+	f1, err := newPhysicalFloat64(filepath.Join(dir, "f1"), send(floats), len(floats), compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := newPhysicalFloat64(filepath.Join(dir, "f2"), send(floats), len(floats), compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged_floats, err := f1.Merge(f2, filepath.Join(dir, "f3"), compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s1, err := newPhysicalString(filepath.Join(dir, "s1"), send(strs), len(strs), compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := newPhysicalString(filepath.Join(dir, "s2"), send(strs), len(strs), compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged_strs, err := s1.Merge(s2, filepath.Join(dir, "s3"), compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{merged_floats.filename, merged_strs.filename, merged_strs.filename + HEAP_SUFFIX} {
+		if codec, err := FileCodec(filename); err != nil || codec != schema.CODEC_ZLIB {
+			t.Errorf("Expected %s to be compressed with %s, got %q (%v)", filename, schema.CODEC_ZLIB, codec, err)
+		}
+	}
+	checkRead(t, merged_floats, append(floats, floats...), 0, 2*len(floats))
+	checkRead(t, merged_strs, append(strs, strs...), 0, 2*len(strs))
+}
+
+// Write the data to a new sealed file with the compression
+func writeSealed(t *testing.T, filename string, data []byte, compression *schema.Compression) {
+	w, err := createSealed(filename, datatypes.INT64_TYPE, ENCODING_PLAIN, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		t.Fatal(err)
+	}
+	if err := w.Close(len(data) / 8); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressedFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "data")
+	data := make([]byte, 2*COMPRESSION_BLOCK_SIZE+10)
+	for i := range data {
+		data[i] = byte(i % 7)
+	}
+	writeSealed(t, filename, data, &schema.Compression{Codec: schema.CODEC_FLATE, Level: flate.BestSpeed})
+	if h, err := readHeaderOf(filename); err != nil || h.codec == 0 || h.body_size >= int64(len(data)) {
+		t.Fatalf("Expected the data to be compressed, got %+v (%v)", h, err)
+	}
+
+	f, err := openData(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Size() != int64(len(data)) {
+		t.Errorf("Expected %d bytes, got %d", len(data), f.Size())
+	}
+	for _, off := range []int{0, COMPRESSION_BLOCK_SIZE - 5, 2*COMPRESSION_BLOCK_SIZE + 5, 17} {
+		buf := make([]byte, 10)
+		n, err := f.ReadAt(buf, int64(off))
+		if expected := len(data) - off; expected < len(buf) {
+			if n != expected || err != io.EOF {
+				t.Errorf("Expected %d bytes and EOF at %d, got %d (%v)", expected, off, n, err)
+			}
+		} else if err != nil || n != len(buf) {
+			t.Errorf("Expected %d bytes at %d, got %d (%v)", len(buf), off, n, err)
+		}
+		for k := 0; k < n; k++ {
+			if buf[k] != data[off+k] {
+				t.Fatalf("Expected %d at %d, got %d", data[off+k], off+k, buf[k])
+			}
+		}
+	}
+}
+
+func TestCompressedFileWithoutIndex(t *testing.T) {
+	// a file whose header says it is compressed but whose body is not
+	filename := filepath.Join(t.TempDir(), "data")
+	data := make([]byte, 3*COMPRESSION_BLOCK_SIZE)
+	for i := range data {
+		data[i] = byte(i % 7)
+	}
+	writeSealed(t, filename, data, nil)
+
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, header_size)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(header[40:], codecs[0].id)
+	binary.LittleEndian.PutUint32(header[header_size-4:], crc32.Checksum(header[:header_size-4], crc_table))
+	if _, err := f.WriteAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var corrupt *CorruptionError
+	if _, err := openData(filename); !errors.As(err, &corrupt) {
+		t.Errorf("Expected a corruption error, got %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+package column
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+const (
+	// rows per block of a delta encoded column
+	DELTA_BLOCK_SIZE = 1024
+
+	// how the rows of a block are packed
+	DELTA_MODE_FOR   = 0 // as their difference to the block's base, its minimum
+	DELTA_MODE_DELTA = 1 // as their difference to the row before, zigzag encoded
+
+	delta_entry_size = 24
+)
+
+/*
+	A delta encoded int64 column is cut into blocks of DELTA_BLOCK_SIZE rows,
+	each packed on its own in whichever of two modes takes fewer bits per row:
+	frame of reference, storing each row as its difference to the smallest
+	value of the block, or delta, storing each row as its difference to the
+	row before, the first row being the block's base.  Differences of the
+	delta mode are zigzag encoded so that small steps either way take few
+	bits.  A null is packed as 0, taking the base or the value before it.
+
+	The file starts with an entry per block: its base as a little-endian
+	int64, the offset of its packed rows in the file as a uint64, and the
+	bits per row and mode as uint32s.  The packed rows follow, row k of a
+	block starting at bit k*width of its data, least significant bit first.
+	Reading a range only decodes the blocks it overlaps.
+
+	Sequences such as serial numbers and timestamps, and columns of small
+	numbers, take a few bits per row.
+*/
+
+type PhysicalDeltaInt64 struct {
+	filename string
+	data_len int
+}
+
+// The stats of a block that decide how it is packed
+type deltaBlock struct {
+	rows      int
+	n_values  int // rows that are not null
+	first     int64
+	min, max  int64
+	last      int64
+	max_delta uint64 // the largest zigzag encoded difference between rows
+}
+
+func zigzag(x int64) uint64 {
+	return uint64(x<<1) ^ uint64(x>>63)
+}
+
+func unzigzag(x uint64) int64 {
+	return int64(x>>1) ^ -int64(x&1)
+}
+
+// Add the next row of the block
+func (b *deltaBlock) add(value int64, is_null bool) {
+	b.rows++
+	if is_null {
+		return
+	}
+	if b.n_values == 0 {
+		b.first, b.min, b.max = value, value, value
+	} else {
+		if value < b.min {
+			b.min = value
+		}
+		if value > b.max {
+			b.max = value
+		}
+		if delta := zigzag(value - b.last); delta > b.max_delta {
+			b.max_delta = delta
+		}
+	}
+	b.last = value
+	b.n_values++
+}
+
+// The mode, base and bits per row the block is packed with
+func (b *deltaBlock) packing() (mode int, base int64, width int) {
+	for_width := bitWidth(uint64(b.max - b.min))
+	delta_width := bitWidth(b.max_delta)
+	if delta_width < for_width {
+		return DELTA_MODE_DELTA, b.first, delta_width
+	}
+	return DELTA_MODE_FOR, b.min, for_width
+}
+
+// The bytes the block takes, its entry included
+func (b *deltaBlock) encodedSize() int64 {
+	_, _, width := b.packing()
+	return delta_entry_size + (int64(b.rows)*int64(width)+7)/8
+}
+
+// Write a run in blocks of differences, given the stats of its blocks, which
+// place the blocks ahead of packing them
+func encodeDelta(filename string, r *int64Run, blocks []deltaBlock, compression *schema.Compression) (*PhysicalDeltaInt64, error) {
+	n_blocks := (len(r.values) + DELTA_BLOCK_SIZE - 1) / DELTA_BLOCK_SIZE
+	if len(blocks) != n_blocks {
+		return nil, fmt.Errorf("Size mismatch encoding %s: expected %d blocks, got %d", filename, n_blocks, len(blocks))
+	}
+
+	err := writeEncoded(filename, len(r.values), ENCODING_DELTA, compression, func(w io.Writer) error {
+		entries := make([]byte, n_blocks*delta_entry_size)
+		offset := int64(len(entries))
+		for b, block := range blocks {
+			mode, base, width := block.packing()
+			entry := entries[b*delta_entry_size:]
+			binary.LittleEndian.PutUint64(entry, uint64(base))
+			binary.LittleEndian.PutUint64(entry[8:], uint64(offset))
+			binary.LittleEndian.PutUint32(entry[16:], uint32(width))
+			binary.LittleEndian.PutUint32(entry[20:], uint32(mode))
+			offset += (int64(block.rows)*int64(width) + 7) / 8
+		}
+		if _, write_err := w.Write(entries); write_err != nil {
+			return write_err
+		}
+
+		b := 0
+		return r.blocks(DELTA_BLOCK_SIZE, func(values []int64, nulls []bool) error {
+			mode, base, width := blocks[b].packing()
+			b++
+
+			packed := make([]byte, (len(values)*width+7)/8)
+			last := base
+			for k, value := range values {
+				if nulls != nil && nulls[k] {
+					continue
+				}
+				if mode == DELTA_MODE_FOR {
+					putBits(packed, k*width, width, uint64(value-base))
+				} else {
+					putBits(packed, k*width, width, zigzag(value-last))
+					last = value
+				}
+			}
+			_, write_err := w.Write(packed)
+			return write_err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PhysicalDeltaInt64{
+		filename: filename,
+		data_len: len(r.values),
+	}, nil
+}
+
+func LoadPhysicalDeltaInt64(filename string, size int) *PhysicalDeltaInt64 {
+	return &PhysicalDeltaInt64{
+		filename: filename,
+		data_len: size,
+	}
+}
+
+func (p *PhysicalDeltaInt64) Move(filename string) error {
+	if err := moveCompanions(p.filename, filename); err != nil {
+		return err
+	}
+	if err := os.Rename(p.filename, filename); err != nil {
+		return err
+	}
+	p.filename = filename
+	return nil
+}
+
+func (p *PhysicalDeltaInt64) Delete() error {
+	if remove_err := os.Remove(p.filename); remove_err != nil {
+		return remove_err
+	}
+	return deleteCompanions(p.filename)
+}
+
+// The zone map of the column, nil if it was written without one
+func (p *PhysicalDeltaInt64) ZoneMap() (*ZoneMap, error) {
+	return readZoneMap(p.filename, datatypes.INT64_TYPE, p.data_len)
+}
+
+// The Bloom filter of the column, nil if it was written without one
+func (p *PhysicalDeltaInt64) BloomFilter() (*BloomFilter, error) {
+	return readBloomFilter(p.filename, p.data_len)
+}
+
+func (p *PhysicalDeltaInt64) GetSize() int {
+	return p.data_len
+}
+
+func (p *PhysicalDeltaInt64) ReadOne(i int) (interface{}, error) {
+	return readOne(p, i)
+}
+
+func (p *PhysicalDeltaInt64) ReadAll(ctx context.Context) (*tableview.ColumnView, error) {
+	return p.Read(ctx, 0, p.data_len)
+}
+
+// Read rows [i, j), decoding the blocks that hold them.  The reader gives up
+// once ctx is cancelled.
+func (p *PhysicalDeltaInt64) Read(ctx context.Context, i, j int) (*tableview.ColumnView, error) {
+	return readDecoded(ctx, p.filename, p.data_len, i, j, func(f dataFile) func(int, []int64) error {
+		block := make([]int64, 0, DELTA_BLOCK_SIZE)
+		b := -1 // the block decoded into block
+
+		decode := func() error {
+			entry := make([]byte, delta_entry_size)
+			if _, read_err := f.ReadAt(entry, int64(b)*delta_entry_size); read_err != nil {
+				return fmt.Errorf("Unable to read %s: %w", p.filename, read_err)
+			}
+			base := int64(binary.LittleEndian.Uint64(entry))
+			offset := int64(binary.LittleEndian.Uint64(entry[8:]))
+			width := int(binary.LittleEndian.Uint32(entry[16:]))
+			mode := int(binary.LittleEndian.Uint32(entry[20:]))
+			if width > 64 || (mode != DELTA_MODE_FOR && mode != DELTA_MODE_DELTA) {
+				return corruptFile(p.filename, "invalid block %d", b)
+			}
+
+			rows := p.data_len - b*DELTA_BLOCK_SIZE
+			if rows > DELTA_BLOCK_SIZE {
+				rows = DELTA_BLOCK_SIZE
+			}
+			packed := make([]byte, (rows*width+7)/8)
+			if _, read_err := f.ReadAt(packed, offset); read_err != nil {
+				return fmt.Errorf("Unable to read %s: %w", p.filename, read_err)
+			}
+
+			block = block[:rows]
+			last := base
+			for k := range block {
+				if mode == DELTA_MODE_FOR {
+					block[k] = base + int64(getBits(packed, k*width, width))
+				} else {
+					last += unzigzag(getBits(packed, k*width, width))
+					block[k] = last
+				}
+			}
+			return nil
+		}
+
+		return func(start int, values []int64) error {
+			for k := 0; k < len(values); {
+				if row := start + k; row/DELTA_BLOCK_SIZE != b {
+					b = row / DELTA_BLOCK_SIZE
+					if err := decode(); err != nil {
+						return err
+					}
+				}
+				k += copy(values[k:], block[(start+k)%DELTA_BLOCK_SIZE:])
+			}
+			return nil
+		}
+	})
+}
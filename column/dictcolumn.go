@@ -0,0 +1,249 @@
+package column
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/settings"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+const (
+	DICT_SUFFIX = ".dict"
+
+	// runs with at most this many distinct values may be dictionary encoded
+	DICT_MAX_SIZE = 256
+
+	// the rows whose codes are packed together as the run is written
+	DICT_BLOCK_SIZE = 1024
+)
+
+/*
+	A dictionary encoded int64 column keeps the distinct values of a run,
+	sorted, in a dictionary next to the data file with DICT_SUFFIX appended,
+	sealed like it, as little-endian int64s.  The data file holds the code of
+	each row, the index of its value in the dictionary, packed into 1, 2, 4
+	or 8 bits depending on the size of the dictionary, so that no code
+	straddles two bytes: the code of row k starts at bit k*width of the
+	file, counting from the least significant bit of each byte.  A null has code 0.
+
+	Columns with a handful of distinct values, such as flags and categories,
+	take an eighth of the space of a PhysicalInt64 or less.  They are read as
+	vectors of codes sharing the run's dictionary, which filters and
+	aggregates can work on without decoding; see tableview.Vector.
+*/
+
+type PhysicalDictInt64 struct {
+	filename string
+	data_len int
+}
+
+// The bits taken by each code of a dictionary of n values
+func codeWidth(n int) int {
+	for _, width := range []int{1, 2, 4} {
+		if n <= 1<<uint(width) {
+			return width
+		}
+	}
+	return 8
+}
+
+// The bytes taken by a run of size rows with a dictionary of n values
+func dictEncodedSize(n, size int) int64 {
+	return int64(n)*8 + (int64(size)*int64(codeWidth(n))+7)/8
+}
+
+// Write a run with the dictionary, which must hold every value of the run
+func encodeDict(filename string, r *int64Run, dict []int64, compression *schema.Compression) (*PhysicalDictInt64, error) {
+	codes := make(map[int64]uint8, len(dict))
+	for code, value := range dict {
+		codes[value] = uint8(code)
+	}
+	width := codeWidth(len(dict))
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, dict)
+	if err := writeCompanion(filename+DICT_SUFFIX, datatypes.INT64_TYPE, len(r.values), buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// the codes of a block of DICT_BLOCK_SIZE rows fill whole bytes
+	err := writeEncoded(filename, len(r.values), ENCODING_DICT, compression, func(w io.Writer) error {
+		return r.blocks(DICT_BLOCK_SIZE, func(values []int64, nulls []bool) error {
+			packed := make([]byte, (len(values)*width+7)/8)
+			for k, value := range values {
+				code, ok := codes[value]
+				if !ok && (nulls == nil || !nulls[k]) {
+					return fmt.Errorf("Value %d of %s is not in its dictionary", value, filename)
+				}
+				packed[k*width/8] |= code << uint(k*width%8)
+			}
+			_, write_err := w.Write(packed)
+			return write_err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PhysicalDictInt64{
+		filename: filename,
+		data_len: len(r.values),
+	}, nil
+}
+
+func LoadPhysicalDictInt64(filename string, size int) *PhysicalDictInt64 {
+	return &PhysicalDictInt64{
+		filename: filename,
+		data_len: size,
+	}
+}
+
+// The dictionary of a run of rows
+func readDict(filename string, rows int) ([]int64, error) {
+	data, err := readCompanion(filename+DICT_SUFFIX, datatypes.INT64_TYPE, rows)
+	if err != nil {
+		return nil, err
+	} else if data == nil {
+		return nil, corruptFile(filename+DICT_SUFFIX, "missing dictionary")
+	}
+	if len(data) == 0 || len(data)%8 != 0 || len(data)/8 > DICT_MAX_SIZE {
+		return nil, corruptFile(filename+DICT_SUFFIX, "unexpected size %d", len(data))
+	}
+	dict := make([]int64, len(data)/8)
+	for k := range dict {
+		dict[k] = int64(binary.LittleEndian.Uint64(data[8*k:]))
+	}
+	return dict, nil
+}
+
+func (p *PhysicalDictInt64) Move(filename string) error {
+	if err := moveCompanions(p.filename, filename); err != nil {
+		return err
+	}
+	if err := os.Rename(p.filename, filename); err != nil {
+		return err
+	}
+	p.filename = filename
+	return nil
+}
+
+func (p *PhysicalDictInt64) Delete() error {
+	if remove_err := os.Remove(p.filename); remove_err != nil {
+		return remove_err
+	}
+	return deleteCompanions(p.filename)
+}
+
+// The zone map of the column, nil if it was written without one
+func (p *PhysicalDictInt64) ZoneMap() (*ZoneMap, error) {
+	return readZoneMap(p.filename, datatypes.INT64_TYPE, p.data_len)
+}
+
+// The Bloom filter of the column, nil if it was written without one
+func (p *PhysicalDictInt64) BloomFilter() (*BloomFilter, error) {
+	return readBloomFilter(p.filename, p.data_len)
+}
+
+func (p *PhysicalDictInt64) GetSize() int {
+	return p.data_len
+}
+
+func (p *PhysicalDictInt64) ReadOne(i int) (interface{}, error) {
+	return readOne(p, i)
+}
+
+func (p *PhysicalDictInt64) ReadAll(ctx context.Context) (*tableview.ColumnView, error) {
+	return p.Read(ctx, 0, p.data_len)
+}
+
+// Read rows [i, j) as vectors of codes.  The reader gives up once ctx is
+// cancelled.
+func (p *PhysicalDictInt64) Read(ctx context.Context, i, j int) (*tableview.ColumnView, error) {
+	if j < i {
+		return nil, fmt.Errorf("Second index must be at least as big as the first")
+	}
+
+	dict, dict_err := readDict(p.filename, p.data_len)
+	if dict_err != nil {
+		return nil, dict_err
+	}
+	is_valid, valid_err := readValidity(p.filename, datatypes.INT64_TYPE, p.data_len, i, j)
+	if valid_err != nil {
+		return nil, valid_err
+	}
+
+	f, open_err := openData(p.filename) // open for reading
+	if open_err != nil {
+		return nil, open_err
+	}
+
+	n_records := j - i
+	width := codeWidth(len(dict))
+	mask := uint8(1<<uint(width) - 1)
+
+	cv := tableview.NewColumnView()
+
+	go func() {
+		defer func() {
+			if close_err := f.Close(); close_err != nil {
+				cv.Fail(close_err)
+			}
+			close(cv.C)
+		}()
+
+		// read the codes of rows [start, start+amount)
+		read_fun := func(amount, start int) error {
+			first_byte := start * width / 8
+			buf := make([]byte, ((start+amount)*width+7)/8-first_byte)
+			if _, read_err := f.ReadAt(buf, int64(first_byte)); read_err != nil {
+				return fmt.Errorf("Unable to read %s: %w", p.filename, read_err)
+			}
+
+			vector := &tableview.Vector{
+				Type:  datatypes.INT64_TYPE,
+				Dict:  dict,
+				Codes: make([]uint8, amount),
+			}
+			for k := 0; k < amount; k++ {
+				bit := (start+k)*width - first_byte*8
+				vector.Codes[k] = buf[bit/8] >> uint(bit%8) & mask
+				if int(vector.Codes[k]) >= len(dict) {
+					return corruptFile(p.filename, "invalid code at row %d", start+k)
+				}
+			}
+			if is_valid != nil {
+				vector.Nulls = make([]bool, amount)
+				for k := 0; k < amount; k++ {
+					vector.Nulls[k] = !is_valid(start - i + k)
+				}
+			}
+			if !cv.Send(ctx, vector) {
+				return ctx.Err()
+			}
+			return nil
+		}
+
+		var k int
+		for k = 0; k < n_records/settings.BatchSize; k++ {
+			if err := read_fun(settings.BatchSize, i+k*settings.BatchSize); err != nil {
+				cv.Fail(err)
+				return
+			}
+		}
+		if n_records%settings.BatchSize != 0 {
+			if err := read_fun(n_records%settings.BatchSize, i+k*settings.BatchSize); err != nil {
+				cv.Fail(err)
+				return
+			}
+		}
+	}()
+
+	return cv, nil
+}
@@ -0,0 +1,99 @@
+package column
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jinpan/stuffdb/database"
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+)
+
+// A column of a single nullable int64, with one run of the given values
+func insertInt64s(t *testing.T, data []interface{}) (*database.Database, *Column) {
+	db := column_setup(t)
+	s, err := schema.NewNullableSchema([]string{"a"}, []datatypes.DatumType{datatypes.INT64_TYPE}, []bool{true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	col, err := NewColumn(db, "encoded", s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan interface{})
+	go func() {
+		for _, datum := range data {
+			ch <- datum
+		}
+		close(ch)
+	}()
+	if err := col.Insert(ch, len(data)); err != nil {
+		t.Fatal(err)
+	}
+	return db, col
+}
+
+func TestDictEncoding(t *testing.T) {
+	// five distinct values and some nulls
+	data := make([]interface{}, 5000)
+	for i := range data {
+		if i%11 != 0 {
+			data[i] = int64(i%5) * 1000
+		}
+	}
+	db, col := insertInt64s(t, data)
+	physical, ok := col.primary.Front().Value.(*run).Physical.(*PhysicalDictInt64)
+	if !ok {
+		t.Fatalf("Expected a dictionary encoded run, got %T", col.primary.Front().Value.(*run).Physical)
+	}
+	if body := readBody(t, physical.filename); len(body) != len(data)*4/8 {
+		t.Errorf("Expected 4 bit codes, got %d bytes", len(body))
+	}
+
+	// a range that starts and ends within bytes and batches
+	cv, err := physical.Read(context.Background(), 37, 4001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := 37
+	for vector := range cv.C {
+		if !vector.IsEncoded() {
+			t.Fatalf("Expected vectors of codes")
+		}
+		for k := 0; k < vector.Len(); k, pos = k+1, pos+1 {
+			if vector.Get(k) != data[pos] {
+				t.Fatalf("Expected %v at %d, got %v", data[pos], pos, vector.Get(k))
+			}
+		}
+	}
+	if err := cv.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if pos != 4001 {
+		t.Errorf("Expected to read up to %d, got %d", 4001, pos)
+	}
+
+	// and the encoding is found again on load
+	loaded, err := Load(db, "encoded", col.schema, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded_physical := loaded.primary.Front().Value.(*run).Physical
+	if _, ok := loaded_physical.(*PhysicalDictInt64); !ok {
+		t.Errorf("Expected to load a dictionary encoded run, got %T", loaded_physical)
+	}
+	if datum, err := loaded_physical.ReadOne(4999); err != nil || datum != data[4999] {
+		t.Errorf("Expected %v, got %v (%v)", data[4999], datum, err)
+	}
+}
+
+func TestDictEncodingSkipsManyValues(t *testing.T) {
+	data := make([]interface{}, 2*DICT_MAX_SIZE)
+	for i := range data {
+		data[i] = int64(i)
+	}
+	_, col := insertInt64s(t, data)
+	if physical, ok := col.primary.Front().Value.(*run).Physical.(*PhysicalDictInt64); ok {
+		t.Errorf("Expected a run that is not dictionary encoded, got %T", physical)
+	}
+}
@@ -0,0 +1,378 @@
+package column
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/settings"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+/*
+	The values of a new run of int64s are held in memory as they arrive,
+	8 bytes a row, gathering stats of them along the way.  The stats give
+	the size of the run in each encoding, and the run is then written once,
+	in the encoding that takes the fewest bytes; the validity, zone map and
+	Bloom filter files are the same in every encoding.  The encoding of a
+	run is named in the header of its data file; see format.go.
+
+	A run is only written while it is still pending, under a name carrying
+	TMP_SUFFIX, so a crash part way leaves nothing that recovery would keep.
+*/
+
+const (
+	ENCODING_PLAIN = "plain"
+	ENCODING_DICT  = "dict"
+	ENCODING_RLE   = "rle"
+	ENCODING_DELTA = "delta"
+)
+
+// What the encoders need to know of an int64 run.  Nulls count as any value
+// that suits the encoding, as the validity file marks them.
+type int64Stats struct {
+	size     int
+	distinct map[int64]bool // nil once there are more than DICT_MAX_SIZE
+
+	// runs of equal values, a null continuing the run before it
+	n_runs    int
+	has_value bool
+	last      int64
+
+	delta_blocks []deltaBlock // the blocks of the delta encoding, the last one being filled
+}
+
+func newInt64Stats() *int64Stats {
+	return &int64Stats{distinct: make(map[int64]bool)}
+}
+
+// Add the next datum of the run
+func (s *int64Stats) add(datum interface{}) {
+	s.size++
+	value, is_null := int64(0), datum == nil
+	if !is_null {
+		value = datum.(int64)
+	}
+
+	if !is_null && s.distinct != nil {
+		s.distinct[value] = true
+		if len(s.distinct) > DICT_MAX_SIZE {
+			s.distinct = nil
+		}
+	}
+
+	if s.size == 1 {
+		s.n_runs = 1
+	}
+	if !is_null && !s.has_value {
+		s.has_value, s.last = true, value
+	} else if !is_null && value != s.last {
+		s.n_runs++
+		s.last = value
+	}
+
+	if n := len(s.delta_blocks); n == 0 || s.delta_blocks[n-1].rows == DELTA_BLOCK_SIZE {
+		s.delta_blocks = append(s.delta_blocks, deltaBlock{})
+	}
+	s.delta_blocks[len(s.delta_blocks)-1].add(value, is_null)
+}
+
+// The distinct values of the run, sorted, or nil if there are too many
+func (s *int64Stats) dictionary() []int64 {
+	if s.distinct == nil {
+		return nil
+	}
+	dict := make([]int64, 0, len(s.distinct))
+	for value := range s.distinct {
+		dict = append(dict, value)
+	}
+	if len(dict) == 0 {
+		dict = append(dict, 0) // for the nulls
+	}
+	sort.Slice(dict, func(i, j int) bool { return dict[i] < dict[j] })
+	return dict
+}
+
+// The bytes the run takes in each encoding it can be written in
+func (s *int64Stats) encodedSizes() map[string]int64 {
+	sizes := map[string]int64{
+		ENCODING_PLAIN: int64(s.size) * 8,
+		ENCODING_RLE:   int64(s.n_runs) * rle_entry_size,
+	}
+	for _, block := range s.delta_blocks {
+		sizes[ENCODING_DELTA] += block.encodedSize()
+	}
+	if dict := s.dictionary(); dict != nil {
+		sizes[ENCODING_DICT] = dictEncodedSize(len(dict), s.size)
+	}
+	return sizes
+}
+
+// The encoding of a run with the stats that takes the fewest bytes, favoring
+// the simpler encodings on ties
+func (s *int64Stats) bestEncoding() string {
+	sizes := s.encodedSizes()
+	best := ENCODING_PLAIN
+	for _, encoding := range []string{ENCODING_DICT, ENCODING_DELTA, ENCODING_RLE} {
+		if size, ok := sizes[encoding]; ok && size < sizes[best] {
+			best = encoding
+		}
+	}
+	return best
+}
+
+// The values of a new int64 run, held in memory while its encoding is chosen
+type int64Run struct {
+	values []int64 // 0 in the place of nulls
+	valid  *validity
+}
+
+// Gather size values from data, with their stats.  The channel is always
+// drained, even if that fails part way.
+func bufferInt64s(filename string, data <-chan interface{}, size int, stats *int64Stats) (*int64Run, error) {
+	defer drain(data)
+
+	r := &int64Run{values: make([]int64, 0, size), valid: &validity{}}
+	for datum := range data {
+		stats.add(datum)
+		r.valid.set(len(r.values), datum != nil)
+		if datum == nil {
+			datum = int64(0)
+		}
+		r.values = append(r.values, datum.(int64))
+	}
+	if len(r.values) != size {
+		return nil, fmt.Errorf("Size mismatch writing %s: expected %d values, got %d",
+			filename, size, len(r.values))
+	}
+	return r, nil
+}
+
+// Call f with the values of the run in blocks of n rows, the last of which
+// may be short.  Nulls is nil when none of the run's rows are null.
+func (r *int64Run) blocks(n int, f func(values []int64, nulls []bool) error) error {
+	nulls := make([]bool, n)
+	for start := 0; start < len(r.values); start += n {
+		end := start + n
+		if end > len(r.values) {
+			end = len(r.values)
+		}
+		var block_nulls []bool
+		if r.valid.has_null {
+			block_nulls = nulls[:end-start]
+			for k := range block_nulls {
+				block_nulls[k] = !r.valid.get(start + k)
+			}
+		}
+		if err := f(r.values[start:end], block_nulls); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write out the validity bitmap, the zone map and, if asked for, the Bloom
+// filter of the run
+func (r *int64Run) storeCompanions(filename string, with_bloom bool) error {
+	zones := newZoneBuilder(datatypes.INT64_TYPE)
+	var bloom *BloomFilter
+	if with_bloom {
+		bloom = newBloomFilter(len(r.values))
+	}
+	for i, value := range r.values {
+		is_null := r.valid.has_null && !r.valid.get(i)
+		zones.addInt64(i, value, is_null)
+		if bloom != nil && !is_null {
+			bloom.add(value)
+		}
+	}
+	if err := r.valid.store(filename, datatypes.INT64_TYPE, len(r.values)); err != nil {
+		return err
+	}
+	if err := zones.store(filename); err != nil {
+		return err
+	}
+	if bloom != nil {
+		return bloom.store(filename, len(r.values))
+	}
+	return nil
+}
+
+// Write the data as an int64 run in the smallest encoding, compressed if
+// asked for
+func newInt64Run(
+	filename string,
+	data <-chan interface{},
+	size int,
+	with_bloom bool,
+	compression *schema.Compression,
+) (physical Physical, err error) {
+	stats := newInt64Stats()
+	r, err := bufferInt64s(filename, data, size, stats)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			removeFiles(filename)
+		}
+	}()
+
+	if err := r.storeCompanions(filename, with_bloom); err != nil {
+		return nil, err
+	}
+	switch stats.bestEncoding() {
+	case ENCODING_DICT:
+		physical, err = encodeDict(filename, r, stats.dictionary(), compression)
+	case ENCODING_RLE:
+		physical, err = encodeRLE(filename, r, compression)
+	case ENCODING_DELTA:
+		physical, err = encodeDelta(filename, r, stats.delta_blocks, compression)
+	default:
+		physical, err = encodePlain(filename, r, compression)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return physical, nil
+}
+
+// Write the data file of a run of rows in the encoding, written by write
+func writeEncoded(
+	filename string,
+	rows int,
+	encoding string,
+	compression *schema.Compression,
+	write func(w io.Writer) error,
+) error {
+	w, create_err := createSealed(filename, datatypes.INT64_TYPE, encoding, compression)
+	if create_err != nil {
+		return create_err
+	}
+	if err := write(w); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close(rows)
+}
+
+// Open an existing int64 run in the encoding named by the header of its data
+// file
+func loadInt64Run(filename string, size int, h *fileHeader) (Physical, error) {
+	switch h.encoding {
+	case ENCODING_PLAIN:
+		return LoadPhysicalInt64(filename, size), nil
+	case ENCODING_DICT:
+		return LoadPhysicalDictInt64(filename, size), nil
+	case ENCODING_RLE:
+		return LoadPhysicalRLEInt64(filename, size), nil
+	case ENCODING_DELTA:
+		return LoadPhysicalDeltaInt64(filename, size), nil
+	}
+	return nil, fmt.Errorf("Unknown encoding %q of %s", h.encoding, filename)
+}
+
+// The number of bits needed for x
+func bitWidth(x uint64) int {
+	return bits.Len64(x)
+}
+
+// Write the low width bits of value to buf from bit position bit on, least
+// significant bit first
+func putBits(buf []byte, bit, width int, value uint64) {
+	for width > 0 {
+		shift := bit % 8
+		n := 8 - shift
+		if n > width {
+			n = width
+		}
+		buf[bit/8] |= byte(value&(1<<uint(n)-1)) << uint(shift)
+		value >>= uint(n)
+		bit += n
+		width -= n
+	}
+}
+
+// Read width bits written by putBits
+func getBits(buf []byte, bit, width int) uint64 {
+	var value uint64
+	for done := 0; done < width; {
+		shift := bit % 8
+		n := 8 - shift
+		if n > width-done {
+			n = width - done
+		}
+		value |= uint64(buf[bit/8]>>uint(shift)&byte(1<<uint(n)-1)) << uint(done)
+		bit += n
+		done += n
+	}
+	return value
+}
+
+// Stream rows [i, j) of an encoded int64 run of size rows as plain vectors.
+// The decoder is handed the open data file and gives back a function writing
+// the values of the rows from start on into values, which the reader calls
+// for consecutive ranges from its goroutine; the values of nulls are ignored.
+// The reader gives up once ctx is cancelled.
+func readDecoded(
+	ctx context.Context,
+	filename string,
+	size int,
+	i, j int,
+	decoder func(f dataFile) func(start int, values []int64) error,
+) (*tableview.ColumnView, error) {
+	if j < i {
+		return nil, fmt.Errorf("Second index must be at least as big as the first")
+	}
+
+	is_valid, valid_err := readValidity(filename, datatypes.INT64_TYPE, size, i, j)
+	if valid_err != nil {
+		return nil, valid_err
+	}
+
+	f, open_err := openData(filename) // open for reading
+	if open_err != nil {
+		return nil, open_err
+	}
+
+	cv := tableview.NewColumnView()
+
+	go func() {
+		defer func() {
+			if close_err := f.Close(); close_err != nil {
+				cv.Fail(close_err)
+			}
+			close(cv.C)
+		}()
+
+		fill := decoder(f)
+		for start := i; start < j; start += settings.BatchSize {
+			amount := j - start
+			if amount > settings.BatchSize {
+				amount = settings.BatchSize
+			}
+			vector := &tableview.Vector{Type: datatypes.INT64_TYPE, Int64s: make([]int64, amount)}
+			if err := fill(start, vector.Int64s); err != nil {
+				cv.Fail(err)
+				return
+			}
+			if is_valid != nil {
+				vector.Nulls = make([]bool, amount)
+				for k := range vector.Nulls {
+					if vector.Nulls[k] = !is_valid(start - i + k); vector.Nulls[k] {
+						vector.Int64s[k] = 0
+					}
+				}
+			}
+			if !cv.Send(ctx, vector) {
+				return
+			}
+		}
+	}()
+
+	return cv, nil
+}
@@ -0,0 +1,174 @@
+package column
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// The data file as it was before sealing
+func readBody(t *testing.T, filename string) []byte {
+	t.Helper()
+	f, err := openData(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	body := make([]byte, f.Size())
+	if _, err := f.ReadAt(body, 0); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// Check that rows [i, j) of the physical column read back as data[i:j]
+func checkRead(t *testing.T, p Physical, data []interface{}, i, j int) {
+	t.Helper()
+	cv, err := p.Read(context.Background(), i, j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := i
+	for vector := range cv.C {
+		for k := 0; k < vector.Len(); k, pos = k+1, pos+1 {
+			if vector.Get(k) != data[pos] {
+				t.Fatalf("Expected %v at %d, got %v", data[pos], pos, vector.Get(k))
+			}
+			if vector.IsNull(k) && vector.Int64(k) != 0 {
+				t.Fatalf("Expected 0 in place of the null at %d, got %d", pos, vector.Int64(k))
+			}
+		}
+	}
+	if err := cv.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if pos != j {
+		t.Errorf("Expected to read up to %d, got %d", j, pos)
+	}
+}
+
+func TestBits(t *testing.T) {
+	values := []uint64{0, 1, 5, 1<<63 | 7, 3, math.MaxUint64, 0, 1 << 40}
+	for width := 0; width <= 64; width++ {
+		buf := make([]byte, (len(values)*width+7)/8)
+		for k, value := range values {
+			putBits(buf, k*width, width, value)
+		}
+		for k, value := range values {
+			if width < 64 {
+				value &= 1<<uint(width) - 1
+			}
+			if got := getBits(buf, k*width, width); got != value {
+				t.Fatalf("Expected %d at %d with width %d, got %d", value, k, width, got)
+			}
+		}
+	}
+}
+
+func TestRLEEncoding(t *testing.T) {
+	// long runs of a few hundred rows, with nulls inside them and leading them
+	data := make([]interface{}, 5000)
+	for i := range data {
+		if i%97 != 0 {
+			data[i] = int64(i/300) - 5
+		}
+	}
+	db, col := insertInt64s(t, data)
+	physical, ok := col.primary.Front().Value.(*run).Physical.(*PhysicalRLEInt64)
+	if !ok {
+		t.Fatalf("Expected a run-length encoded run, got %T", col.primary.Front().Value.(*run).Physical)
+	}
+	if n_runs, body := (len(data)+299)/300, readBody(t, physical.filename); len(body) != n_runs*rle_entry_size {
+		t.Errorf("Expected %d runs, got %d bytes", n_runs, len(body))
+	}
+
+	checkRead(t, physical, data, 0, len(data))
+	checkRead(t, physical, data, 299, 301)
+	checkRead(t, physical, data, 4001, 5000)
+	checkRead(t, physical, data, 10, 10)
+
+	loaded, err := Load(db, "encoded", col.schema, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded_physical := loaded.primary.Front().Value.(*run).Physical
+	if _, ok := loaded_physical.(*PhysicalRLEInt64); !ok {
+		t.Errorf("Expected to load a run-length encoded run, got %T", loaded_physical)
+	}
+	if datum, err := loaded_physical.ReadOne(4999); err != nil || datum != data[4999] {
+		t.Errorf("Expected %v, got %v (%v)", data[4999], datum, err)
+	}
+}
+
+func TestDeltaEncoding(t *testing.T) {
+	data := make([]interface{}, 3*DELTA_BLOCK_SIZE+100)
+	for i := range data {
+		switch block := i / DELTA_BLOCK_SIZE; {
+		case i%50 == 0:
+			// nulls, a leading one included
+		case block == 0:
+			data[i] = int64(1e12 + 1000*i) // steady steps
+		case block == 1:
+			data[i] = int64((i * 7919) % 1000) // small values in no order
+		case block == 2:
+			data[i] = int64(mix(uint64(i))) // the whole range
+		default:
+			data[i] = int64(-i)
+		}
+	}
+	db, col := insertInt64s(t, data)
+	physical, ok := col.primary.Front().Value.(*run).Physical.(*PhysicalDeltaInt64)
+	if !ok {
+		t.Fatalf("Expected a delta encoded run, got %T", col.primary.Front().Value.(*run).Physical)
+	}
+
+	// each block is packed in the mode that suits it
+	contents := readBody(t, physical.filename)
+	for b, expected := range []int{DELTA_MODE_DELTA, DELTA_MODE_FOR, DELTA_MODE_FOR, DELTA_MODE_DELTA} {
+		if mode := int(binary.LittleEndian.Uint32(contents[b*delta_entry_size+20:])); mode != expected {
+			t.Errorf("Expected block %d in mode %d, got %d", b, expected, mode)
+		}
+	}
+
+	checkRead(t, physical, data, 0, len(data))
+	checkRead(t, physical, data, DELTA_BLOCK_SIZE-5, 2*DELTA_BLOCK_SIZE+5)
+	checkRead(t, physical, data, 3*DELTA_BLOCK_SIZE+99, 3*DELTA_BLOCK_SIZE+100)
+
+	loaded, err := Load(db, "encoded", col.schema, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded_physical := loaded.primary.Front().Value.(*run).Physical
+	if _, ok := loaded_physical.(*PhysicalDeltaInt64); !ok {
+		t.Errorf("Expected to load a delta encoded run, got %T", loaded_physical)
+	}
+
+	// the run reads back in its encoding once moved, and is deleted whole
+	moved := filepath.Join(t.TempDir(), "moved")
+	if err := physical.Move(moved); err != nil {
+		t.Fatal(err)
+	}
+	checkRead(t, physical, data, 1000, 1100)
+	if err := physical.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := ioutil.ReadDir(filepath.Dir(moved)); err != nil || len(files) != 0 {
+		t.Errorf("Expected every file of the run to be deleted, got %d (%v)", len(files), err)
+	}
+}
+
+func TestEncodingOfUnorderedValues(t *testing.T) {
+	data := make([]interface{}, 2000)
+	for i := range data {
+		data[i] = int64(mix(uint64(i)))
+	}
+	_, col := insertInt64s(t, data)
+	physical := col.primary.Front().Value.(*run).Physical
+	if _, ok := physical.(*PhysicalInt64); !ok {
+		t.Errorf("Expected a plain run, got %T", physical)
+	}
+	checkRead(t, physical, data, 17, 1999)
+}
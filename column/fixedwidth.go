@@ -0,0 +1,199 @@
+package column
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/settings"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+/*
+	A plain PhysicalInt64 and a PhysicalFloat64 share one layout.  The body
+	of the data file holds the value of every row, in order, as a
+	little-endian int64 or IEEE 754 float64, so row k starts at byte 8*k and
+	a range of rows is read without touching the rest of the file.  A null
+	is written as 0 and marked in the validity file.  Like every data file
+	it is sealed, and compressed if the column asks for it; see format.go.
+*/
+
+// the rows handed to the data file at a time
+const FIXED_BLOCK_SIZE = 1024
+
+// Write the int64s or float64s on the channel to a new data file, along with
+// its validity and zone map files, compressed if asked for.  Visit, if given,
+// is called with every value that is not null.  The channel is always
+// drained, and the files are removed if writing fails part way.
+func writeFixed(
+	filename string,
+	data_type datatypes.DatumType,
+	data <-chan interface{},
+	size int,
+	compression *schema.Compression,
+	visit func(datum interface{}),
+) (err error) {
+	defer drain(data)
+
+	w, create_err := createSealed(filename, data_type, ENCODING_PLAIN, compression)
+	if create_err != nil {
+		return create_err
+	}
+	defer func() {
+		if err == nil {
+			err = w.Close(size)
+		} else {
+			w.Abort()
+		}
+		if err != nil {
+			removeFiles(filename)
+		}
+	}()
+
+	valid := &validity{}
+	zones := newZoneBuilder(data_type)
+	i := 0
+	for done := false; !done; {
+		buf := new(bytes.Buffer)
+		for j := 0; j < FIXED_BLOCK_SIZE; i, j = i+1, j+1 {
+			datum, ok := <-data
+			if !ok {
+				done = true
+				break
+			}
+			is_null := datum == nil
+			valid.set(i, !is_null)
+			if !is_null && visit != nil {
+				visit(datum)
+			}
+			switch data_type {
+			case datatypes.INT64_TYPE:
+				if is_null {
+					datum = int64(0)
+				}
+				zones.addInt64(i, datum.(int64), is_null)
+			case datatypes.FLOAT64_TYPE:
+				if is_null {
+					datum = float64(0)
+				}
+				zones.addFloat64(i, datum.(float64), is_null)
+			default:
+				return fmt.Errorf("Invalid data type %s for %s", data_type, filename)
+			}
+			if err := binary.Write(buf, binary.LittleEndian, datum); err != nil {
+				return err
+			}
+		}
+		if _, write_err := w.Write(buf.Bytes()); write_err != nil {
+			return write_err
+		}
+	}
+	if i != size {
+		return fmt.Errorf("Size mismatch writing %s: expected %d values, got %d",
+			filename, size, i)
+	}
+	if err := valid.store(filename, data_type, size); err != nil {
+		return err
+	}
+	return zones.store(filename)
+}
+
+// Read rows [i, j) of a fixed width data file of size rows of the type.  The
+// reader gives up once ctx is cancelled.
+func readFixed(
+	ctx context.Context,
+	filename string,
+	data_type datatypes.DatumType,
+	size int,
+	i, j int,
+) (*tableview.ColumnView, error) {
+	if j < i {
+		return nil, fmt.Errorf("Second index must be at least as big as the first")
+	}
+
+	is_valid, valid_err := readValidity(filename, data_type, size, i, j)
+	if valid_err != nil {
+		return nil, valid_err
+	}
+
+	f, open_err := openData(filename) // open for reading
+	if open_err != nil {
+		return nil, open_err
+	}
+
+	n_records := j - i
+	datum_size := data_type.GetSize()
+
+	cv := tableview.NewColumnView()
+
+	go func() {
+		defer func() {
+			if close_err := f.Close(); close_err != nil {
+				cv.Fail(close_err)
+			}
+			close(cv.C)
+		}()
+
+		read_fun := func(amount_bytes, offset_bytes int) error {
+			buf := make([]byte, amount_bytes)
+			if _, read_err := f.ReadAt(buf, int64(offset_bytes)); read_err != nil {
+				return fmt.Errorf("Unable to read %s: %w", filename, read_err)
+			}
+
+			n := amount_bytes / datum_size
+			vector := &tableview.Vector{Type: data_type}
+			var data interface{}
+			if data_type == datatypes.INT64_TYPE {
+				vector.Int64s = make([]int64, n)
+				data = vector.Int64s
+			} else {
+				vector.Float64s = make([]float64, n)
+				data = vector.Float64s
+			}
+			if bin_read_err := binary.Read(
+				bytes.NewReader(buf),
+				binary.LittleEndian,
+				data,
+			); bin_read_err != nil {
+				return bin_read_err
+			}
+
+			if is_valid != nil {
+				first := offset_bytes/datum_size - i
+				vector.Nulls = make([]bool, n)
+				for k := range vector.Nulls {
+					vector.Nulls[k] = !is_valid(first + k)
+				}
+			}
+			if !cv.Send(ctx, vector) {
+				return ctx.Err()
+			}
+			return nil
+		}
+
+		var k int
+		for k = 0; k < n_records/settings.BatchSize; k++ {
+			amount_bytes := settings.BatchSize * datum_size
+			offset_bytes := (i + k*settings.BatchSize) * datum_size
+
+			if err := read_fun(amount_bytes, offset_bytes); err != nil {
+				cv.Fail(err)
+				return
+			}
+		}
+		if n_records%settings.BatchSize != 0 {
+			amount_bytes := (n_records % settings.BatchSize) * datum_size
+			offset_bytes := (i + k*settings.BatchSize) * datum_size
+
+			if err := read_fun(amount_bytes, offset_bytes); err != nil {
+				cv.Fail(err)
+				return
+			}
+		}
+	}()
+
+	return cv, nil
+}
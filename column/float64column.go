@@ -0,0 +1,104 @@
+package column
+
+import (
+	"context"
+	"os"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+/*
+	A run of float64s, one per row in a fixed width data file; see
+	fixedwidth.go for the layout.
+*/
+
+type PhysicalFloat64 struct {
+	filename string
+	data_len int
+}
+
+// Write the data on the channel to a new file.  The channel is always
+// drained, even if writing fails part way.
+func NewPhysicalFloat64(
+	filename string,
+	data <-chan interface{},
+	size int,
+) (*PhysicalFloat64, error) {
+	return newPhysicalFloat64(filename, data, size, nil)
+}
+
+// Write the data, compressed if asked for
+func newPhysicalFloat64(
+	filename string,
+	data <-chan interface{},
+	size int,
+	compression *schema.Compression,
+) (*PhysicalFloat64, error) {
+	if err := writeFixed(filename, datatypes.FLOAT64_TYPE, data, size, compression, nil); err != nil {
+		return nil, err
+	}
+	return &PhysicalFloat64{
+		filename: filename,
+		data_len: size,
+	}, nil
+}
+
+func LoadPhysicalFloat64(filename string, size int) *PhysicalFloat64 {
+	return &PhysicalFloat64{
+		filename: filename,
+		data_len: size,
+	}
+}
+
+func (p *PhysicalFloat64) Move(filename string) error {
+	if err := moveCompanions(p.filename, filename); err != nil {
+		return err
+	}
+	if err := os.Rename(p.filename, filename); err != nil {
+		return err
+	}
+	p.filename = filename
+	return nil
+}
+
+// Write the rows of p followed by those of o to a new file, compressed if
+// asked for
+func (p *PhysicalFloat64) Merge(o *PhysicalFloat64, filename string, compression *schema.Compression) (*PhysicalFloat64, error) {
+	ch, errs := concat(context.Background(), p, o)
+	merged, err := newPhysicalFloat64(filename, ch, p.data_len+o.data_len, compression)
+	if read_err := <-errs; read_err != nil {
+		return nil, read_err
+	}
+	return merged, err
+}
+
+func (p *PhysicalFloat64) Delete() error {
+	if remove_err := os.Remove(p.filename); remove_err != nil {
+		return remove_err
+	}
+	return deleteCompanions(p.filename)
+}
+
+// The zone map of the column, nil if it was written without one
+func (p *PhysicalFloat64) ZoneMap() (*ZoneMap, error) {
+	return readZoneMap(p.filename, datatypes.FLOAT64_TYPE, p.data_len)
+}
+
+func (p *PhysicalFloat64) GetSize() int {
+	return p.data_len
+}
+
+func (p *PhysicalFloat64) ReadOne(i int) (interface{}, error) {
+	return readOne(p, i)
+}
+
+func (p *PhysicalFloat64) ReadAll(ctx context.Context) (*tableview.ColumnView, error) {
+	return p.Read(ctx, 0, p.data_len)
+}
+
+// Read rows [i, j).  The reader gives up once ctx is cancelled.
+func (p *PhysicalFloat64) Read(ctx context.Context, i, j int) (*tableview.ColumnView, error) {
+	return readFixed(ctx, p.filename, datatypes.FLOAT64_TYPE, p.data_len, i, j)
+}
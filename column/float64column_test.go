@@ -0,0 +1,131 @@
+package column
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func setup_float64(t *testing.T) (*PhysicalFloat64, []interface{}) {
+	dir := t.TempDir()
+
+	data := make([]interface{}, 0, n_records)
+	for i := 0; i < n_records; i++ {
+		data = append(data, float64(i)/4)
+	}
+	ch := make(chan interface{})
+	go func() {
+		for i := 0; i < n_records; i++ {
+			ch <- data[i]
+		}
+		close(ch)
+	}()
+
+	physical, err := NewPhysicalFloat64(
+		filepath.Join(dir, fmt.Sprint(n_records)),
+		ch,
+		n_records,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if physical.data_len != n_records {
+		t.Errorf("Did not set physical size correctly")
+	}
+
+	return physical, data
+}
+
+func TestReadAllFloat64(t *testing.T) {
+	physical, data := setup_float64(t)
+
+	count := 0
+	actual, err := physical.ReadAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for vector := range actual.C {
+		for k := 0; k < vector.Len(); k++ {
+			datum := vector.Get(k)
+			if datum.(float64) != data[count] {
+				t.Errorf("Expected %f, got %f", data[count], datum.(float64))
+			}
+			count++
+		}
+	}
+	if count != n_records {
+		t.Errorf("Expected length %d result, got %d", n_records, count)
+	}
+}
+
+func TestReadIndividualFloat64(t *testing.T) {
+	physical, data := setup_float64(t)
+
+	for i := 0; i < n_records; i += 7 {
+		datum, read_err := physical.ReadOne(i)
+		if read_err != nil {
+			t.Error(read_err)
+		}
+
+		if datum.(float64) != data[i] {
+			t.Errorf("Expected %f, got %f", data[i], datum.(float64))
+		}
+	}
+}
+
+func TestMergeFloat64(t *testing.T) {
+	physical1, data1 := setup_float64(t)
+	dir := filepath.Dir(physical1.filename)
+
+	data2 := make([]interface{}, 0, n_records)
+	for i := 0; i < n_records; i++ {
+		data2 = append(data2, -float64(i)/3)
+	}
+
+	ch := make(chan interface{})
+	go func() {
+		for _, datum := range data2 {
+			ch <- datum
+		}
+		close(ch)
+	}()
+
+	physical2, err := NewPhysicalFloat64(
+		filepath.Join(dir, fmt.Sprintf("%d_b", n_records)),
+		ch,
+		n_records,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	physical3, err := physical1.Merge(
+		physical2,
+		filepath.Join(dir, fmt.Sprintf("%d_c", n_records)),
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(data1, data2...)
+	actual, err := physical3.Read(context.Background(), 0, 2*n_records)
+	if err != nil {
+		t.Errorf("Expected no error in batch read, got %s", err.Error())
+	}
+	count := 0
+	for vector := range actual.C {
+		for k := 0; k < vector.Len(); k++ {
+			datum := vector.Get(k)
+			if datum.(float64) != expected[count] {
+				t.Errorf("Expected %f, got %f", expected[count], datum.(float64))
+			}
+			count++
+		}
+	}
+	if count != 2*n_records {
+		t.Errorf("Expected length %d result, got %d", 2*n_records, count)
+	}
+}
@@ -0,0 +1,480 @@
+package column
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+)
+
+const (
+	FORMAT_MAGIC   = "STUFFCOL"
+	FORMAT_VERSION = 1
+
+	// the bytes of the body covered by each checksum
+	CHECKSUM_BLOCK_SIZE = 64 << 10
+
+	header_size = 48
+)
+
+/*
+	The data file of a physical column is sealed with a header and checksums
+	as it is written, encoded and compressed, so that a file that was
+	truncated, damaged or renamed is caught rather than misread.  The file
+	holds:
+
+		the header, of header_size bytes: FORMAT_MAGIC, then the format
+		version, the datatypes.DatumType of the column, the index of its
+		encoding in encodings and the checksum block size as uint32s, the
+		row count and the size of the body as uint64s, the id of the codec
+		the body is compressed with, 0 if it is not, as a uint32 and the
+		CRC-32C of the header before it, all little-endian
+
+		the body, the data as encoded and compressed
+
+		the CRC-32C of each CHECKSUM_BLOCK_SIZE bytes of the body, the last
+		block short, as little-endian uint32s
+
+	Every read through openData verifies the checksums of the blocks it
+	touches, and the header is checked against the run's name and the column
+	when the column is loaded.  The companion files of a run, its validity
+	bitmap, zone map, Bloom filter and dictionary, are sealed the same way,
+	in the plain encoding and with the type and rows of the run, and their
+	headers are checked whenever they are read.  A file without the magic is corrupt.
+*/
+
+var crc_table = crc32.MakeTable(crc32.Castagnoli)
+
+// The encodings, by their index in the header
+var encodings = []string{ENCODING_PLAIN, ENCODING_DICT, ENCODING_RLE, ENCODING_DELTA}
+
+// A physical column file that does not hold what it should.  Errors raised
+// while reading a file only know the file; the column fills in the rest.
+type CorruptionError struct {
+	Table  string
+	Rank   int
+	File   string
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Table == "" {
+		return fmt.Sprintf("Corrupt file %s: %s", e.File, e.Reason)
+	}
+	return fmt.Sprintf("Corrupt file %s of column %d of table %s: %s", e.File, e.Rank, e.Table, e.Reason)
+}
+
+func corruptFile(filename string, format string, args ...interface{}) error {
+	return &CorruptionError{File: filename, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Name the column of the file if err is a corruption error
+func inColumn(err error, tablename string, rank int) error {
+	var corrupt *CorruptionError
+	if errors.As(err, &corrupt) && corrupt.Table == "" {
+		named := *corrupt
+		named.Table, named.Rank = tablename, rank
+		return &named
+	}
+	return err
+}
+
+type fileHeader struct {
+	version    int
+	data_type  datatypes.DatumType
+	encoding   string
+	block_size int
+	rows       int
+	body_size  int64
+	codec      uint32 // 0 if the body is not compressed
+}
+
+func (h *fileHeader) blockCount() int64 {
+	return (h.body_size + int64(h.block_size) - 1) / int64(h.block_size)
+}
+
+// The size of a file with the header
+func (h *fileHeader) fileSize() int64 {
+	return header_size + h.body_size + 4*h.blockCount()
+}
+
+// The encoding a physical column was written in
+func encodingOf(p Physical) string {
+	switch p.(type) {
+	case *PhysicalDictInt64:
+		return ENCODING_DICT
+	case *PhysicalRLEInt64:
+		return ENCODING_RLE
+	case *PhysicalDeltaInt64:
+		return ENCODING_DELTA
+	}
+	return ENCODING_PLAIN
+}
+
+// A data file being written, which is compressed, if asked for, and sealed as
+// it goes, so that the data is written once
+type sealedWriter struct {
+	f         *os.File
+	w         *bufio.Writer
+	filename  string
+	data_type datatypes.DatumType
+	code      int // the index of the encoding in encodings
+
+	// the compression of the data, if any; see compression.go
+	codec  *codec
+	level  int
+	block  []byte   // the data not yet compressed
+	ends   []uint64 // the end of each compressed block in the body
+	size   uint64   // the data compressed so far
+	stored uint64   // the bytes it took
+
+	body_size int64
+	crc       uint32 // of the bytes of the checksum block being filled
+	crcs      *bytes.Buffer
+}
+
+// Create a data file holding data of the type in the encoding
+func createSealed(
+	filename string,
+	data_type datatypes.DatumType,
+	encoding string,
+	compression *schema.Compression,
+) (*sealedWriter, error) {
+	code := -1
+	for k, name := range encodings {
+		if name == encoding {
+			code = k
+		}
+	}
+	if code < 0 {
+		return nil, fmt.Errorf("Unknown encoding %q of %s", encoding, filename)
+	}
+	var c *codec
+	if compression != nil {
+		found, ok := findCodec(func(c codec) bool { return c.name == compression.Codec })
+		if !ok {
+			return nil, fmt.Errorf("Unknown codec %s", compression.Codec)
+		}
+		c = &found
+	}
+
+	f, create_err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if create_err != nil {
+		return nil, create_err
+	}
+	w := &sealedWriter{
+		f:         f,
+		w:         bufio.NewWriterSize(f, CHECKSUM_BLOCK_SIZE),
+		filename:  filename,
+		data_type: data_type,
+		code:      code,
+		codec:     c,
+		crcs:      new(bytes.Buffer),
+	}
+	if c != nil {
+		w.level = compression.Level
+		w.block = make([]byte, 0, COMPRESSION_BLOCK_SIZE)
+	}
+	// the header is written last, once the sizes are known
+	if _, write_err := w.w.Write(make([]byte, header_size)); write_err != nil {
+		w.Abort()
+		return nil, write_err
+	}
+	return w, nil
+}
+
+func (w *sealedWriter) Write(p []byte) (int, error) {
+	if w.codec == nil {
+		return len(p), w.writeBody(p)
+	}
+	n := len(p)
+	for len(p) > 0 {
+		taken := COMPRESSION_BLOCK_SIZE - len(w.block)
+		if taken > len(p) {
+			taken = len(p)
+		}
+		w.block, p = append(w.block, p[:taken]...), p[taken:]
+		if len(w.block) == COMPRESSION_BLOCK_SIZE {
+			if err := w.compressBlock(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Append to the body, checksumming it a block at a time
+func (w *sealedWriter) writeBody(p []byte) error {
+	for len(p) > 0 {
+		taken := CHECKSUM_BLOCK_SIZE - int(w.body_size%CHECKSUM_BLOCK_SIZE)
+		if taken > len(p) {
+			taken = len(p)
+		}
+		if _, write_err := w.w.Write(p[:taken]); write_err != nil {
+			return write_err
+		}
+		w.crc = crc32.Update(w.crc, crc_table, p[:taken])
+		w.body_size += int64(taken)
+		p = p[taken:]
+		if w.body_size%CHECKSUM_BLOCK_SIZE == 0 {
+			binary.Write(w.crcs, binary.LittleEndian, w.crc)
+			w.crc = 0
+		}
+	}
+	return nil
+}
+
+// Finish the file, holding rows rows, and close it.  The file is left for the
+// caller to remove if that fails.
+func (w *sealedWriter) Close(rows int) error {
+	err := w.finish(rows)
+	if close_err := w.f.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+func (w *sealedWriter) finish(rows int) error {
+	var codec_id uint32
+	if w.codec != nil {
+		codec_id = w.codec.id
+		if err := w.writeIndex(); err != nil {
+			return err
+		}
+	}
+	if w.body_size%CHECKSUM_BLOCK_SIZE != 0 {
+		binary.Write(w.crcs, binary.LittleEndian, w.crc)
+	}
+	if _, write_err := w.w.Write(w.crcs.Bytes()); write_err != nil {
+		return write_err
+	}
+	if flush_err := w.w.Flush(); flush_err != nil {
+		return flush_err
+	}
+
+	header := new(bytes.Buffer)
+	header.WriteString(FORMAT_MAGIC)
+	binary.Write(header, binary.LittleEndian, []uint32{
+		FORMAT_VERSION, uint32(w.data_type), uint32(w.code), CHECKSUM_BLOCK_SIZE,
+	})
+	binary.Write(header, binary.LittleEndian, []uint64{uint64(rows), uint64(w.body_size)})
+	binary.Write(header, binary.LittleEndian, codec_id)
+	binary.Write(header, binary.LittleEndian, crc32.Checksum(header.Bytes(), crc_table))
+	if _, write_err := w.f.WriteAt(header.Bytes(), 0); write_err != nil {
+		return write_err
+	}
+	return w.f.Sync()
+}
+
+// Give up on the file and remove it
+func (w *sealedWriter) Abort() {
+	w.f.Close()
+	os.Remove(w.filename)
+}
+
+// Read the header of a data file
+func readHeader(f *os.File, filename string) (*fileHeader, error) {
+	buf := make([]byte, header_size)
+	n, read_err := f.ReadAt(buf, 0)
+	if n < len(FORMAT_MAGIC) || string(buf[:len(FORMAT_MAGIC)]) != FORMAT_MAGIC {
+		return nil, corruptFile(filename, "missing header")
+	} else if n < header_size {
+		return nil, corruptFile(filename, "truncated header")
+	} else if read_err != nil && read_err != io.EOF {
+		return nil, read_err
+	}
+
+	if crc32.Checksum(buf[:header_size-4], crc_table) != binary.LittleEndian.Uint32(buf[header_size-4:]) {
+		return nil, corruptFile(filename, "header checksum mismatch")
+	}
+	h := &fileHeader{
+		version:    int(binary.LittleEndian.Uint32(buf[8:])),
+		data_type:  datatypes.DatumType(binary.LittleEndian.Uint32(buf[12:])),
+		block_size: int(binary.LittleEndian.Uint32(buf[20:])),
+		rows:       int(binary.LittleEndian.Uint64(buf[24:])),
+		body_size:  int64(binary.LittleEndian.Uint64(buf[32:])),
+		codec:      binary.LittleEndian.Uint32(buf[40:]),
+	}
+	if h.version != FORMAT_VERSION {
+		return nil, fmt.Errorf("Unable to read %s: unsupported format version %d", filename, h.version)
+	}
+	code := int(binary.LittleEndian.Uint32(buf[16:]))
+	if code >= len(encodings) || h.block_size <= 0 {
+		return nil, corruptFile(filename, "invalid header")
+	}
+	if _, ok := findCodec(func(c codec) bool { return c.id == h.codec }); h.codec != 0 && !ok {
+		return nil, corruptFile(filename, "unknown codec %d", h.codec)
+	}
+	h.encoding = encodings[code]
+
+	fi, stat_err := f.Stat()
+	if stat_err != nil {
+		return nil, stat_err
+	}
+	if fi.Size() != h.fileSize() {
+		return nil, corruptFile(filename, "expected %d bytes, found %d", h.fileSize(), fi.Size())
+	}
+	return h, nil
+}
+
+// Read the header of the data file of a physical column
+func readHeaderOf(filename string) (*fileHeader, error) {
+	f, open_err := os.Open(filename)
+	if open_err != nil {
+		return nil, open_err
+	}
+	defer f.Close()
+	return readHeader(f, filename)
+}
+
+// The name of the codec the data file of a physical column is compressed
+// with, or "" if it is not compressed
+func FileCodec(filename string) (string, error) {
+	h, err := readHeaderOf(filename)
+	if err != nil || h.codec == 0 {
+		return "", err
+	}
+	c, _ := findCodec(func(c codec) bool { return c.id == h.codec })
+	return c.name, nil
+}
+
+// Check the header of a data file against what the column expects of it
+func checkHeader(filename string, data_type datatypes.DatumType, rows int) (*fileHeader, error) {
+	h, err := readHeaderOf(filename)
+	if err != nil {
+		return nil, err
+	}
+	if h.data_type != data_type {
+		return nil, corruptFile(filename, "holds %s data in a column of %s", h.data_type, data_type)
+	}
+	if h.rows != rows {
+		return nil, corruptFile(filename, "holds %d rows where its name says %d", h.rows, rows)
+	}
+	return h, nil
+}
+
+// Durably write a new companion file of a data file holding data, sealed like
+// the data file with the type and rows of its run
+func writeCompanion(filename string, data_type datatypes.DatumType, rows int, data []byte) error {
+	w, create_err := createSealed(filename, data_type, ENCODING_PLAIN, nil)
+	if create_err != nil {
+		return create_err
+	}
+	if _, write_err := w.Write(data); write_err != nil {
+		w.Abort()
+		return write_err
+	}
+	return w.Close(rows)
+}
+
+// Open a companion file of a data file for reading, checking its header
+// against the run.  It is nil if the run has no such file.
+func openCompanion(filename string, data_type datatypes.DatumType, rows int) (dataFile, error) {
+	if _, err := checkHeader(filename, data_type, rows); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return openData(filename)
+}
+
+// Read the whole of a companion file of a data file, nil if the run has none
+func readCompanion(filename string, data_type datatypes.DatumType, rows int) ([]byte, error) {
+	f, err := openCompanion(filename, data_type, rows)
+	if err != nil || f == nil {
+		return nil, err
+	}
+	defer f.Close()
+	data := make([]byte, f.Size())
+	if _, read_err := f.ReadAt(data, 0); read_err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %w", filename, read_err)
+	}
+	return data, nil
+}
+
+// The body of a sealed data file, verified against its checksums as it is
+// read
+type checkedFile struct {
+	f        *os.File
+	filename string
+	header   *fileHeader
+	crcs     []byte
+
+	mu     sync.Mutex
+	cached int64 // the block held by block, or -1
+	block  []byte
+}
+
+func openChecked(f *os.File, filename string, h *fileHeader) (*checkedFile, error) {
+	crcs := make([]byte, 4*h.blockCount())
+	if _, read_err := f.ReadAt(crcs, header_size+h.body_size); read_err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", filename, read_err.Error())
+	}
+	return &checkedFile{
+		f:        f,
+		filename: filename,
+		header:   h,
+		crcs:     crcs,
+		cached:   -1,
+		block:    make([]byte, h.block_size),
+	}, nil
+}
+
+func (cf *checkedFile) Size() int64 {
+	return cf.header.body_size
+}
+
+func (cf *checkedFile) Close() error {
+	return cf.f.Close()
+}
+
+// Read and verify block b into cf.block, unless it is there already
+func (cf *checkedFile) load(b int64) error {
+	if cf.cached == b {
+		return nil
+	}
+	cf.cached = -1
+
+	size := cf.header.body_size - b*int64(cf.header.block_size)
+	if size > int64(cf.header.block_size) {
+		size = int64(cf.header.block_size)
+	}
+	cf.block = cf.block[:size]
+	if _, read_err := cf.f.ReadAt(cf.block, header_size+b*int64(cf.header.block_size)); read_err != nil {
+		return read_err
+	}
+	if crc32.Checksum(cf.block, crc_table) != binary.LittleEndian.Uint32(cf.crcs[4*b:]) {
+		return corruptFile(cf.filename, "checksum mismatch in block %d", b)
+	}
+	cf.cached = b
+	return nil
+}
+
+// Read the body from off on, verifying the blocks it is in
+func (cf *checkedFile) ReadAt(p []byte, off int64) (int, error) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off >= cf.header.body_size {
+			return n, io.EOF
+		}
+		b := off / int64(cf.header.block_size)
+		if err := cf.load(b); err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], cf.block[off-b*int64(cf.header.block_size):])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
@@ -0,0 +1,166 @@
+package column
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jinpan/stuffdb/datatypes"
+)
+
+// Check that err names the corrupt file of column 0 of the table "encoded"
+func checkCorruption(t *testing.T, err error, filename string) {
+	t.Helper()
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected a corruption error, got %v", err)
+	}
+	if corrupt.Table != "encoded" || corrupt.Rank != 0 || corrupt.File != filename {
+		t.Errorf("Expected the error to name column 0 of table encoded and %s, got %v", filename, err)
+	}
+}
+
+func TestSealedFile(t *testing.T) {
+	data := make([]interface{}, 3*CHECKSUM_BLOCK_SIZE/8)
+	for i := range data {
+		data[i] = int64(mix(uint64(i)))
+	}
+	_, col := insertInt64s(t, data)
+	physical := col.primary.Front().Value.(*run).Physical.(*PhysicalInt64)
+
+	h, err := readHeaderOf(physical.filename)
+	if err != nil {
+		t.Fatalf("Expected a header, got %v", err)
+	}
+	if h.version != FORMAT_VERSION || h.data_type != datatypes.INT64_TYPE ||
+		h.encoding != ENCODING_PLAIN || h.rows != len(data) || h.body_size != int64(8*len(data)) {
+		t.Errorf("Unexpected header %+v", h)
+	}
+
+	// damage a byte in the middle block
+	contents, err := ioutil.ReadFile(physical.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[header_size+CHECKSUM_BLOCK_SIZE+100] ^= 1
+	if err := ioutil.WriteFile(physical.filename, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// rows in the other blocks still read, while the damaged one is caught
+	checkRead(t, physical, data, 0, 100)
+	checkRead(t, physical, data, 2*CHECKSUM_BLOCK_SIZE/8, len(data))
+	cv := col.Snapshot().Scan(context.Background())
+	for range cv.C {
+	}
+	checkCorruption(t, cv.Err(), physical.filename)
+	_, err = col.Snapshot().GetDatum(CHECKSUM_BLOCK_SIZE/8 + 20)
+	checkCorruption(t, err, physical.filename)
+}
+
+func TestLoadChecksHeader(t *testing.T) {
+	data := make([]interface{}, 1000)
+	for i := range data {
+		data[i] = int64(mix(uint64(i)))
+	}
+
+	// a file renamed to claim other rows
+	db, col := insertInt64s(t, data)
+	physical := col.primary.Front().Value.(*run).Physical.(*PhysicalInt64)
+	renamed := filepath.Join(filepath.Dir(physical.filename), runName(0, 0, 999))
+	if err := physical.Move(renamed); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(db, "encoded", col.schema, 0)
+	checkCorruption(t, err, renamed)
+
+	// a truncated file
+	db, col = insertInt64s(t, data)
+	physical = col.primary.Front().Value.(*run).Physical.(*PhysicalInt64)
+	if err := os.Truncate(physical.filename, header_size+8*500); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(db, "encoded", col.schema, 0)
+	checkCorruption(t, err, physical.filename)
+}
+
+func TestFileWithoutMagic(t *testing.T) {
+	// a file of plain int64s with no header at all
+	filename := filepath.Join(t.TempDir(), "headerless")
+	buf := new(bytes.Buffer)
+	for i := 0; i < 1000; i++ {
+		binary.Write(buf, binary.LittleEndian, int64(i))
+	}
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var corrupt *CorruptionError
+	if _, err := openData(filename); !errors.As(err, &corrupt) {
+		t.Errorf("Expected a corruption error, got %v", err)
+	}
+
+	// a run whose magic lost a bit
+	data := make([]interface{}, 1000)
+	for i := range data {
+		data[i] = int64(mix(uint64(i)))
+	}
+	db, col := insertInt64s(t, data)
+	physical := col.primary.Front().Value.(*run).Physical.(*PhysicalInt64)
+	contents, err := ioutil.ReadFile(physical.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[0] ^= 1
+	if err := ioutil.WriteFile(physical.filename, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(db, "encoded", col.schema, 0)
+	checkCorruption(t, err, physical.filename)
+}
+
+func TestSealedCompanions(t *testing.T) {
+	// two distinct values and some nulls, which are dictionary encoded
+	data := make([]interface{}, 3000)
+	for i := range data {
+		if i%10 != 0 {
+			data[i] = int64(i % 2 * 1000)
+		}
+	}
+	for _, suffix := range []string{VALIDITY_SUFFIX, ZONE_SUFFIX, DICT_SUFFIX} {
+		_, col := insertInt64s(t, data)
+		physical, ok := col.primary.Front().Value.(*run).Physical.(*PhysicalDictInt64)
+		if !ok {
+			t.Fatalf("Expected a dictionary encoded run, got %T", col.primary.Front().Value.(*run).Physical)
+		}
+
+		// damage the last byte of the body
+		filename := physical.filename + suffix
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[len(contents)-5] ^= 1
+		if err := ioutil.WriteFile(filename, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if suffix == ZONE_SUFFIX {
+			_, err = physical.ZoneMap()
+		} else if cv, read_err := physical.ReadAll(context.Background()); read_err != nil {
+			err = read_err
+		} else {
+			for range cv.C {
+			}
+			err = cv.Err()
+		}
+		var corrupt *CorruptionError
+		if !errors.As(err, &corrupt) || corrupt.File != filename {
+			t.Errorf("Expected a corruption error naming %s, got %v", filename, err)
+		}
+	}
+}
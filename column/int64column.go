@@ -1,13 +1,14 @@
 package column
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
-	"fmt"
+	"io"
 	"os"
 
 	"github.com/jinpan/stuffdb/datatypes"
-	"github.com/jinpan/stuffdb/settings"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/tableview"
 )
 
 /*
@@ -22,45 +23,63 @@ type PhysicalInt64 struct {
 	data_len int
 }
 
-func NewPhysicalInt64(
+// Write the data on the channel to a new file.  The channel is always
+// drained, even if writing fails part way.
+func NewPhysicalInt64(filename string, data <-chan interface{}, size int) (*PhysicalInt64, error) {
+	return newPhysicalInt64(filename, data, size, false, nil)
+}
+
+// Write the data on the channel to a new file, along with a Bloom filter of
+// its values
+func NewPhysicalInt64WithBloomFilter(filename string, data <-chan interface{}, size int) (*PhysicalInt64, error) {
+	return newPhysicalInt64(filename, data, size, true, nil)
+}
+
+// Write the data, compressed if asked for
+func newPhysicalInt64(
 	filename string,
 	data <-chan interface{},
 	size int,
-) *PhysicalInt64 {
-
-	f, create_err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
-	if create_err != nil {
-		panic(create_err.Error())
+	with_bloom bool,
+	compression *schema.Compression,
+) (*PhysicalInt64, error) {
+	var bloom *BloomFilter
+	var visit func(datum interface{})
+	if with_bloom {
+		bloom = newBloomFilter(size)
+		visit = func(datum interface{}) { bloom.add(datum.(int64)) }
 	}
-	defer f.Close()
-
-	i := 0
-	for done := false; !done; {
-		buf := new(bytes.Buffer)
-		for j := 0; j < 1024; i, j = i+1, j+1 {
-			datum, ok := <-data
-			if ok {
-				if err := binary.Write(buf, binary.LittleEndian, datum.(int64)); err != nil {
-					panic(err.Error())
-				}
-			} else {
-				done = true
-				break
-			}
-		}
-		_, write_err := f.Write(buf.Bytes())
-		if write_err != nil {
-			panic(write_err.Error())
-		}
+	if err := writeFixed(filename, datatypes.INT64_TYPE, data, size, compression, visit); err != nil {
+		return nil, err
 	}
-	if i != size {
-		panic("size mismatch")
+	if bloom != nil {
+		if err := bloom.store(filename, size); err != nil {
+			removeFiles(filename)
+			return nil, err
+		}
 	}
 
 	return &PhysicalInt64{
 		filename: filename,
 		data_len: size,
+	}, nil
+}
+
+// Write a run plain, compressed if asked for
+func encodePlain(filename string, r *int64Run, compression *schema.Compression) (*PhysicalInt64, error) {
+	err := writeEncoded(filename, len(r.values), ENCODING_PLAIN, compression, func(w io.Writer) error {
+		return r.blocks(FIXED_BLOCK_SIZE, func(values []int64, nulls []bool) error {
+			return binary.Write(w, binary.LittleEndian, values)
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
+
+	return &PhysicalInt64{
+		filename: filename,
+		data_len: len(r.values),
+	}, nil
 }
 
 func LoadPhysicalInt64(filename string, size int) *PhysicalInt64 {
@@ -70,45 +89,44 @@ func LoadPhysicalInt64(filename string, size int) *PhysicalInt64 {
 	}
 }
 
-func (p *PhysicalInt64) Move(filename string) {
-	err := os.Rename(p.filename, filename)
-	if err != nil {
-		panic(err.Error())
+func (p *PhysicalInt64) Move(filename string) error {
+	if err := moveCompanions(p.filename, filename); err != nil {
+		return err
+	}
+	if err := os.Rename(p.filename, filename); err != nil {
+		return err
 	}
 	p.filename = filename
+	return nil
 }
 
-func (p *PhysicalInt64) Merge(o *PhysicalInt64, filename string) *PhysicalInt64 {
-
-	data1 := p.ReadAll()
-	data2 := o.ReadAll()
+// Write the rows of p followed by those of o to a new file, compressed if
+// asked for.  The merged column keeps a Bloom filter if either of them does.
+func (p *PhysicalInt64) Merge(o *PhysicalInt64, filename string, compression *schema.Compression) (*PhysicalInt64, error) {
+	with_bloom := hasBloomFilter(p.filename) || hasBloomFilter(o.filename)
+	ch, errs := concat(context.Background(), p, o)
+	merged, err := newPhysicalInt64(filename, ch, p.data_len+o.data_len, with_bloom, compression)
+	if read_err := <-errs; read_err != nil {
+		return nil, read_err
+	}
+	return merged, err
+}
 
-	ch := make(chan interface{})
-	go func() {
-		count := 0
-		for rows := range data1 {
-			for _, datum := range rows {
-				ch <- datum
-				count++
-			}
-		}
-		for rows := range data2 {
-			for _, datum := range rows {
-				ch <- datum
-				count++
-			}
-		}
-		close(ch)
-	}()
+func (p *PhysicalInt64) Delete() error {
+	if remove_err := os.Remove(p.filename); remove_err != nil {
+		return remove_err
+	}
+	return deleteCompanions(p.filename)
+}
 
-	return NewPhysicalInt64(filename, ch, p.data_len+o.data_len)
+// The zone map of the column, nil if it was written without one
+func (p *PhysicalInt64) ZoneMap() (*ZoneMap, error) {
+	return readZoneMap(p.filename, datatypes.INT64_TYPE, p.data_len)
 }
 
-func (p *PhysicalInt64) Delete() {
-	remove_err := os.Remove(p.filename)
-	if remove_err != nil {
-		panic(remove_err.Error())
-	}
+// The Bloom filter of the column, nil if it was written without one
+func (p *PhysicalInt64) BloomFilter() (*BloomFilter, error) {
+	return readBloomFilter(p.filename, p.data_len)
 }
 
 func (p *PhysicalInt64) GetSize() int {
@@ -116,90 +134,14 @@ func (p *PhysicalInt64) GetSize() int {
 }
 
 func (p *PhysicalInt64) ReadOne(i int) (interface{}, error) {
-	ch, err := p.Read(i, i+1)
-	if err != nil {
-		return nil, err
-	}
-
-	rows := <-ch
-	if len(rows) != 1 {
-		panic("Wrong length")
-	}
-	return rows[0], nil
+	return readOne(p, i)
 }
 
-func (p *PhysicalInt64) ReadAll() <-chan []interface{} {
-	ch, err := p.Read(0, p.data_len)
-	if err != nil {
-		panic(err.Error())
-	}
-	return ch
+func (p *PhysicalInt64) ReadAll(ctx context.Context) (*tableview.ColumnView, error) {
+	return p.Read(ctx, 0, p.data_len)
 }
 
-// exclusive
-func (p *PhysicalInt64) Read(i, j int) (<-chan []interface{}, error) {
-	if j < i {
-		return nil, fmt.Errorf("Second index must be at least as big as the first")
-	}
-
-	f, open_err := os.Open(p.filename) // open for reading
-	if open_err != nil {
-		panic(open_err.Error())
-	}
-
-	n_records := j - i
-	datum_size := datatypes.INT64_TYPE.GetSize()
-
-	ch := make(chan []interface{}, settings.ChanSize)
-
-	go func() {
-		cleanup := func() {
-			close(ch)
-			if close_err := f.Close(); close_err != nil {
-				panic(close_err.Error())
-			}
-		}
-
-		read_fun := func(amount_bytes, offset_bytes int) {
-			buf := make([]byte, amount_bytes)
-			data := make([]int64, amount_bytes/datum_size)
-
-			if _, read_err := f.ReadAt(buf, int64(offset_bytes)); read_err != nil {
-				cleanup()
-				panic(read_err.Error())
-			}
-
-			if bin_read_err := binary.Read(
-				bytes.NewReader(buf),
-				binary.LittleEndian,
-				data,
-			); bin_read_err != nil {
-				cleanup()
-				panic(bin_read_err.Error())
-			}
-
-			interface_data := make([]interface{}, len(data))
-			for i, datum := range data {
-				interface_data[i] = datum
-			}
-			ch <- interface_data
-		}
-
-		var k int
-		for k = 0; k < n_records/settings.BatchSize; k++ {
-			amount_bytes := settings.BatchSize * datum_size
-			offset_bytes := (i + k*settings.BatchSize) * datum_size
-
-			read_fun(amount_bytes, offset_bytes)
-		}
-		if n_records%settings.BatchSize != 0 {
-			amount_bytes := (n_records % settings.BatchSize) * datum_size
-			offset_bytes := (i + k*settings.BatchSize) * datum_size
-
-			read_fun(amount_bytes, offset_bytes)
-		}
-		cleanup()
-	}()
-
-	return ch, nil
+// Read rows [i, j).  The reader gives up once ctx is cancelled.
+func (p *PhysicalInt64) Read(ctx context.Context, i, j int) (*tableview.ColumnView, error) {
+	return readFixed(ctx, p.filename, datatypes.INT64_TYPE, p.data_len, i, j)
 }
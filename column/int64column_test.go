@@ -1,9 +1,10 @@
 package column
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"path"
+	"path/filepath"
 	"testing"
 )
 
@@ -12,10 +13,7 @@ const (
 )
 
 func setup_int64(t *testing.T) (*PhysicalInt64, []interface{}) {
-	err := os.MkdirAll("/var/stuffdb/test_table/c0", 0700)
-	if err != nil {
-		t.Error(err.Error())
-	}
+	dir := t.TempDir()
 
 	data := make([]interface{}, 0, n_records)
 	for i := int64(0); i < int64(n_records); i++ {
@@ -29,11 +27,14 @@ func setup_int64(t *testing.T) (*PhysicalInt64, []interface{}) {
 		close(ch)
 	}()
 
-	physical := NewPhysicalInt64(
-		fmt.Sprintf("/var/stuffdb/test_table/c0/%d", n_records),
+	physical, err := NewPhysicalInt64(
+		filepath.Join(dir, fmt.Sprint(n_records)),
 		ch,
 		n_records,
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	if physical.data_len != n_records {
 		t.Errorf("Did not set physical size correctly")
@@ -42,42 +43,23 @@ func setup_int64(t *testing.T) (*PhysicalInt64, []interface{}) {
 	return physical, data
 }
 
-func cleanup(t *testing.T) {
-	r := recover()
-
-	testpath := path.Join(
-		"/var",
-		"stuffdb",
-		"test_table",
-	)
-	remove_err := os.RemoveAll(testpath)
-	if remove_err != nil {
-		t.Errorf(remove_err.Error())
-	}
-
-	if r != nil {
-		panic(r)
-	}
-}
-
 func TestCreateInt64(t *testing.T) {
 	setup_int64(t)
-	defer cleanup(t)
 }
 
 func TestReadAll(t *testing.T) {
 	physical, data := setup_int64(t)
-	defer cleanup(t)
 
 	// test read batch
-	actual := physical.ReadAll()
-	if actual == nil {
-		t.Errorf("")
+	actual, err := physical.ReadAll(context.Background())
+	if err != nil {
+		t.Errorf("Expected no error in read all, got %s", err.Error())
 	}
 
 	count := 0
-	for rows := range actual {
-		for _, datum := range rows {
+	for vector := range actual.C {
+		for k := 0; k < vector.Len(); k++ {
+			datum := vector.Get(k)
 			if datum.(int64) != data[count] {
 				t.Errorf("Expected %d, got %d", data[count], datum.(int64))
 			}
@@ -91,10 +73,9 @@ func TestReadAll(t *testing.T) {
 
 func TestReadBatch(t *testing.T) {
 	physical, data := setup_int64(t)
-	defer cleanup(t)
 
 	// test read batch
-	actual, err := physical.Read(0, n_records)
+	actual, err := physical.Read(context.Background(), 0, n_records)
 	if err != nil {
 		t.Errorf("Expected no error in batch read, got %s", err.Error())
 	}
@@ -103,8 +84,9 @@ func TestReadBatch(t *testing.T) {
 	}
 
 	count := 0
-	for rows := range actual {
-		for _, datum := range rows {
+	for vector := range actual.C {
+		for k := 0; k < vector.Len(); k++ {
+			datum := vector.Get(k)
 			if datum.(int64) != data[count] {
 				t.Errorf("Expected %d, got %d", data[count], datum.(int64))
 			}
@@ -118,13 +100,12 @@ func TestReadBatch(t *testing.T) {
 
 func TestReadIndividual(t *testing.T) {
 	physical, data := setup_int64(t)
-	defer cleanup(t)
 
 	// test read one at a time (skip over 6/7 for perf)
 	for i := 0; i < n_records; i += 7 {
 		datum, read_err := physical.ReadOne(i)
 		if read_err != nil {
-			t.Errorf(read_err.Error())
+			t.Error(read_err)
 		}
 
 		if datum.(int64) != data[i] {
@@ -135,16 +116,16 @@ func TestReadIndividual(t *testing.T) {
 
 func TestMoveInt64(t *testing.T) {
 	physical, data := setup_int64(t)
-	defer cleanup(t)
 
 	// test read batch
-	actual, err := physical.Read(0, n_records)
+	actual, err := physical.Read(context.Background(), 0, n_records)
 	if err != nil {
 		t.Errorf("Expected no error in batch read, got %s", err.Error())
 	}
 	count := 0
-	for rows := range actual {
-		for _, datum := range rows {
+	for vector := range actual.C {
+		for k := 0; k < vector.Len(); k++ {
+			datum := vector.Get(k)
 			if datum.(int64) != data[count] {
 				t.Errorf("Expected %d, got %d", data[count], datum.(int64))
 			}
@@ -158,7 +139,7 @@ func TestMoveInt64(t *testing.T) {
 
 func TestMergeInt64(t *testing.T) {
 	physical1, data1 := setup_int64(t)
-	defer cleanup(t)
+	dir := filepath.Dir(physical1.filename)
 
 	data2 := make([]interface{}, 0, n_records)
 	for i := int64(0); i < int64(n_records); i++ {
@@ -173,26 +154,34 @@ func TestMergeInt64(t *testing.T) {
 		close(ch)
 	}()
 
-	physical2 := NewPhysicalInt64(
-		fmt.Sprintf("/var/stuffdb/test_table/c0/%d_b", n_records),
+	physical2, err := NewPhysicalInt64(
+		filepath.Join(dir, fmt.Sprintf("%d_b", n_records)),
 		ch,
 		n_records,
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	physical3 := physical1.Merge(
+	physical3, err := physical1.Merge(
 		physical2,
-		fmt.Sprintf("/var/stuffdb/test_table/c0/%d_c", n_records),
+		filepath.Join(dir, fmt.Sprintf("%d_c", n_records)),
+		nil,
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// test read batch
 	expected := append(data1, data2...)
-	actual, err := physical3.Read(0, 2*n_records)
+	actual, err := physical3.Read(context.Background(), 0, 2*n_records)
 	if err != nil {
 		t.Errorf("Expected no error in batch read, got %s", err.Error())
 	}
 	count := 0
-	for rows := range actual {
-		for _, datum := range rows {
+	for vector := range actual.C {
+		for k := 0; k < vector.Len(); k++ {
+			datum := vector.Get(k)
 			if datum.(int64) != expected[count] {
 				t.Errorf("Expected %d, got %d", expected[count], datum.(int64))
 			}
@@ -203,3 +192,64 @@ func TestMergeInt64(t *testing.T) {
 		t.Errorf("Expected length %d result, got %d", 2*n_records, count)
 	}
 }
+
+func TestNullsInt64(t *testing.T) {
+	dir := t.TempDir()
+
+	data := make([]interface{}, n_records)
+	for i := 0; i < n_records; i++ {
+		if i%3 != 0 {
+			data[i] = int64(i)
+		}
+	}
+	ch := make(chan interface{})
+	go func() {
+		for _, datum := range data {
+			ch <- datum
+		}
+		close(ch)
+	}()
+
+	physical, err := NewPhysicalInt64(filepath.Join(dir, "tmp"), ch, n_records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := physical.Move(filepath.Join(dir, fmt.Sprint(n_records))); err != nil {
+		t.Error(err)
+	}
+
+	count := 0
+	actual, err := physical.ReadAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for vector := range actual.C {
+		for k := 0; k < vector.Len(); k++ {
+			datum := vector.Get(k)
+			if datum != data[count] {
+				t.Errorf("Expected %v, got %v", data[count], datum)
+			}
+			count++
+		}
+	}
+	if count != n_records {
+		t.Errorf("Expected length %d result, got %d", n_records, count)
+	}
+
+	for i := 1; i < n_records; i += 7 {
+		datum, read_err := physical.ReadOne(i)
+		if read_err != nil {
+			t.Error(read_err)
+		}
+		if datum != data[i] {
+			t.Errorf("Expected %v, got %v", data[i], datum)
+		}
+	}
+
+	if err := physical.Delete(); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(physical.filename + VALIDITY_SUFFIX); !os.IsNotExist(err) {
+		t.Errorf("Expected the validity bitmap to be deleted")
+	}
+}
@@ -1,15 +1,137 @@
 package column
 
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jinpan/stuffdb/tableview"
+)
+
 var (
 	_ Physical = &PhysicalInt64{}
+	_ Physical = &PhysicalFloat64{}
+	_ Physical = &PhysicalString{}
+	_ Physical = &PhysicalDictInt64{}
+	_ Physical = &PhysicalRLEInt64{}
+	_ Physical = &PhysicalDeltaInt64{}
 )
 
 type Physical interface {
-	Delete()
+	Delete() error
 
 	GetSize() int
 	ReadOne(int) (interface{}, error)
-	ReadAll() <-chan []interface{}
-	Read(int, int) (<-chan []interface{}, error)
-	Move(string)
+	ReadAll(context.Context) (*tableview.ColumnView, error)
+	Read(context.Context, int, int) (*tableview.ColumnView, error)
+	Move(string) error
+	ZoneMap() (*ZoneMap, error)
+}
+
+// Discard whatever is left on the channel, so its producer can finish
+func drain(data <-chan interface{}) {
+	for range data {
+	}
+}
+
+// The files kept next to the data file of a physical column are named by
+// appending one of these
+var companion_suffixes = []string{HEAP_SUFFIX, VALIDITY_SUFFIX, ZONE_SUFFIX, BLOOM_SUFFIX, DICT_SUFFIX}
+
+// The name of the data file that a file belongs to, which is the file itself
+// unless it is a companion
+func dataFileName(name string) string {
+	for _, suffix := range companion_suffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// Best effort removal of a partially written physical column
+func removeFiles(filename string) {
+	os.Remove(filename)
+	for _, suffix := range companion_suffixes {
+		os.Remove(filename + suffix)
+	}
+}
+
+// Move the files kept next to a data file along with it
+func moveCompanions(from, to string) error {
+	for _, suffix := range companion_suffixes {
+		err := os.Rename(from+suffix, to+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the files kept next to a data file
+func deleteCompanions(filename string) error {
+	for _, suffix := range companion_suffixes {
+		err := os.Remove(filename + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stream the data of each physical column in turn.  Once the stream is
+// closed, errs yields the error that cut it short, if any.  The consumer must
+// either read ch until it is closed or cancel ctx.
+func concat(ctx context.Context, physicals ...Physical) (<-chan interface{}, <-chan error) {
+	ch := make(chan interface{})
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(ch)
+
+		for _, physical := range physicals {
+			cv, err := physical.ReadAll(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for vector := range cv.C {
+				for k := 0; k < vector.Len(); k++ {
+					select {
+					case ch <- vector.Get(k):
+					case <-ctx.Done():
+					}
+				}
+			}
+			if err := cv.Err(); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	return ch, errs
+}
+
+func readOne(p Physical, i int) (interface{}, error) {
+	cv, err := p.Read(context.Background(), i, i+1)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []interface{}
+	for vector := range cv.C {
+		for k := 0; k < vector.Len(); k++ {
+			data = append(data, vector.Get(k))
+		}
+	}
+	if err := cv.Err(); err != nil {
+		return nil, err
+	}
+	if len(data) != 1 {
+		return nil, fmt.Errorf("Expected to read 1 value, got %d", len(data))
+	}
+	return data[0], nil
 }
@@ -0,0 +1,103 @@
+package column
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jinpan/stuffdb/database"
+)
+
+const (
+	TMP_SUFFIX = "_tmp"
+)
+
+/*
+	Crash recovery for a column whose append was interrupted.  These work on
+	the files alone, as the column may not be loadable in the meantime.  An
+	append writes its new run under a name carrying TMP_SUFFIX, then retires
+	the runs it replaces, which are those whose inserts it covers, then
+	renames the new run, so the table's write-ahead log need only record
+	which of those steps was reached.  Retired runs left over once the new
+	run is in place are removed by Load.
+*/
+
+// Remove the new runs of an append that never committed, along with any
+// stray temporary files
+func DiscardPending(db *database.Database, tablename string, rank int) error {
+	return forEachFile(db.ColumnPath(tablename, rank), func(dir, name string) error {
+		if !strings.Contains(name, TMP_SUFFIX) {
+			return nil
+		}
+		return os.Remove(filepath.Join(dir, name))
+	})
+}
+
+// Remove the runs replaced by a committed append.  Only valid before any new
+// run has been renamed into place.
+func DeleteReplaced(db *database.Database, tablename string, rank int) error {
+	type span struct{ lo, hi int }
+	var pending []span
+	err := forEachFile(db.ColumnPath(tablename, rank), func(dir, name string) error {
+		if !strings.HasSuffix(name, TMP_SUFFIX) {
+			return nil // the heap or validity bitmap of a new run
+		}
+		if lo, hi, _, ok := parseRunName(strings.TrimSuffix(name, TMP_SUFFIX)); ok {
+			pending = append(pending, span{lo, hi})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return forEachFile(db.ColumnPath(tablename, rank), func(dir, name string) error {
+		if strings.Contains(name, TMP_SUFFIX) {
+			return nil
+		}
+		lo, hi, _, ok := parseRunName(dataFileName(name))
+		if !ok {
+			return nil
+		}
+		for _, s := range pending {
+			if s.lo <= lo && hi <= s.hi {
+				return os.Remove(filepath.Join(dir, name))
+			}
+		}
+		return nil
+	})
+}
+
+// Rename the new runs of a committed append into place.  Safe to repeat.
+func PromotePending(db *database.Database, tablename string, rank int) error {
+	dir := db.ColumnPath(tablename, rank)
+	err := forEachFile(dir, func(dir, name string) error {
+		if !strings.Contains(name, TMP_SUFFIX) {
+			return nil
+		}
+		return os.Rename(
+			filepath.Join(dir, name),
+			filepath.Join(dir, strings.Replace(name, TMP_SUFFIX, "", 1)),
+		)
+	})
+	if err != nil {
+		return err
+	}
+	return database.SyncDir(dir)
+}
+
+func forEachFile(dir string, f func(dir, name string) error) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if err := f(dir, fi.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package column
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+/*
+	A run-length encoded int64 column keeps one entry per run of equal
+	values: the row that ends the run, exclusive, and its value, as
+	little-endian uint64 and int64.  The entries are sorted by their ends, so
+	the entry holding a row is found by binary search, and a range of rows is
+	read from there on without touching the rest of the file.  A null
+	continues the run before it, and leading nulls join the first run.
+
+	Sorted columns with many repeats, such as dates or foreign keys of a
+	table loaded in order, take a few bytes per run however long it is.
+*/
+
+const rle_entry_size = 16
+
+type PhysicalRLEInt64 struct {
+	filename string
+	data_len int
+}
+
+// Write a run as runs of equal values
+func encodeRLE(filename string, r *int64Run, compression *schema.Compression) (*PhysicalRLEInt64, error) {
+	err := writeEncoded(filename, len(r.values), ENCODING_RLE, compression, func(w io.Writer) error {
+		var end int
+		var value int64
+		has_value := false
+		entry := make([]byte, rle_entry_size)
+		flush := func() error {
+			binary.LittleEndian.PutUint64(entry, uint64(end))
+			binary.LittleEndian.PutUint64(entry[8:], uint64(value))
+			_, write_err := w.Write(entry)
+			return write_err
+		}
+
+		err := r.blocks(DELTA_BLOCK_SIZE, func(values []int64, nulls []bool) error {
+			for k, x := range values {
+				is_null := nulls != nil && nulls[k]
+				if !is_null && !has_value {
+					value, has_value = x, true
+				} else if !is_null && x != value {
+					if err := flush(); err != nil {
+						return err
+					}
+					value = x
+				}
+				end++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if end > 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PhysicalRLEInt64{
+		filename: filename,
+		data_len: len(r.values),
+	}, nil
+}
+
+func LoadPhysicalRLEInt64(filename string, size int) *PhysicalRLEInt64 {
+	return &PhysicalRLEInt64{
+		filename: filename,
+		data_len: size,
+	}
+}
+
+func (p *PhysicalRLEInt64) Move(filename string) error {
+	if err := moveCompanions(p.filename, filename); err != nil {
+		return err
+	}
+	if err := os.Rename(p.filename, filename); err != nil {
+		return err
+	}
+	p.filename = filename
+	return nil
+}
+
+func (p *PhysicalRLEInt64) Delete() error {
+	if remove_err := os.Remove(p.filename); remove_err != nil {
+		return remove_err
+	}
+	return deleteCompanions(p.filename)
+}
+
+// The zone map of the column, nil if it was written without one
+func (p *PhysicalRLEInt64) ZoneMap() (*ZoneMap, error) {
+	return readZoneMap(p.filename, datatypes.INT64_TYPE, p.data_len)
+}
+
+// The Bloom filter of the column, nil if it was written without one
+func (p *PhysicalRLEInt64) BloomFilter() (*BloomFilter, error) {
+	return readBloomFilter(p.filename, p.data_len)
+}
+
+func (p *PhysicalRLEInt64) GetSize() int {
+	return p.data_len
+}
+
+func (p *PhysicalRLEInt64) ReadOne(i int) (interface{}, error) {
+	return readOne(p, i)
+}
+
+func (p *PhysicalRLEInt64) ReadAll(ctx context.Context) (*tableview.ColumnView, error) {
+	return p.Read(ctx, 0, p.data_len)
+}
+
+// Read rows [i, j), expanding the runs that hold them.  The reader gives up
+// once ctx is cancelled.
+func (p *PhysicalRLEInt64) Read(ctx context.Context, i, j int) (*tableview.ColumnView, error) {
+	return readDecoded(ctx, p.filename, p.data_len, i, j, func(f dataFile) func(int, []int64) error {
+		var r *bufio.Reader
+		var end int
+		var value int64
+		entry := make([]byte, rle_entry_size)
+
+		// find the first run ending after row start, and read on from there
+		seek := func(start int) error {
+			n_entries := int(f.Size() / rle_entry_size)
+			var read_err error
+			first := sort.Search(n_entries, func(e int) bool {
+				if _, err := f.ReadAt(entry[:8], int64(e)*rle_entry_size); err != nil && read_err == nil {
+					read_err = err
+				}
+				return int(binary.LittleEndian.Uint64(entry)) > start
+			})
+			if read_err != nil {
+				return fmt.Errorf("Unable to read %s: %w", p.filename, read_err)
+			}
+			r = bufio.NewReader(io.NewSectionReader(f, int64(first)*rle_entry_size, f.Size()))
+			return nil
+		}
+
+		return func(start int, values []int64) error {
+			if r == nil {
+				if err := seek(start); err != nil {
+					return err
+				}
+			}
+			for k := range values {
+				for start+k >= end {
+					if _, read_err := io.ReadFull(r, entry); read_err != nil {
+						return fmt.Errorf("Unable to read %s: %w", p.filename, read_err)
+					}
+					next_end := int(binary.LittleEndian.Uint64(entry))
+					if next_end <= end {
+						return corruptFile(p.filename, "invalid run ending at row %d", next_end)
+					}
+					end, value = next_end, int64(binary.LittleEndian.Uint64(entry[8:]))
+				}
+				values[k] = value
+			}
+			return nil
+		}
+	})
+}
@@ -0,0 +1,295 @@
+package column
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/settings"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+const (
+	HEAP_SUFFIX = ".heap"
+	offset_size = 8
+)
+
+/*
+	A physical column of variable length strings.
+
+	It is stored as two files: the heap holds the bytes of every string back
+	to back, and the offsets file holds size+1 little-endian int64 offsets
+	into the heap, so string k occupies heap[offsets[k]:offsets[k+1]].  The
+	offsets file carries the column's name; the heap sits next to it with
+	HEAP_SUFFIX appended.
+*/
+
+type PhysicalString struct {
+	filename string
+	data_len int
+}
+
+// Write the data on the channel to a new offsets file and heap.  The channel
+// is always drained, even if writing fails part way.
+func NewPhysicalString(
+	filename string,
+	data <-chan interface{},
+	size int,
+) (*PhysicalString, error) {
+	return newPhysicalString(filename, data, size, nil)
+}
+
+// Write the data, both offsets and heap compressed if asked for
+func newPhysicalString(
+	filename string,
+	data <-chan interface{},
+	size int,
+	compression *schema.Compression,
+) (p *PhysicalString, err error) {
+	defer drain(data)
+
+	w, create_err := createSealed(filename, datatypes.STRING_TYPE, ENCODING_PLAIN, compression)
+	if create_err != nil {
+		return nil, create_err
+	}
+	heap_w, create_err := createSealed(filename+HEAP_SUFFIX, datatypes.STRING_TYPE, ENCODING_PLAIN, compression)
+	if create_err != nil {
+		w.Abort()
+		return nil, create_err
+	}
+	defer func() {
+		if err == nil {
+			if close_err := w.Close(size); close_err != nil {
+				p, err = nil, close_err
+			}
+		} else {
+			w.Abort()
+		}
+		if err == nil {
+			if close_err := heap_w.Close(size); close_err != nil {
+				p, err = nil, close_err
+			}
+		} else {
+			heap_w.Abort()
+		}
+		if err != nil {
+			removeFiles(filename)
+		}
+	}()
+
+	offset := int64(0)
+	if err := binary.Write(w, binary.LittleEndian, offset); err != nil {
+		return nil, err
+	}
+
+	valid := &validity{}
+	zones := newZoneBuilder(datatypes.STRING_TYPE)
+	i := 0
+	for done := false; !done; {
+		buf := new(bytes.Buffer)
+		heap_buf := new(bytes.Buffer)
+		for j := 0; j < 1024; i, j = i+1, j+1 {
+			datum, ok := <-data
+			if ok {
+				is_null := datum == nil
+				valid.set(i, !is_null)
+				if datum == nil {
+					datum = ""
+				}
+				zones.addString(i, datum.(string), is_null)
+				n, _ := heap_buf.WriteString(datum.(string))
+				offset += int64(n)
+				if err := binary.Write(buf, binary.LittleEndian, offset); err != nil {
+					return nil, err
+				}
+			} else {
+				done = true
+				break
+			}
+		}
+		if _, write_err := heap_w.Write(heap_buf.Bytes()); write_err != nil {
+			return nil, write_err
+		}
+		if _, write_err := w.Write(buf.Bytes()); write_err != nil {
+			return nil, write_err
+		}
+	}
+	if i != size {
+		return nil, fmt.Errorf("Size mismatch writing %s: expected %d values, got %d",
+			filename, size, i)
+	}
+	if err := valid.store(filename, datatypes.STRING_TYPE, size); err != nil {
+		return nil, err
+	}
+	if err := zones.store(filename); err != nil {
+		return nil, err
+	}
+
+	return &PhysicalString{
+		filename: filename,
+		data_len: size,
+	}, nil
+}
+
+func LoadPhysicalString(filename string, size int) *PhysicalString {
+	return &PhysicalString{
+		filename: filename,
+		data_len: size,
+	}
+}
+
+func (p *PhysicalString) Move(filename string) error {
+	if err := os.Rename(p.filename+HEAP_SUFFIX, filename+HEAP_SUFFIX); err != nil {
+		return err
+	}
+	if err := moveCompanions(p.filename, filename); err != nil {
+		return err
+	}
+	if err := os.Rename(p.filename, filename); err != nil {
+		return err
+	}
+	p.filename = filename
+	return nil
+}
+
+// Write the rows of p followed by those of o to a new offsets file and heap,
+// compressed if asked for
+func (p *PhysicalString) Merge(o *PhysicalString, filename string, compression *schema.Compression) (*PhysicalString, error) {
+	ch, errs := concat(context.Background(), p, o)
+	merged, err := newPhysicalString(filename, ch, p.data_len+o.data_len, compression)
+	if read_err := <-errs; read_err != nil {
+		return nil, read_err
+	}
+	return merged, err
+}
+
+func (p *PhysicalString) Delete() error {
+	if remove_err := os.Remove(p.filename); remove_err != nil {
+		return remove_err
+	}
+	if remove_err := os.Remove(p.filename + HEAP_SUFFIX); remove_err != nil {
+		return remove_err
+	}
+	return deleteCompanions(p.filename)
+}
+
+// The zone map of the column, nil if it was written without one
+func (p *PhysicalString) ZoneMap() (*ZoneMap, error) {
+	return readZoneMap(p.filename, datatypes.STRING_TYPE, p.data_len)
+}
+
+func (p *PhysicalString) GetSize() int {
+	return p.data_len
+}
+
+func (p *PhysicalString) ReadOne(i int) (interface{}, error) {
+	return readOne(p, i)
+}
+
+func (p *PhysicalString) ReadAll(ctx context.Context) (*tableview.ColumnView, error) {
+	return p.Read(ctx, 0, p.data_len)
+}
+
+// Read rows [i, j).  The reader gives up once ctx is cancelled.
+func (p *PhysicalString) Read(ctx context.Context, i, j int) (*tableview.ColumnView, error) {
+	if j < i {
+		return nil, fmt.Errorf("Second index must be at least as big as the first")
+	}
+
+	is_valid, valid_err := readValidity(p.filename, datatypes.STRING_TYPE, p.data_len, i, j)
+	if valid_err != nil {
+		return nil, valid_err
+	}
+
+	f, open_err := openData(p.filename) // open for reading
+	if open_err != nil {
+		return nil, open_err
+	}
+	heap_f, open_err := openData(p.filename + HEAP_SUFFIX)
+	if open_err != nil {
+		f.Close()
+		return nil, open_err
+	}
+
+	n_records := j - i
+
+	cv := tableview.NewColumnView()
+
+	go func() {
+		defer func() {
+			for _, file := range []io.Closer{f, heap_f} {
+				if close_err := file.Close(); close_err != nil {
+					cv.Fail(close_err)
+				}
+			}
+			close(cv.C)
+		}()
+
+		// read the strings [start, start+amount)
+		read_fun := func(amount, start int) error {
+			buf := make([]byte, (amount+1)*offset_size)
+			offsets := make([]int64, amount+1)
+
+			if _, read_err := f.ReadAt(buf, int64(start*offset_size)); read_err != nil {
+				return fmt.Errorf("Unable to read %s: %w", p.filename, read_err)
+			}
+			if bin_read_err := binary.Read(
+				bytes.NewReader(buf),
+				binary.LittleEndian,
+				offsets,
+			); bin_read_err != nil {
+				return bin_read_err
+			}
+			for k := 0; k < amount; k++ {
+				if offsets[k] < 0 || offsets[k+1] < offsets[k] {
+					return corruptFile(p.filename, "invalid offsets at row %d", start+k)
+				}
+			}
+
+			heap := make([]byte, offsets[amount]-offsets[0])
+			if _, read_err := heap_f.ReadAt(heap, offsets[0]); read_err != nil {
+				return fmt.Errorf("Unable to read %s: %w", p.filename+HEAP_SUFFIX, read_err)
+			}
+
+			vector := &tableview.Vector{
+				Type:    datatypes.STRING_TYPE,
+				Strings: make([]string, amount),
+			}
+			if is_valid != nil {
+				vector.Nulls = make([]bool, amount)
+			}
+			for k := 0; k < amount; k++ {
+				if is_valid != nil && !is_valid(start-i+k) {
+					vector.Nulls[k] = true
+					continue
+				}
+				vector.Strings[k] = string(heap[offsets[k]-offsets[0] : offsets[k+1]-offsets[0]])
+			}
+			if !cv.Send(ctx, vector) {
+				return ctx.Err()
+			}
+			return nil
+		}
+
+		var k int
+		for k = 0; k < n_records/settings.BatchSize; k++ {
+			if err := read_fun(settings.BatchSize, i+k*settings.BatchSize); err != nil {
+				cv.Fail(err)
+				return
+			}
+		}
+		if n_records%settings.BatchSize != 0 {
+			if err := read_fun(n_records%settings.BatchSize, i+k*settings.BatchSize); err != nil {
+				cv.Fail(err)
+				return
+			}
+		}
+	}()
+
+	return cv, nil
+}
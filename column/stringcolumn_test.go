@@ -0,0 +1,154 @@
+package column
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setup_string(t *testing.T) (*PhysicalString, []interface{}) {
+	dir := t.TempDir()
+
+	// include empty strings and strings of varying length
+	data := make([]interface{}, 0, n_records)
+	for i := 0; i < n_records; i++ {
+		data = append(data, strings.Repeat("x", i%5)+fmt.Sprint(i%13))
+		if i%11 == 0 {
+			data[i] = ""
+		}
+	}
+	ch := make(chan interface{})
+	go func() {
+		for i := 0; i < n_records; i++ {
+			ch <- data[i]
+		}
+		close(ch)
+	}()
+
+	physical, err := NewPhysicalString(
+		filepath.Join(dir, fmt.Sprint(n_records)),
+		ch,
+		n_records,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if physical.data_len != n_records {
+		t.Errorf("Did not set physical size correctly")
+	}
+
+	return physical, data
+}
+
+func TestReadAllString(t *testing.T) {
+	physical, data := setup_string(t)
+
+	count := 0
+	actual, err := physical.ReadAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for vector := range actual.C {
+		for k := 0; k < vector.Len(); k++ {
+			datum := vector.Get(k)
+			if datum.(string) != data[count] {
+				t.Errorf("Expected %q, got %q", data[count], datum.(string))
+			}
+			count++
+		}
+	}
+	if count != n_records {
+		t.Errorf("Expected length %d result, got %d", n_records, count)
+	}
+}
+
+func TestReadRangeString(t *testing.T) {
+	physical, data := setup_string(t)
+
+	actual, err := physical.Read(context.Background(), 37, 1000)
+	if err != nil {
+		t.Errorf("Expected no error in batch read, got %s", err.Error())
+	}
+	count := 37
+	for vector := range actual.C {
+		for k := 0; k < vector.Len(); k++ {
+			datum := vector.Get(k)
+			if datum.(string) != data[count] {
+				t.Errorf("Expected %q, got %q", data[count], datum.(string))
+			}
+			count++
+		}
+	}
+	if count != 1000 {
+		t.Errorf("Expected to end at %d, ended at %d", 1000, count)
+	}
+
+	for i := 0; i < n_records; i += 7 {
+		datum, read_err := physical.ReadOne(i)
+		if read_err != nil {
+			t.Error(read_err)
+		}
+		if datum.(string) != data[i] {
+			t.Errorf("Expected %q, got %q", data[i], datum.(string))
+		}
+	}
+}
+
+func TestMoveMergeString(t *testing.T) {
+	physical1, data1 := setup_string(t)
+	dir := filepath.Dir(physical1.filename)
+
+	if err := physical1.Move(filepath.Join(dir, "moved")); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved") + HEAP_SUFFIX); err != nil {
+		t.Errorf("Expected the heap to move with the offsets: %s", err.Error())
+	}
+
+	data2 := []interface{}{"alabama", "", "wyoming"}
+	ch := make(chan interface{})
+	go func() {
+		for _, datum := range data2 {
+			ch <- datum
+		}
+		close(ch)
+	}()
+	physical2, err := NewPhysicalString(filepath.Join(dir, "3"), ch, len(data2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	physical3, err := physical1.Merge(physical2, filepath.Join(dir, "merged"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := physical1.Delete(); err != nil {
+		t.Error(err)
+	}
+	if err := physical2.Delete(); err != nil {
+		t.Error(err)
+	}
+
+	expected := append(data1, data2...)
+	count := 0
+	actual, err := physical3.ReadAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for vector := range actual.C {
+		for k := 0; k < vector.Len(); k++ {
+			datum := vector.Get(k)
+			if datum.(string) != expected[count] {
+				t.Errorf("Expected %q, got %q", expected[count], datum.(string))
+			}
+			count++
+		}
+	}
+	if count != len(expected) {
+		t.Errorf("Expected length %d result, got %d", len(expected), count)
+	}
+}
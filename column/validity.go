@@ -0,0 +1,71 @@
+package column
+
+import (
+	"fmt"
+
+	"github.com/jinpan/stuffdb/datatypes"
+)
+
+const (
+	VALIDITY_SUFFIX = ".valid"
+)
+
+/*
+	Nulls in a physical column are tracked by a validity bitmap stored next to
+	the data file with VALIDITY_SUFFIX appended, sealed like it.  Bit k (least significant bit
+	first) is set when row k holds a value.  Runs without any nulls, which is
+	the common case, have no bitmap file at all, and the data file holds a
+	zero value in the slot of every null.
+*/
+
+type validity struct {
+	bits     []byte
+	has_null bool
+}
+
+func (v *validity) set(i int, valid bool) {
+	for len(v.bits) <= i/8 {
+		v.bits = append(v.bits, 0)
+	}
+	if valid {
+		v.bits[i/8] |= 1 << uint(i%8)
+	} else {
+		v.has_null = true
+	}
+}
+
+// Whether row i holds a value, once it was set
+func (v *validity) get(i int) bool {
+	return v.bits[i/8]&(1<<uint(i%8)) != 0
+}
+
+// Write out the bitmap for the data file of a run of rows of the type, if any
+// row was null
+func (v *validity) store(filename string, data_type datatypes.DatumType, rows int) error {
+	if !v.has_null {
+		return nil
+	}
+	return writeCompanion(filename+VALIDITY_SUFFIX, data_type, rows, v.bits)
+}
+
+// Read the validity of rows [i, j) of the data file of a run of rows of the
+// type.  The returned function reports whether row i+k holds a value; it is
+// nil when the file has no nulls.
+func readValidity(filename string, data_type datatypes.DatumType, rows int, i, j int) (func(int) bool, error) {
+	f, open_err := openCompanion(filename+VALIDITY_SUFFIX, data_type, rows)
+	if open_err != nil || f == nil {
+		return nil, open_err
+	}
+	defer f.Close()
+
+	first_byte := i / 8
+	bits := make([]byte, (j+7)/8-first_byte)
+	if _, read_err := f.ReadAt(bits, int64(first_byte)); read_err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %w", filename+VALIDITY_SUFFIX, read_err)
+	}
+
+	return func(k int) bool {
+		bit := i + k - first_byte*8
+		return bits[bit/8]&(1<<uint(bit%8)) != 0
+	}, nil
+}
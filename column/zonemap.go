@@ -0,0 +1,380 @@
+package column
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/jinpan/stuffdb/datatypes"
+)
+
+const (
+	ZONE_SUFFIX = ".zone"
+
+	// the rows summarized by each zone of a zone map
+	ZONE_BLOCK_SIZE = 1024
+
+	// the bytes of a string kept as a bound of a zone
+	ZONE_PREFIX_SIZE = 32
+)
+
+/*
+	A zone map holds the smallest and largest value of every block of
+	ZONE_BLOCK_SIZE rows of a physical column, so that a scan looking for the
+	values in a range can skip the blocks that cannot hold any.  It is stored
+	next to the data file with ZONE_SUFFIX appended, sealed like it, its body
+	holding the block size as a little-endian uint32, then for every block
+	the number of values it summarizes as a uint32 followed, unless that is
+	0, by the minimum and the maximum.  Numbers are stored as in the data
+	file, and a string as its length as a uint32 followed by its bytes.  A
+	string bound is cut to ZONE_PREFIX_SIZE bytes, the maximum being rounded
+	up, so that the zones of long strings take little room; the bounds still
+	hold every value of the block, if less tightly.
+
+	Nulls and float NaNs lie in no range, so they are left out of the zones.
+	Physical columns written before zone maps existed have no file, and are
+	never skipped.
+*/
+
+// The values of a block of rows
+type Zone struct {
+	Count    int         // the values summarized, not counting nulls and NaNs
+	Min, Max interface{} // nil when Count is 0
+}
+
+type ZoneMap struct {
+	Zones []Zone // zone k covers the rows from k*ZONE_BLOCK_SIZE
+}
+
+// The zone of the whole physical column
+func (z *ZoneMap) Whole() Zone {
+	var whole Zone
+	for _, zone := range z.Zones {
+		whole = whole.merge(zone)
+	}
+	return whole
+}
+
+func (z Zone) merge(o Zone) Zone {
+	if o.Count == 0 {
+		return z
+	}
+	if z.Count == 0 {
+		return o
+	}
+	merged := Zone{Count: z.Count + o.Count, Min: z.Min, Max: z.Max}
+	if compare(o.Min, merged.Min) < 0 {
+		merged.Min = o.Min
+	}
+	if compare(o.Max, merged.Max) > 0 {
+		merged.Max = o.Max
+	}
+	return merged
+}
+
+// Builds the zone map of a physical column as its rows are written
+type zoneBuilder struct {
+	data_type datatypes.DatumType
+	zones     []Zone // the blocks before the one being filled
+	rows      int
+
+	// the values of the block being filled, by the column's type
+	count  int
+	ints   [2]int64 // the minimum and the maximum
+	floats [2]float64
+	strs   [2]string
+}
+
+func newZoneBuilder(data_type datatypes.DatumType) *zoneBuilder {
+	return &zoneBuilder{data_type: data_type}
+}
+
+// Close the blocks before that of row i
+func (b *zoneBuilder) next(i int) {
+	for len(b.zones) < i/ZONE_BLOCK_SIZE {
+		b.finish()
+	}
+	b.rows = i + 1
+}
+
+// Close the block being filled
+func (b *zoneBuilder) finish() {
+	zone := Zone{Count: b.count}
+	if b.count > 0 {
+		switch b.data_type {
+		case datatypes.INT64_TYPE:
+			zone.Min, zone.Max = b.ints[0], b.ints[1]
+		case datatypes.FLOAT64_TYPE:
+			zone.Min, zone.Max = b.floats[0], b.floats[1]
+		case datatypes.STRING_TYPE:
+			zone.Min, zone.Max = lowerBound(b.strs[0]), upperBound(b.strs[1])
+		}
+	}
+	b.zones = append(b.zones, zone)
+	b.count, b.strs = 0, [2]string{}
+}
+
+// Add the value of row i of an int64 column, rows being added in order
+func (b *zoneBuilder) addInt64(i int, value int64, is_null bool) {
+	b.next(i)
+	if is_null {
+		return
+	}
+	if b.count == 0 || value < b.ints[0] {
+		b.ints[0] = value
+	}
+	if b.count == 0 || value > b.ints[1] {
+		b.ints[1] = value
+	}
+	b.count++
+}
+
+// Add the value of row i of a float64 column, rows being added in order
+func (b *zoneBuilder) addFloat64(i int, value float64, is_null bool) {
+	b.next(i)
+	if is_null || math.IsNaN(value) {
+		return
+	}
+	if b.count == 0 || value < b.floats[0] {
+		b.floats[0] = value
+	}
+	if b.count == 0 || value > b.floats[1] {
+		b.floats[1] = value
+	}
+	b.count++
+}
+
+// Add the value of row i of a string column, rows being added in order
+func (b *zoneBuilder) addString(i int, value string, is_null bool) {
+	b.next(i)
+	if is_null {
+		return
+	}
+	if b.count == 0 || value < b.strs[0] {
+		b.strs[0] = value
+	}
+	if b.count == 0 || value > b.strs[1] {
+		b.strs[1] = value
+	}
+	b.count++
+}
+
+// The prefix of at most ZONE_PREFIX_SIZE bytes of s, which is no larger
+func lowerBound(s string) string {
+	if len(s) <= ZONE_PREFIX_SIZE {
+		return s
+	}
+	return s[:ZONE_PREFIX_SIZE]
+}
+
+// A string of at most ZONE_PREFIX_SIZE bytes that is no smaller than s: its
+// prefix with the last byte that can be incremented incremented.  s itself
+// if its prefix is all 0xff bytes, which no UTF-8 text holds.
+func upperBound(s string) string {
+	if len(s) <= ZONE_PREFIX_SIZE {
+		return s
+	}
+	prefix := []byte(s[:ZONE_PREFIX_SIZE])
+	for k := len(prefix) - 1; k >= 0; k-- {
+		if prefix[k] != 0xff {
+			prefix[k]++
+			return string(prefix[:k+1])
+		}
+	}
+	return s
+}
+
+// Write out the zone map for the data file
+func (b *zoneBuilder) store(filename string) error {
+	for len(b.zones) < (b.rows+ZONE_BLOCK_SIZE-1)/ZONE_BLOCK_SIZE {
+		b.finish()
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint32(ZONE_BLOCK_SIZE))
+	for _, zone := range b.zones {
+		binary.Write(buf, binary.LittleEndian, uint32(zone.Count))
+		if zone.Count == 0 {
+			continue
+		}
+		for _, datum := range []interface{}{zone.Min, zone.Max} {
+			if s, ok := datum.(string); ok {
+				binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+				buf.WriteString(s)
+			} else {
+				binary.Write(buf, binary.LittleEndian, datum)
+			}
+		}
+	}
+
+	return writeCompanion(filename+ZONE_SUFFIX, b.data_type, b.rows, buf.Bytes())
+}
+
+// Read the zone map of the data file of a run of rows of the type, which is
+// nil if it has none
+func readZoneMap(filename string, data_type datatypes.DatumType, rows int) (*ZoneMap, error) {
+	data, read_err := readCompanion(filename+ZONE_SUFFIX, data_type, rows)
+	if read_err != nil || data == nil {
+		return nil, read_err
+	}
+	r := bytes.NewReader(data)
+
+	corrupt := func(err error) error {
+		return fmt.Errorf("Unable to read %s: %s", filename+ZONE_SUFFIX, err.Error())
+	}
+	var block_size uint32
+	if err := binary.Read(r, binary.LittleEndian, &block_size); err != nil {
+		return nil, corrupt(err)
+	}
+	if block_size != ZONE_BLOCK_SIZE {
+		return nil, corrupt(fmt.Errorf("unexpected block size %d", block_size))
+	}
+
+	read_datum := func() (interface{}, error) {
+		switch data_type {
+		case datatypes.INT64_TYPE:
+			var datum int64
+			err := binary.Read(r, binary.LittleEndian, &datum)
+			return datum, err
+		case datatypes.FLOAT64_TYPE:
+			var datum float64
+			err := binary.Read(r, binary.LittleEndian, &datum)
+			return datum, err
+		case datatypes.STRING_TYPE:
+			var n uint32
+			if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+				return nil, err
+			}
+			datum := make([]byte, n)
+			_, err := io.ReadFull(r, datum)
+			return string(datum), err
+		}
+		return nil, fmt.Errorf("Invalid data type %s", data_type)
+	}
+
+	z := &ZoneMap{}
+	for {
+		var count uint32
+		if err := binary.Read(r, binary.LittleEndian, &count); err == io.EOF {
+			return z, nil
+		} else if err != nil {
+			return nil, corrupt(err)
+		}
+		zone := Zone{Count: int(count)}
+		if count > 0 {
+			var err error
+			if zone.Min, err = read_datum(); err != nil {
+				return nil, corrupt(err)
+			}
+			if zone.Max, err = read_datum(); err != nil {
+				return nil, corrupt(err)
+			}
+		}
+		z.Zones = append(z.Zones, zone)
+	}
+}
+
+/*
+A range of values of one type, such as Range{Lo: int64(90), Lo_open: true}
+for the values above 90.  A nil bound leaves that side unbounded, and an open
+bound excludes the bound itself.  Nulls and NaNs lie in no range.
+*/
+type Range struct {
+	Lo, Hi           interface{}
+	Lo_open, Hi_open bool
+}
+
+// Check that the bounds are values of the type
+func (r Range) Check(data_type datatypes.DatumType) error {
+	for _, bound := range []interface{}{r.Lo, r.Hi} {
+		if bound == nil {
+			continue
+		}
+		ok := false
+		switch data_type {
+		case datatypes.INT64_TYPE:
+			_, ok = bound.(int64)
+		case datatypes.FLOAT64_TYPE:
+			var f float64
+			f, ok = bound.(float64)
+			ok = ok && !math.IsNaN(f)
+		case datatypes.STRING_TYPE:
+			_, ok = bound.(string)
+		}
+		if !ok {
+			return fmt.Errorf("Range bound %v is not a valid %s", bound, data_type)
+		}
+	}
+	return nil
+}
+
+// Whether the datum lies in the range
+func (r Range) Contains(datum interface{}) bool {
+	return isValue(datum) && r.Overlaps(Zone{Count: 1, Min: datum, Max: datum})
+}
+
+// Whether the datum is neither null nor NaN
+func isValue(datum interface{}) bool {
+	f, ok := datum.(float64)
+	return datum != nil && !(ok && math.IsNaN(f))
+}
+
+// The range holding the single value
+func Point(datum interface{}) Range {
+	return Range{Lo: datum, Hi: datum}
+}
+
+// The value of a range holding a single value
+func (r Range) point() (interface{}, bool) {
+	if r.Lo == nil || r.Lo_open || r.Hi_open || r.Hi == nil || compare(r.Lo, r.Hi) != 0 {
+		return nil, false
+	}
+	return r.Lo, true
+}
+
+// Whether any value of the zone may lie in the range
+func (r Range) Overlaps(z Zone) bool {
+	if z.Count == 0 {
+		return false
+	}
+	if r.Lo != nil {
+		if c := compare(z.Max, r.Lo); c < 0 || (c == 0 && r.Lo_open) {
+			return false
+		}
+	}
+	if r.Hi != nil {
+		if c := compare(z.Min, r.Hi); c > 0 || (c == 0 && r.Hi_open) {
+			return false
+		}
+	}
+	return true
+}
+
+// Order two values of the same type
+func compare(a, b interface{}) int {
+	switch a := a.(type) {
+	case int64:
+		b := b.(int64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	case float64:
+		b := b.(float64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	case string:
+		if a < b.(string) {
+			return -1
+		} else if a > b.(string) {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,213 @@
+package column
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+)
+
+func TestZoneMap(t *testing.T) {
+	dir := t.TempDir()
+
+	// a block of nulls and NaNs between two blocks of numbers
+	size := 2*ZONE_BLOCK_SIZE + 10
+	ch := make(chan interface{})
+	go func() {
+		for i := 0; i < size; i++ {
+			switch {
+			case i/ZONE_BLOCK_SIZE != 1:
+				ch <- float64(i)
+			case i%2 == 0:
+				ch <- nil
+			default:
+				ch <- math.NaN()
+			}
+		}
+		close(ch)
+	}()
+	filename := filepath.Join(dir, "0_0_2058")
+	physical, err := NewPhysicalFloat64(filename, ch, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zone_map, err := physical.ZoneMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Zone{
+		{Count: ZONE_BLOCK_SIZE, Min: float64(0), Max: float64(ZONE_BLOCK_SIZE - 1)},
+		{},
+		{Count: 10, Min: float64(2 * ZONE_BLOCK_SIZE), Max: float64(size - 1)},
+	}
+	if zone_map == nil || !reflect.DeepEqual(zone_map.Zones, expected) {
+		t.Fatalf("Expected zones %v, got %+v", expected, zone_map)
+	}
+	if whole := zone_map.Whole(); whole.Count != ZONE_BLOCK_SIZE+10 || whole.Min != float64(0) || whole.Max != float64(size-1) {
+		t.Errorf("Unexpected zone %+v for the whole column", whole)
+	}
+
+	// the zone map follows the data file
+	moved := filepath.Join(dir, "0_0_2058_moved")
+	if err := physical.Move(moved); err != nil {
+		t.Fatal(err)
+	}
+	if moved_map, err := physical.ZoneMap(); err != nil || !reflect.DeepEqual(moved_map, zone_map) {
+		t.Errorf("Expected the zone map to move with the data, got %+v (%v)", moved_map, err)
+	}
+	if err := physical.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(moved + ZONE_SUFFIX); !os.IsNotExist(err) {
+		t.Errorf("Expected the zone map to be deleted, got %v", err)
+	}
+}
+
+func TestStringZoneBounds(t *testing.T) {
+	long := strings.Repeat("a", 100)
+	data := []string{long + "z", long, "b" + long, "\xff" + strings.Repeat("\xfe", 50)}
+	ch := make(chan interface{})
+	go func() {
+		for _, datum := range data {
+			ch <- datum
+		}
+		close(ch)
+	}()
+	physical, err := NewPhysicalString(filepath.Join(t.TempDir(), "0_0_4"), ch, len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone_map, err := physical.ZoneMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the bounds are cut short, yet still hold every value
+	zone := zone_map.Zones[0]
+	min, max := zone.Min.(string), zone.Max.(string)
+	if len(min) > ZONE_PREFIX_SIZE || len(max) > ZONE_PREFIX_SIZE {
+		t.Errorf("Expected bounds of at most %d bytes, got %q and %q", ZONE_PREFIX_SIZE, min, max)
+	}
+	for _, datum := range data {
+		if !Point(datum).Overlaps(zone) {
+			t.Errorf("Expected the zone %+v to hold %q", zone, datum)
+		}
+	}
+	if expected := "\xff" + strings.Repeat("\xfe", ZONE_PREFIX_SIZE-2) + "\xff"; max != expected {
+		t.Errorf("Expected the maximum to round up to %q, got %q", expected, max)
+	}
+	if upperBound(strings.Repeat("\xff", 40)) != strings.Repeat("\xff", 40) {
+		t.Errorf("Expected a string of 0xff bytes to be its own upper bound")
+	}
+}
+
+func TestRange(t *testing.T) {
+	zone := Zone{Count: 3, Min: int64(10), Max: int64(20)}
+	for _, test := range []struct {
+		r        Range
+		overlaps bool
+	}{
+		{Range{}, true},
+		{Range{Lo: int64(20)}, true},
+		{Range{Lo: int64(20), Lo_open: true}, false},
+		{Range{Hi: int64(10)}, true},
+		{Range{Hi: int64(10), Hi_open: true}, false},
+		{Range{Lo: int64(12), Hi: int64(15)}, true},
+		{Range{Lo: int64(21), Hi: int64(30)}, false},
+	} {
+		if test.r.Overlaps(zone) != test.overlaps {
+			t.Errorf("Expected %+v to overlap %+v: %v", test.r, zone, test.overlaps)
+		}
+	}
+
+	r := Range{Lo: "b", Hi: "c"}
+	if !r.Contains("bz") || r.Contains("cat") || r.Contains(nil) {
+		t.Errorf("Unexpected strings in %+v", r)
+	}
+	if (Range{}).Contains(math.NaN()) {
+		t.Errorf("Expected NaN to lie in no range")
+	}
+	if err := r.Check(datatypes.INT64_TYPE); err == nil {
+		t.Errorf("Expected string bounds to be invalid for an int64 column")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	db := column_setup(t)
+	s, err := schema.NewSchema([]string{"a"}, []datatypes.DatumType{datatypes.INT64_TYPE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	col, err := NewColumn(db, "zoned", s, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two runs of three blocks each, with values rising within each run
+	for run := 0; run < 2; run++ {
+		ch := make(chan interface{})
+		go func() {
+			for i := 0; i < 3*ZONE_BLOCK_SIZE; i++ {
+				ch <- int64(i)
+			}
+			close(ch)
+		}()
+		if err := col.Insert(ch, 3*ZONE_BLOCK_SIZE); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the values above the first block's, and the first value
+	snapshot := col.Snapshot()
+	for _, test := range []struct {
+		r     Range
+		spans []Span
+	}{
+		{
+			Range{Lo: int64(ZONE_BLOCK_SIZE)},
+			[]Span{{ZONE_BLOCK_SIZE, 3 * ZONE_BLOCK_SIZE}, {4 * ZONE_BLOCK_SIZE, 6 * ZONE_BLOCK_SIZE}},
+		},
+		{
+			Range{Hi: int64(0)},
+			[]Span{{0, ZONE_BLOCK_SIZE}, {3 * ZONE_BLOCK_SIZE, 4 * ZONE_BLOCK_SIZE}},
+		},
+	} {
+		spans, err := snapshot.Prune(test.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(spans, test.spans) {
+			t.Errorf("Expected spans %v for %+v, got %v", test.spans, test.r, spans)
+		}
+
+		// the spans read back the rows at their positions
+		cv := snapshot.ScanSpans(context.Background(), spans)
+		var data []interface{}
+		for vector := range cv.C {
+			for k := 0; k < vector.Len(); k++ {
+				data = append(data, vector.Get(k))
+			}
+		}
+		if err := cv.Err(); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, span := range spans {
+			for pos := span.Lo; pos < span.Hi; pos, n = pos+1, n+1 {
+				if n >= len(data) || data[n] != int64(pos%(3*ZONE_BLOCK_SIZE)) {
+					t.Fatalf("Unexpected value at position %d", pos)
+				}
+			}
+		}
+		if n != len(data) {
+			t.Errorf("Expected %d values, got %d", n, len(data))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	DEFAULT_ROOT = "/var/stuffdb"
+	CATALOG_FILE = "catalog"
+
+	SEGMENT_PREFIX = "segment_"
+)
+
+/*
+A handle on one database: a root directory holding a subdirectory per
+table.  Every file the storage layer touches is located relative to the
+root, so several databases can live side by side.
+*/
+type Database struct {
+	root string
+}
+
+// Open the database rooted at root, creating the directory if necessary
+func Open(root string) (*Database, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &Database{
+		root: root,
+	}, nil
+}
+
+func (d *Database) GetRoot() string {
+	return d.root
+}
+
+// The directory holding everything belonging to the table
+func (d *Database) TablePath(tablename string) string {
+	return filepath.Join(d.root, tablename)
+}
+
+// The directory holding the physical files of the table's rank'th column
+func (d *Database) ColumnPath(tablename string, rank int) string {
+	return filepath.Join(d.TablePath(tablename), fmt.Sprintf("c%d", rank))
+}
+
+// The write store file of the table
+func (d *Database) InsertBufferPath(tablename string) string {
+	return filepath.Join(d.TablePath(tablename), "insert_buffer")
+}
+
+// The metadata file of the table
+func (d *Database) MetadataPath(tablename string) string {
+	return filepath.Join(d.TablePath(tablename), "metadata")
+}
+
+// The delete vector of the table, marking the rows that have been deleted
+func (d *Database) DeletesPath(tablename string) string {
+	return filepath.Join(d.TablePath(tablename), "deletes")
+}
+
+// The write-ahead log named log of the table, recording an operation in
+// progress
+func (d *Database) WALPath(tablename string, log string) string {
+	return filepath.Join(d.TablePath(tablename), log+".wal")
+}
+
+// The file holding the sealed insert store segment seq of the table, which
+// holds n_entries rows
+func (d *Database) SegmentPath(tablename string, seq, n_entries int) string {
+	return filepath.Join(d.TablePath(tablename), fmt.Sprintf("%s%d_%d", SEGMENT_PREFIX, seq, n_entries))
+}
+
+// The commit record of the transaction id, which exists from the moment the
+// transaction commits until every table it changed has recorded it.  Table
+// names cannot contain a dot, so the file never clashes with a table.
+func (d *Database) TransactionPath(id string) string {
+	return filepath.Join(d.root, "txn."+id)
+}
+
+// The file listing every table in the database
+func (d *Database) CatalogPath() string {
+	return filepath.Join(d.root, CATALOG_FILE)
+}
+
+// Flush the directory itself, so that files created, renamed or removed in it
+// survive a crash
+func SyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if sync_err := f.Sync(); sync_err != nil {
+		f.Close()
+		return sync_err
+	}
+	return f.Close()
+}
@@ -1,8 +1,14 @@
 package datatypes
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 var (
 	_ Datum = &Int64Datum{}
 	_ Datum = &Float64Datum{}
+	_ Datum = &StringDatum{}
 )
 
 type DatumType int
@@ -10,6 +16,7 @@ type DatumType int
 const (
 	INT64_TYPE DatumType = iota
 	FLOAT64_TYPE
+	STRING_TYPE
 )
 
 type Datum interface {
@@ -17,16 +24,79 @@ type Datum interface {
 	GetData() interface{}
 }
 
-// Get the size of a datatype in bytes
+// Get the size of a datatype in bytes.  Variable length types have no fixed
+// size and report 0.
 func (d DatumType) GetSize() int {
 	switch d {
 	case INT64_TYPE:
 		return 8
 	case FLOAT64_TYPE:
 		return 8
+	case STRING_TYPE:
+		return 0
 	default:
 		panic("Invalid data type")
 	}
 
 	return 0
 }
+
+// Whether every datum of this type occupies GetSize bytes
+func (d DatumType) IsFixedSize() bool {
+	return d != STRING_TYPE
+}
+
+// The stable textual form of each type, as written to table metadata
+var type_names = map[DatumType]string{
+	INT64_TYPE:   "int64",
+	FLOAT64_TYPE: "float64",
+	STRING_TYPE:  "string",
+}
+
+func (d DatumType) String() string {
+	if name, ok := type_names[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("DatumType(%d)", int(d))
+}
+
+// Parse the textual form of a type
+func ParseDatumType(name string) (DatumType, error) {
+	for d, d_name := range type_names {
+		if d_name == name {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown data type %q", name)
+}
+
+func (d DatumType) MarshalJSON() ([]byte, error) {
+	name, ok := type_names[d]
+	if !ok {
+		return nil, fmt.Errorf("Unknown data type %d", int(d))
+	}
+	return json.Marshal(name)
+}
+
+func (d *DatumType) UnmarshalJSON(data []byte) error {
+	// older metadata stored the raw integer code
+	var code int
+	if err := json.Unmarshal(data, &code); err == nil {
+		if _, ok := type_names[DatumType(code)]; !ok {
+			return fmt.Errorf("Unknown data type %d", code)
+		}
+		*d = DatumType(code)
+		return nil
+	}
+
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return fmt.Errorf("Invalid data type %s", data)
+	}
+	parsed, err := ParseDatumType(name)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
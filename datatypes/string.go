@@ -0,0 +1,26 @@
+package datatypes
+
+type StringDatum struct {
+	datum string
+}
+
+func NewStringDatum(datum string) *StringDatum {
+	return &StringDatum{
+		datum: datum,
+	}
+}
+
+func NewStringDatumFromString(input string) (*StringDatum, error) {
+	datum := &StringDatum{
+		datum: input,
+	}
+	return datum, nil
+}
+
+func (s StringDatum) GetType() DatumType {
+	return STRING_TYPE
+}
+
+func (s StringDatum) GetData() interface{} {
+	return s.datum
+}
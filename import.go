@@ -1,110 +1,93 @@
 package main
 
 import (
-	"bufio"
+	"compress/flate"
+	"flag"
 	"fmt"
 	"os"
-	"path"
-	"strconv"
 	"strings"
 
-	"github.com/jinpan/stuffdb/datatypes"
-	"github.com/jinpan/stuffdb/schema"
-	"github.com/jinpan/stuffdb/table"
+	"github.com/jinpan/stuffdb/catalog"
+	"github.com/jinpan/stuffdb/database"
+	"github.com/jinpan/stuffdb/importer"
 )
 
-const (
-	N_COLS          = 190
-	TEST_TABLE_NAME = "test_census"
-)
-
-var (
-	TEST_PATH = path.Join(
-		"/var",
-		"stuffdb",
-		TEST_TABLE_NAME,
-	)
-)
+// stuffdb import [flags] file.csv: create a table holding the rows of a CSV
+// file with a header row.  The table is dropped again if the import fails.
+func importCommand(db *database.Database, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	name := flags.String("table", "", "the table to create")
+	schema_spec := flags.String("schema", "",
+		"the columns as name:type pairs, e.g. id:int64,score:float64?,name:string; inferred if empty")
+	sample_rows := flags.Int("sample", importer.DEFAULT_SAMPLE_ROWS, "the rows to infer the schema from")
+	null := flags.String("null", "", "the value read as null")
+	max_errors := flags.Int("max-errors", 0, "the number of bad lines tolerated")
+	bloom := flags.String("bloom", "", "the int64 columns to keep Bloom filters for, comma separated")
+	codec := flags.String("codec", "", "the codec to compress column files with, flate or zlib")
+	level := flags.Int("level", flate.DefaultCompression, "the compression level, from -2 to 9")
+	flags.Parse(args)
+	if *name == "" || flags.NArg() != 1 {
+		return fmt.Errorf("Usage: stuffdb import -table name [flags] file.csv")
+	}
 
-func makeSchema() *schema.Schema {
-	names := []string{
-		"serialno", "sporder", "puma00", "st", "adjinc", "pwgtp", "agep", "cit", "dear",
-		"deye", "hins1", "hins2", "hins3", "hins4", "hins5", "hins6", "hins7", "mar", "relp",
-		"sex", "anc", "anc1p05", "anc2p05", "dis", "hicov", "hisp", "nativity", "oc", "pobp05",
-		"privcov", "pubcov", "qtrbir", "rac1p", "rac2p05", "rac3p05", "racaian", "racasn", "racblk",
-		"racnhpi", "racnum", "racsor", "racwht", "rc", "waob", "fagep", "fancp", "fcitp", "fcitwp",
-		"fcowp", "fddrsp", "fdearp", "fdeyep", "fdoutp", "fdphyp", "fdratp", "fdratxp", "fdremp",
-		"fengp", "fesrp", "fferp", "ffodp", "fgclp", "fgcmp", "fgcrp", "fhins1p", "fhins2p",
-		"fhins3p", "fhins4p", "fhins5p", "fhins6p", "fhins7p", "fhisp", "findp", "fintp", "fjwdp",
-		"fjwmnp", "fjwrip", "fjwtrp", "flanp", "flanxp", "fmarhdp", "fmarhmp", "fmarhtp", "fmarhwp",
-		"fmarhyp", "fmarp", "fmigp", "fmigsp", "fmilpp", "fmilsp", "foccp", "foip", "fpap", "fpobp",
-		"fpowsp", "fracp", "frelp", "fretp", "fschgp", "fschlp", "fschp", "fsemp", "fsexp", "fssip",
-		"fssp", "fwagp", "fwkhp", "fwklp", "fwkwp", "fyoep", "pwgtp1", "pwgtp2", "pwgtp3", "pwgtp4",
-		"pwgtp5", "pwgtp6", "pwgtp7", "pwgtp8", "pwgtp9", "pwgtp10", "pwgtp11", "pwgtp12", "pwgtp13",
-		"pwgtp14", "pwgtp15", "pwgtp16", "pwgtp17", "pwgtp18", "pwgtp19", "pwgtp20", "pwgtp21",
-		"pwgtp22", "pwgtp23", "pwgtp24", "pwgtp25", "pwgtp26", "pwgtp27", "pwgtp28", "pwgtp29",
-		"pwgtp30", "pwgtp31", "pwgtp32", "pwgtp33", "pwgtp34", "pwgtp35", "pwgtp36", "pwgtp37",
-		"pwgtp38", "pwgtp39", "pwgtp40", "pwgtp41", "pwgtp42", "pwgtp43", "pwgtp44", "pwgtp45",
-		"pwgtp46", "pwgtp47", "pwgtp48", "pwgtp49", "pwgtp50", "pwgtp51", "pwgtp52", "pwgtp53",
-		"pwgtp54", "pwgtp55", "pwgtp56", "pwgtp57", "pwgtp58", "pwgtp59", "pwgtp60", "pwgtp61",
-		"pwgtp62", "pwgtp63", "pwgtp64", "pwgtp65", "pwgtp66", "pwgtp67", "pwgtp68", "pwgtp69",
-		"pwgtp70", "pwgtp71", "pwgtp72", "pwgtp73", "pwgtp74", "pwgtp75", "pwgtp76", "pwgtp77",
-		"pwgtp78", "pwgtp79", "pwgtp80",
+	opts := importer.Options{
+		Sample_rows: *sample_rows,
+		Null:        *null,
+		Max_errors:  *max_errors,
 	}
-	types := make([]datatypes.DatumType, len(names))
-	for i := 0; i < len(types); i++ {
-		types[i] = datatypes.INT64_TYPE
+	if *schema_spec != "" {
+		s, err := importer.ParseSchema(*schema_spec)
+		if err != nil {
+			return err
+		}
+		opts.Schema = s
 	}
 
-	schema, err := schema.NewSchema(names, types)
+	f, err := os.Open(flags.Arg(0))
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+	defer f.Close()
+	im, err := importer.NewImporter(f, opts)
+	if err != nil {
+		return err
 	}
-	return schema
-}
 
-func import_census() *table.Table {
-	s := makeSchema()
-	table := table.NewTable(TEST_TABLE_NAME, s)
-	if table == nil {
-		panic("Unable to create a new table")
+	s := im.Schema()
+	if *bloom != "" {
+		if s, err = s.WithBloomFilters(strings.Split(*bloom, ",")...); err != nil {
+			return err
+		}
+	}
+	if *codec != "" {
+		if s, err = s.WithCompression(*codec, *level); err != nil {
+			return err
+		}
 	}
 
-	f, err := os.Open("/home/jinpan/ss13pca_int.csv")
+	c, err := catalog.Open(db)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
-	defer f.Close()
-
-	scanner := bufio.NewScanner(f)
-	count := 0
-
-	rows := make(chan []interface{})
-	go func() {
-		for scanner.Scan() {
-			if count%1000 == 0 {
-				fmt.Println(count)
-			}
-
-			line := scanner.Text()
-			parts := strings.Split(line, ",")
-			if len(parts) != N_COLS {
-				panic(fmt.Sprintf("Expected %d cols, got %d", N_COLS, len(parts)))
-			}
-			row := make([]interface{}, N_COLS)
-			for i, part := range parts {
-				num, err := strconv.ParseInt(part, 10, 64)
-				if err != nil {
-					panic(err.Error())
-				}
-				row[i] = num
-			}
-			rows <- row
-			count++
+	t, err := c.CreateTable(*name, s)
+	if err != nil {
+		return err
+	}
+	result, err := im.Load(t)
+	if result != nil {
+		for _, line_err := range result.Errors {
+			fmt.Fprintln(os.Stderr, line_err)
 		}
-		close(rows)
-	}()
-	table.BulkInsert(rows, 1821870)
+	}
+	if err == nil {
+		err = t.Flush()
+	}
+	if err != nil {
+		t.Flush()
+		c.DropTable(*name)
+		return err
+	}
 
-	return table
+	fmt.Printf("Loaded %d rows into %s, skipped %d lines\n", result.Rows, *name, len(result.Errors))
+	return nil
 }
@@ -0,0 +1,292 @@
+package importer
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/table"
+)
+
+const (
+	// the number of rows whose values decide the types of an inferred schema
+	DEFAULT_SAMPLE_ROWS = 1000
+)
+
+// How to read the CSV
+type Options struct {
+	Schema      *schema.Schema // nil to infer the schema
+	Sample_rows int            // rows to infer the schema from; 0 for DEFAULT_SAMPLE_ROWS
+	Null        string         // the value read as null
+	Max_errors  int            // the number of bad lines tolerated
+}
+
+// A line that was skipped, and why
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+type Result struct {
+	Rows   int          // the rows loaded
+	Errors []*LineError // the lines skipped
+}
+
+/*
+An importer reads CSV with a header row naming the columns.  The schema is
+either given, in which case the header must name its columns in order, or
+inferred from the first rows: a column is int64 if every value parses as one,
+else float64 if every value parses as one, else string, and accepts nulls if
+any value is null.  A column of nulls alone is a nullable string.
+
+A line that cannot be decoded, such as a value of the wrong type or a line
+with the wrong number of fields, is skipped and reported, until more than
+Max_errors lines are bad.
+*/
+type Importer struct {
+	opts    Options
+	csv     *csv.Reader
+	schema  *schema.Schema
+	sampled []record // read to infer the schema, not decoded yet
+}
+
+// A CSV record along with the line it starts on
+type record struct {
+	fields []string
+	line   int
+	err    error
+}
+
+// Read the header, and the sample rows if the schema is to be inferred
+func NewImporter(r io.Reader, opts Options) (*Importer, error) {
+	if opts.Sample_rows <= 0 {
+		opts.Sample_rows = DEFAULT_SAMPLE_ROWS
+	}
+	im := &Importer{
+		opts: opts,
+		csv:  csv.NewReader(r),
+	}
+	im.csv.FieldsPerRecord = -1 // checked against the schema instead
+
+	header, err := im.csv.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("Expected a header row")
+	} else if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(header))
+	for i, name := range header {
+		names[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+
+	if opts.Schema != nil {
+		if len(names) != opts.Schema.GetLen() {
+			return nil, fmt.Errorf("The header has %d columns, the schema has %d",
+				len(names), opts.Schema.GetLen())
+		}
+		for i, name := range names {
+			if name != opts.Schema.GetName(i) {
+				return nil, fmt.Errorf("Column %d is %q in the header but %q in the schema",
+					i, name, opts.Schema.GetName(i))
+			}
+		}
+		im.schema = opts.Schema
+		return im, nil
+	}
+
+	for len(im.sampled) < opts.Sample_rows {
+		rec, err := im.read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		im.sampled = append(im.sampled, rec)
+	}
+	s, err := infer(names, im.sampled, opts.Null)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid header: %s", err.Error())
+	}
+	im.schema = s
+	return im, nil
+}
+
+// The next record.  A record that is not valid CSV comes back with its error
+// set; any other error stops the import.
+func (im *Importer) read() (record, error) {
+	fields, err := im.csv.Read()
+	if parse_err, ok := err.(*csv.ParseError); ok {
+		return record{line: parse_err.StartLine, err: parse_err.Err}, nil
+	} else if err != nil {
+		return record{}, err
+	}
+	line, _ := im.csv.FieldPos(0)
+	return record{fields: fields, line: line}, nil
+}
+
+// The type of a column that fits every value seen so far, from the narrowest
+const (
+	KIND_NULL = iota // only nulls so far
+	KIND_INT64
+	KIND_FLOAT64
+	KIND_STRING
+)
+
+func infer(names []string, sampled []record, null string) (*schema.Schema, error) {
+	kinds := make([]int, len(names))
+	nullable := make([]bool, len(names))
+	for _, rec := range sampled {
+		if rec.err != nil || len(rec.fields) != len(names) {
+			continue // reported once the row is decoded
+		}
+		for i, field := range rec.fields {
+			if field == null {
+				nullable[i] = true
+				continue
+			}
+			for kinds[i] < KIND_STRING && !fits(kinds[i], field) {
+				kinds[i]++
+			}
+		}
+	}
+
+	types := make([]datatypes.DatumType, len(names))
+	for i, kind := range kinds {
+		switch kind {
+		case KIND_INT64:
+			types[i] = datatypes.INT64_TYPE
+		case KIND_FLOAT64:
+			types[i] = datatypes.FLOAT64_TYPE
+		default:
+			types[i] = datatypes.STRING_TYPE
+			nullable[i] = nullable[i] || kind == KIND_NULL
+		}
+	}
+	return schema.NewNullableSchema(names, types, nullable)
+}
+
+func fits(kind int, field string) bool {
+	switch kind {
+	case KIND_INT64:
+		_, err := strconv.ParseInt(field, 10, 64)
+		return err == nil
+	case KIND_FLOAT64:
+		_, err := strconv.ParseFloat(field, 64)
+		return err == nil
+	case KIND_STRING:
+		return true
+	}
+	return false
+}
+
+// The schema of the rows, as given or inferred
+func (im *Importer) Schema() *schema.Schema {
+	return im.schema
+}
+
+// Decode a record's fields into a row of the schema
+func (im *Importer) decode(rec record) ([]interface{}, error) {
+	if rec.err != nil {
+		return nil, rec.err
+	}
+	if len(rec.fields) != im.schema.GetLen() {
+		return nil, fmt.Errorf("Expected %d fields, got %d", im.schema.GetLen(), len(rec.fields))
+	}
+
+	row := make([]interface{}, len(rec.fields))
+	for i, field := range rec.fields {
+		if field == im.opts.Null {
+			if !im.schema.IsNullable(i) {
+				return nil, fmt.Errorf("Column %s is not nullable", im.schema.GetName(i))
+			}
+			continue
+		}
+
+		var err error
+		switch im.schema.GetType(i) {
+		case datatypes.INT64_TYPE:
+			row[i], err = strconv.ParseInt(field, 10, 64)
+		case datatypes.FLOAT64_TYPE:
+			row[i], err = strconv.ParseFloat(field, 64)
+		case datatypes.STRING_TYPE:
+			row[i] = field
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q in column %s", im.schema.GetType(i), field, im.schema.GetName(i))
+		}
+	}
+	return row, nil
+}
+
+// Load every row into t, whose schema must be the importer's.  Rows are
+// loaded as they are read, in runs; if the import fails, the runs loaded
+// before stay in the table.
+func (im *Importer) Load(t *table.Table) (*Result, error) {
+	if t.Schema.GetLen() != im.schema.GetLen() {
+		return nil, fmt.Errorf("Table %s has %d columns, the CSV has %d",
+			t.Name, t.Schema.GetLen(), im.schema.GetLen())
+	}
+	for i := 0; i < im.schema.GetLen(); i++ {
+		if t.Schema.GetType(i) != im.schema.GetType(i) || t.Schema.IsNullable(i) != im.schema.IsNullable(i) {
+			return nil, fmt.Errorf("Column %d of table %s does not match the CSV", i, t.Name)
+		}
+	}
+
+	result := &Result{}
+	n_loaded, err := t.BulkLoadFrom(func() ([]interface{}, error) {
+		for {
+			var rec record
+			if len(im.sampled) > 0 {
+				rec, im.sampled = im.sampled[0], im.sampled[1:]
+			} else {
+				var err error
+				if rec, err = im.read(); err != nil {
+					return nil, err
+				}
+			}
+
+			row, err := im.decode(rec)
+			if err == nil {
+				return row, nil
+			}
+			result.Errors = append(result.Errors, &LineError{Line: rec.line, Err: err})
+			if len(result.Errors) > im.opts.Max_errors {
+				return nil, fmt.Errorf("Giving up after %d bad lines", len(result.Errors))
+			}
+		}
+	})
+	result.Rows = n_loaded
+	return result, err
+}
+
+// Parse a schema written as comma separated name:type pairs, where the type
+// is one of int64, float64 and string, followed by ? if the column accepts
+// nulls, e.g. "id:int64,score:float64?,name:string"
+func ParseSchema(spec string) (*schema.Schema, error) {
+	var names []string
+	var types []datatypes.DatumType
+	var nullable []bool
+	for _, column := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(column), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected name:type, got %q", column)
+		}
+		type_name := strings.TrimSuffix(parts[1], "?")
+		data_type, err := datatypes.ParseDatumType(type_name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, parts[0])
+		types = append(types, data_type)
+		nullable = append(nullable, type_name != parts[1])
+	}
+	return schema.NewNullableSchema(names, types, nullable)
+}
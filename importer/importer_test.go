@@ -0,0 +1,166 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jinpan/stuffdb/catalog"
+	"github.com/jinpan/stuffdb/database"
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/table"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+// Import the CSV into a new table, returning the table's rows
+func load(t *testing.T, csv string, opts Options) (*schema.Schema, *Result, tableview.TableViewRows, error) {
+	db, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	im, err := NewImporter(strings.NewReader(csv), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := catalog.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl, err := c.CreateTable("imported", im.Schema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, load_err := im.Load(tbl)
+	if err := tbl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	columns := make([]int, im.Schema().GetLen())
+	for i := range columns {
+		columns[i] = i
+	}
+	var rows tableview.TableViewRows
+	tv := tbl.Scan(context.Background(), columns...)
+	for batch := range tv.C {
+		rows = append(rows, batch...)
+	}
+	if err := tv.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return im.Schema(), result, rows, load_err
+}
+
+func TestInferSchema(t *testing.T) {
+	csv := "ID, Score,Name,Note\n" +
+		"1,2,alice,\n" +
+		"2,2.5,\"bob, jr\",\n" +
+		"3,,carol,\n"
+	s, result, rows, err := load(t, csv, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := schema.NewNullableSchema(
+		[]string{"id", "score", "name", "note"},
+		[]datatypes.DatumType{datatypes.INT64_TYPE, datatypes.FLOAT64_TYPE, datatypes.STRING_TYPE, datatypes.STRING_TYPE},
+		[]bool{false, true, false, true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("Expected schema %+v, got %+v", expected, s)
+	}
+
+	expected_rows := tableview.TableViewRows{
+		{int64(1), float64(2), "alice", nil},
+		{int64(2), 2.5, "bob, jr", nil},
+		{int64(3), nil, "carol", nil},
+	}
+	if !reflect.DeepEqual(rows, expected_rows) || result.Rows != 3 || len(result.Errors) != 0 {
+		t.Errorf("Expected rows %v, got %v (%+v)", expected_rows, rows, result)
+	}
+}
+
+func TestErrorBudget(t *testing.T) {
+	s, err := ParseSchema("a:int64,b:string?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csv := "a,b\n" +
+		"1,x\n" +
+		"two,y\n" + // line 3: not an int64
+		"3\n" + // line 4: too few fields
+		"4,\"z\n" + // line 5: unterminated quote, to the end
+		"5,w\n"
+
+	// within budget, the bad lines are skipped and reported
+	_, result, rows, err := load(t, csv, Options{Schema: s, Max_errors: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]int, len(result.Errors))
+	for i, line_err := range result.Errors {
+		lines[i] = line_err.Line
+	}
+	if !reflect.DeepEqual(lines, []int{3, 4, 5}) {
+		t.Errorf("Expected errors on lines 3, 4 and 5, got %v", result.Errors)
+	}
+	if !reflect.DeepEqual(rows, tableview.TableViewRows{{int64(1), "x"}}) {
+		t.Errorf("Unexpected rows %v", rows)
+	}
+
+	// over budget, the import stops
+	if _, _, _, err := load(t, csv, Options{Schema: s, Max_errors: 1}); err == nil {
+		t.Errorf("Expected the import to fail")
+	}
+}
+
+func TestSchemaMismatch(t *testing.T) {
+	s, err := ParseSchema("a:int64,b:string")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range []string{"a\n", "a,c\n", ""} {
+		if _, err := NewImporter(strings.NewReader(header), Options{Schema: s}); err == nil {
+			t.Errorf("Expected an error for header %q", header)
+		}
+	}
+	if _, err := NewImporter(strings.NewReader("a,A\n"), Options{}); err == nil {
+		t.Errorf("Expected an error for duplicate columns")
+	}
+	for _, spec := range []string{"a", "a:int32", "A:int64"} {
+		if _, err := ParseSchema(spec); err == nil {
+			t.Errorf("Expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestLoadInRuns(t *testing.T) {
+	// beyond the sample, a value that does not fit the inferred type is a
+	// bad line
+	n_rows := table.BULK_RUN_SIZE + table.MERGE_SIZE + 10
+	var b strings.Builder
+	b.WriteString("a,b\n")
+	for i := 0; i < n_rows; i++ {
+		fmt.Fprintf(&b, "%d,%d\n", i, 2*i)
+	}
+	b.WriteString("x,0\n")
+
+	_, result, rows, err := load(t, b.String(), Options{Sample_rows: 10, Max_errors: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != n_rows || len(rows) != n_rows || len(result.Errors) != 1 {
+		t.Fatalf("Expected %d rows and an error, got %d (%d scanned, %v)",
+			n_rows, result.Rows, len(rows), result.Errors)
+	}
+	for i, row := range rows {
+		if row[0] != int64(i) || row[1] != int64(2*i) {
+			t.Fatalf("Unexpected row %v at %d", row, i)
+		}
+	}
+}
@@ -1,45 +1,77 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
 	"runtime"
 	"runtime/debug"
 	"time"
 
+	"github.com/jinpan/stuffdb/catalog"
+	"github.com/jinpan/stuffdb/column"
+	"github.com/jinpan/stuffdb/database"
 	"github.com/jinpan/stuffdb/table"
 	"github.com/jinpan/stuffdb/tableview"
 )
 
-func filter_census(t *table.Table, c int) time.Duration {
-	cond := func(x interface{}) bool {
-		return x.(int64) == 0
-	}
+func filter_census(t *table.Table, c int) (time.Duration, error) {
+	// the rows whose first column is 0
+	cond := column.Range{Lo: int64(0), Hi: int64(0)}
 
 	cols := make([]int, c)
 	for i := 0; i < c; i++ {
 		cols[i] = i
 	}
-	tv := tableview.Filter(t.Scan(cols...), 0, cond)
+	ctx := context.Background()
+	tv := tableview.Rows(ctx, t.ScanWhere(ctx, 0, cond, cols...))
 
 	start_time := time.Now()
-	for rows := range tv {
+	for rows := range tv.C {
 		for _, row := range rows {
 			fmt.Println(row)
 		}
 	}
 	end_time := time.Now()
-	return end_time.Sub(start_time)
+	return end_time.Sub(start_time), tv.Err()
 }
 
 func main() {
+	root := flag.String("root", database.DEFAULT_ROOT, "directory holding the database")
+	flag.Parse()
+
+	db, err := database.Open(*root)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	if flag.Arg(0) == "import" {
+		if err := importCommand(db, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	debug.SetGCPercent(3200)
-	t := table.Load("test_census")
+	c, err := catalog.Open(db)
+	if err != nil {
+		panic(err.Error())
+	}
+	t, err := c.GetTable("test_census")
+	if err != nil {
+		panic(err.Error())
+	}
 
 	for i := 1; i < 256; i *= 2 {
 		var min_duration time.Duration
 		for j := 0; j < 3; j++ {
 			runtime.GC()
-			d := filter_census(t, i)
+			d, err := filter_census(t, i)
+			if err != nil {
+				panic(err.Error())
+			}
 			runtime.GC()
 			if min_duration == 0 {
 				min_duration = d
@@ -1,6 +1,7 @@
 package schema
 
 import (
+	"compress/flate"
 	"fmt"
 	"strings"
 
@@ -14,19 +15,73 @@ type Schema struct {
 	Names          []string              `json:"names"`
 	Types          []datatypes.DatumType `json:"types"`
 	Row_size_bytes int                   `json:"row_size_bytes"`
+	Nullable       []bool                `json:"nullable,omitempty"`
+	Bloom_filters  []bool                `json:"bloom_filters,omitempty"`
+	Compression    *Compression          `json:"compression,omitempty"`
 }
 
+const (
+	CODEC_FLATE = "flate"
+	CODEC_ZLIB  = "zlib"
+)
+
+// How the physical column files of a table are compressed: the codec, one of
+// the CODEC_ constants, and its level, from flate.HuffmanOnly to
+// flate.BestCompression
+type Compression struct {
+	Codec string `json:"codec"`
+	Level int    `json:"level"`
+}
+
+// Create a schema where no column accepts nulls
 func NewSchema(names []string, types []datatypes.DatumType) (*Schema, error) {
+	return NewNullableSchema(names, types, nil)
+}
+
+// Create a schema where column i accepts nulls iff nullable[i].  A nil
+// nullable means no column accepts nulls.
+func NewNullableSchema(
+	names []string,
+	types []datatypes.DatumType,
+	nullable []bool,
+) (*Schema, error) {
+	if err := validate(names, types, nullable); err != nil {
+		return nil, err
+	}
+
+	schema := &Schema{
+		Names:          make([]string, len(names)),
+		Types:          make([]datatypes.DatumType, len(types)),
+		Row_size_bytes: rowSizeBytes(types),
+	}
+	copy(schema.Names, names)
+	copy(schema.Types, types)
+	for _, is_nullable := range nullable {
+		if is_nullable {
+			schema.Nullable = make([]bool, len(nullable))
+			copy(schema.Nullable, nullable)
+			break
+		}
+	}
+
+	return schema, nil
+}
+
+func validate(names []string, types []datatypes.DatumType, nullable []bool) error {
 	// check size mismatch
 	if len(names) != len(types) {
-		return nil, fmt.Errorf("Size mismatch: |names| = %d, |types| = %d",
+		return fmt.Errorf("Size mismatch: |names| = %d, |types| = %d",
 			len(names), len(types))
 	}
+	if nullable != nil && len(nullable) != len(names) {
+		return fmt.Errorf("Size mismatch: |names| = %d, |nullable| = %d",
+			len(names), len(nullable))
+	}
 
 	// check that names are lower cased
 	for _, name := range names {
 		if name != strings.ToLower(name) {
-			return nil, fmt.Errorf("All names should be lower cased")
+			return fmt.Errorf("All names should be lower cased")
 		}
 	}
 
@@ -36,28 +91,120 @@ func NewSchema(names []string, types []datatypes.DatumType) (*Schema, error) {
 		name_set[name] = true
 	}
 	if len(name_set) < len(names) {
-		return nil, fmt.Errorf("All names should be unique")
+		return fmt.Errorf("All names should be unique")
 	}
 
+	return nil
+}
+
+func rowSizeBytes(types []datatypes.DatumType) int {
 	row_size_bytes := 0
 	for _, data_type := range types {
 		row_size_bytes += data_type.GetSize()
 	}
-	schema := &Schema{
-		Names:          make([]string, len(names)),
-		Types:          make([]datatypes.DatumType, len(types)),
-		Row_size_bytes: row_size_bytes,
+	return row_size_bytes
+}
+
+// A copy of the schema whose named columns keep a Bloom filter of their
+// values, which lets lookups of a key skip the runs that cannot hold it.
+// Only int64 columns can keep one.
+func (s *Schema) WithBloomFilters(names ...string) (*Schema, error) {
+	copied := *s
+	copied.Bloom_filters = make([]bool, len(s.Names))
+	copy(copied.Bloom_filters, s.Bloom_filters)
+	for _, name := range names {
+		found := false
+		for i, column_name := range s.Names {
+			if column_name == name {
+				copied.Bloom_filters[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No column named %s", name)
+		}
 	}
-	copy(schema.Names, names)
-	copy(schema.Types, types)
+	if err := copied.validateBloomFilters(); err != nil {
+		return nil, err
+	}
+	return &copied, nil
+}
 
-	return schema, nil
+// A copy of the schema whose column files are compressed with the codec at
+// the level
+func (s *Schema) WithCompression(codec string, level int) (*Schema, error) {
+	copied := *s
+	copied.Compression = &Compression{Codec: codec, Level: level}
+	if err := copied.validateCompression(); err != nil {
+		return nil, err
+	}
+	return &copied, nil
+}
+
+func (s *Schema) validateCompression() error {
+	if s.Compression == nil {
+		return nil
+	}
+	if s.Compression.Codec != CODEC_FLATE && s.Compression.Codec != CODEC_ZLIB {
+		return fmt.Errorf("Unknown codec %s", s.Compression.Codec)
+	}
+	if s.Compression.Level < flate.HuffmanOnly || s.Compression.Level > flate.BestCompression {
+		return fmt.Errorf("Invalid compression level %d", s.Compression.Level)
+	}
+	return nil
 }
 
+func (s *Schema) validateBloomFilters() error {
+	if s.Bloom_filters == nil {
+		return nil
+	}
+	if len(s.Bloom_filters) != len(s.Names) {
+		return fmt.Errorf("Size mismatch: |names| = %d, |bloom_filters| = %d",
+			len(s.Names), len(s.Bloom_filters))
+	}
+	for i, has_bloom := range s.Bloom_filters {
+		if has_bloom && s.Types[i] != datatypes.INT64_TYPE {
+			return fmt.Errorf("Column %s of type %s cannot keep a Bloom filter", s.Names[i], s.Types[i])
+		}
+	}
+	return nil
+}
+
+// Check a schema that did not come from NewSchema, e.g. one read back from
+// table metadata
+func (s *Schema) Validate() error {
+	if err := validate(s.Names, s.Types, s.Nullable); err != nil {
+		return err
+	}
+	if err := s.validateBloomFilters(); err != nil {
+		return err
+	}
+	if err := s.validateCompression(); err != nil {
+		return err
+	}
+	if row_size_bytes := rowSizeBytes(s.Types); row_size_bytes != s.Row_size_bytes {
+		return fmt.Errorf("Row size mismatch: expected %d bytes, metadata says %d",
+			row_size_bytes, s.Row_size_bytes)
+	}
+	return nil
+}
+
+// The size of a row in bytes, not counting variable length columns
 func (s *Schema) GetRowSizeBytes() int {
 	return s.Row_size_bytes
 }
 
+// Whether every row of this schema has the same size, i.e. there are no
+// variable length columns
+func (s *Schema) IsFixedSize() bool {
+	for _, data_type := range s.Types {
+		if !data_type.IsFixedSize() {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Schema) GetName(i int) string {
 	return s.Names[i]
 }
@@ -66,6 +213,25 @@ func (s *Schema) GetType(i int) datatypes.DatumType {
 	return s.Types[i]
 }
 
+func (s *Schema) IsNullable(i int) bool {
+	return s.Nullable != nil && s.Nullable[i]
+}
+
+// Whether column i keeps a Bloom filter
+func (s *Schema) HasBloomFilter(i int) bool {
+	return s.Bloom_filters != nil && s.Bloom_filters[i]
+}
+
+// Whether any column accepts nulls
+func (s *Schema) HasNullable() bool {
+	for _, is_nullable := range s.Nullable {
+		if is_nullable {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Schema) GetLen() int {
 	return len(s.Names)
 }
@@ -1,6 +1,8 @@
 package schema
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/jinpan/stuffdb/datatypes"
@@ -71,6 +73,189 @@ func TestSuccess(t *testing.T) {
 		t.Errorf("expected no error here")
 	}
 	if schema.GetRowSizeBytes() != 16 {
-		t.Error("Expected row size to be 16 bytes, got %d", schema.GetRowSizeBytes())
+		t.Errorf("Expected row size to be 16 bytes, got %d", schema.GetRowSizeBytes())
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	names1 := []string{
+		"a",
+		"b",
+	}
+	types1 := []datatypes.DatumType{
+		datatypes.INT64_TYPE,
+		datatypes.FLOAT64_TYPE,
+	}
+	schema, err := NewSchema(names1, types1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bytes, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bytes), `"types":["int64","float64"]`) {
+		t.Errorf("Expected textual types, got %s", bytes)
+	}
+
+	var loaded Schema
+	if err := json.Unmarshal(bytes, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Validate(); err != nil {
+		t.Errorf("expected no error here, got %s", err.Error())
+	}
+	for i := range types1 {
+		if loaded.GetType(i) != types1[i] {
+			t.Errorf("Expected type %s, got %s", types1[i], loaded.GetType(i))
+		}
+	}
+}
+
+func TestJSONUnknownType(t *testing.T) {
+	input := `{"names":["a"],"types":["decimal"],"row_size_bytes":8}`
+
+	var loaded Schema
+	err := json.Unmarshal([]byte(input), &loaded)
+	if err == nil {
+		t.Fatal("expected error here")
+	}
+	if !strings.Contains(err.Error(), "decimal") {
+		t.Errorf("Expected error to name the type, got %s", err.Error())
+	}
+}
+
+func TestJSONLegacyTypes(t *testing.T) {
+	input := `{"names":["a","b"],"types":[0,1],"row_size_bytes":16}`
+
+	var loaded Schema
+	if err := json.Unmarshal([]byte(input), &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetType(1) != datatypes.FLOAT64_TYPE {
+		t.Errorf("Expected type %s, got %s", datatypes.FLOAT64_TYPE, loaded.GetType(1))
+	}
+}
+
+func TestValidateRowSize(t *testing.T) {
+	input := `{"names":["a","b"],"types":["int64","int64"],"row_size_bytes":8}`
+
+	var loaded Schema
+	if err := json.Unmarshal([]byte(input), &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Validate(); err == nil {
+		t.Errorf("expected error here")
+	}
+}
+
+func TestNullable(t *testing.T) {
+	names1 := []string{
+		"a",
+		"b",
+	}
+	types1 := []datatypes.DatumType{
+		datatypes.INT64_TYPE,
+		datatypes.INT64_TYPE,
+	}
+
+	schema, err := NewNullableSchema(names1, types1, []bool{true})
+	if schema != nil || err == nil {
+		t.Errorf("expected error here: size mismatch")
+	}
+
+	schema, err = NewNullableSchema(names1, types1, []bool{false, true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.IsNullable(0) || !schema.IsNullable(1) || !schema.HasNullable() {
+		t.Errorf("Expected only column b to be nullable")
+	}
+
+	bytes, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Schema
+	if err := json.Unmarshal(bytes, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.IsNullable(0) || !loaded.IsNullable(1) {
+		t.Errorf("Expected nullability to survive a round trip, got %s", bytes)
+	}
+
+	schema, err = NewSchema(names1, types1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.IsNullable(0) || schema.HasNullable() {
+		t.Errorf("Expected no nullable columns")
+	}
+}
+
+func TestBloomFilters(t *testing.T) {
+	schema, err := NewSchema(
+		[]string{"a", "b"},
+		[]datatypes.DatumType{datatypes.INT64_TYPE, datatypes.STRING_TYPE},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, names := range [][]string{{"b"}, {"c"}} {
+		if _, err := schema.WithBloomFilters(names...); err == nil {
+			t.Errorf("Expected an error for a Bloom filter on %v", names)
+		}
+	}
+
+	bloomed, err := schema.WithBloomFilters("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bloomed.HasBloomFilter(0) || bloomed.HasBloomFilter(1) || schema.HasBloomFilter(0) {
+		t.Errorf("Expected only column a of the copy to keep a Bloom filter")
+	}
+
+	bytes, err := json.Marshal(bloomed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Schema
+	if err := json.Unmarshal(bytes, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Validate(); err != nil || !loaded.HasBloomFilter(0) {
+		t.Errorf("Expected Bloom filters to survive a round trip, got %s (%v)", bytes, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	schema, err := NewSchema([]string{"a"}, []datatypes.DatumType{datatypes.INT64_TYPE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, compression := range []Compression{{"lz4", 1}, {CODEC_FLATE, 10}, {CODEC_ZLIB, -3}} {
+		if _, err := schema.WithCompression(compression.Codec, compression.Level); err == nil {
+			t.Errorf("Expected an error for compression %v", compression)
+		}
+	}
+
+	compressed, err := schema.WithCompression(CODEC_ZLIB, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Compression != nil {
+		t.Errorf("Expected the original schema to be left uncompressed")
+	}
+	bytes, err := json.Marshal(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded Schema
+	if err := json.Unmarshal(bytes, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Validate(); err != nil || *loaded.Compression != (Compression{CODEC_ZLIB, 6}) {
+		t.Errorf("Expected compression to survive a round trip, got %s (%v)", bytes, err)
 	}
 }
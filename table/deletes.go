@@ -0,0 +1,234 @@
+package table
+
+import (
+	"context"
+	"io/ioutil"
+	"math/bits"
+	"os"
+
+	"github.com/jinpan/stuffdb/database"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+/*
+Deleted rows stay where they are until a merge rewrites them.  Meanwhile the
+table's delete vector, a bitmap over the positions of its rows in scan order,
+marks them, and scans skip them.  The positions cover the columns, the
+segments and the insert store alike; they only move when a merge drops
+deleted rows from the runs it writes, or puts rows of a bulk insert ahead of
+the insert store, and the merge then commits a shifted delete vector along
+with the new runs.
+
+A delete vector is never modified once in use, so a scan can go on reading
+the one it started with.  It is stored in its own file, which is replaced
+atomically by writing a temporary file first.
+*/
+type deleteVector struct {
+	bits      []byte
+	n_deleted int
+}
+
+func loadDeleteVector(filename string) (*deleteVector, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return &deleteVector{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	d := &deleteVector{bits: data}
+	for _, b := range data {
+		d.n_deleted += bits.OnesCount8(b)
+	}
+	return d, nil
+}
+
+// Durably write the delete vector to filename
+func (d *deleteVector) write(filename string) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, write_err := f.Write(d.bits); write_err != nil {
+		f.Close()
+		return write_err
+	}
+	if sync_err := f.Sync(); sync_err != nil {
+		f.Close()
+		return sync_err
+	}
+	return f.Close()
+}
+
+func (d *deleteVector) isDeleted(pos int) bool {
+	return pos/8 < len(d.bits) && d.bits[pos/8]&(1<<uint(pos%8)) != 0
+}
+
+// Whether any row at positions [i, j) is deleted
+func (d *deleteVector) anyDeleted(i, j int) bool {
+	if d.n_deleted == 0 {
+		return false
+	}
+	for pos := i; pos < j; pos++ {
+		if d.isDeleted(pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// The position of the i'th row that is not deleted
+func (d *deleteVector) position(i int) int {
+	for idx, b := range d.bits {
+		live := 8 - bits.OnesCount8(b)
+		if i >= live {
+			i -= live
+			continue
+		}
+		for k := 0; ; k++ {
+			if b&(1<<uint(k)) == 0 {
+				if i == 0 {
+					return idx*8 + k
+				}
+				i--
+			}
+		}
+	}
+	return len(d.bits)*8 + i
+}
+
+// A copy with the rows at the given positions deleted as well
+func (d *deleteVector) with(positions []int) *deleteVector {
+	updated := &deleteVector{
+		bits:      append([]byte(nil), d.bits...),
+		n_deleted: d.n_deleted,
+	}
+	for _, pos := range positions {
+		updated.set(pos)
+	}
+	return updated
+}
+
+// A copy in which the rows at positions [i, j) are replaced by n rows that
+// are not deleted, shifting the rows after them
+func (d *deleteVector) splice(i, j, n int) *deleteVector {
+	updated := &deleteVector{}
+	for idx, b := range d.bits {
+		for ; b != 0; b &= b - 1 {
+			pos := idx*8 + bits.TrailingZeros8(b)
+			if pos < i {
+				updated.set(pos)
+			} else if pos >= j {
+				updated.set(pos - (j - i) + n)
+			}
+		}
+	}
+	return updated
+}
+
+func (d *deleteVector) set(pos int) {
+	for pos/8 >= len(d.bits) {
+		d.bits = append(d.bits, 0)
+	}
+	if d.bits[pos/8]&(1<<uint(pos%8)) == 0 {
+		d.bits[pos/8] |= 1 << uint(pos%8)
+		d.n_deleted++
+	}
+}
+
+func (t *Table) deletesTmpPath() string {
+	return t.db.DeletesPath(t.Name) + ".tmp"
+}
+
+// Move a delete vector written to the temporary file into place
+func (t *Table) promoteDeletes() error {
+	if err := os.Rename(t.deletesTmpPath(), t.db.DeletesPath(t.Name)); err != nil {
+		return err
+	}
+	return database.SyncDir(t.db.TablePath(t.Name))
+}
+
+// Delete every row for which predicate returns true, given the values of all
+// of the row's columns.  Returns the number of rows deleted.  The rows stay
+// in storage until a merge drops them.
+func (t *Table) Delete(predicate func(row tableview.TableViewRow) bool) (int, error) {
+	// merges move rows around, so keep them out until the deletes are stored
+	t.merge_mu.Lock()
+	defer t.merge_mu.Unlock()
+
+	deletes, positions, _, err := t.findRows(predicate)
+	if err != nil || len(positions) == 0 {
+		return 0, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOpen(); err != nil {
+		return 0, err
+	}
+
+	updated := deletes.with(positions)
+	if err := updated.write(t.deletesTmpPath()); err != nil {
+		return 0, err
+	}
+	if err := t.promoteDeletes(); err != nil {
+		return 0, err
+	}
+	t.deletes = updated
+	return len(positions), nil
+}
+
+// The positions and values of the rows that are not deleted and for which
+// predicate returns true, along with the delete vector they were checked
+// against.  Called with t.merge_mu held, so the positions stay valid.
+func (t *Table) findRows(predicate func(row tableview.TableViewRow) bool) (
+	*deleteVector, []int, tableview.TableViewRows, error,
+) {
+	all_columns := make([]int, t.Schema.GetLen())
+	for i := range all_columns {
+		all_columns[i] = i
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := t.Snapshot()
+	deletes := s.deletes
+	bv := s.scanBatches(ctx, false, all_columns, nil, s.Release)
+
+	var positions []int
+	var rows tableview.TableViewRows
+	pos := 0
+	for batch := range bv.C {
+		for k := 0; k < batch.Len(); k, pos = k+1, pos+1 {
+			if deletes.isDeleted(pos) {
+				continue
+			}
+			row := make(tableview.TableViewRow, len(batch.Vectors))
+			for col_idx, vector := range batch.Vectors {
+				row[col_idx] = vector.Get(batch.Index(k))
+			}
+			if predicate(row) {
+				positions = append(positions, pos)
+				rows = append(rows, row)
+			}
+		}
+	}
+	if err := bv.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	return deletes, positions, rows, nil
+}
+
+// The i'th row's value in the given column, counting only the rows that are
+// not deleted, in scan order
+func (t *Table) GetDatum(i int, col_idx int) (interface{}, error) {
+	s := t.Snapshot()
+	defer s.Release()
+	return s.GetDatum(i, col_idx)
+}
+
+// The number of rows in the table that are not deleted
+func (t *Table) GetLen() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.N_entries - t.deletes.n_deleted
+}
@@ -0,0 +1,178 @@
+package table
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+// Check that the table holds the rows (i, 2i) for the odd i < n, and nothing
+// else
+func checkOddRows(t *testing.T, table *Table, n int) {
+	tv := table.Scan(context.Background(), 0, 1)
+	i := 1
+	for rows := range tv.C {
+		for _, row := range rows {
+			if row[0] != int64(i) || row[1] != int64(2*i) {
+				t.Fatalf("Expected row %d, got %v", i, row)
+			}
+			i += 2
+		}
+	}
+	if err := tv.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != n+1 || table.GetLen() != n/2 {
+		t.Errorf("Expected %d rows, got %d (length %d)", n/2, i/2, table.GetLen())
+	}
+
+	for k := 0; k < n/2; k += 97 {
+		datum, err := table.GetDatum(k, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if datum != int64(2*(2*k+1)) {
+			t.Errorf("Expected %d at row %d, got %v", 2*(2*k+1), k, datum)
+		}
+	}
+	if _, err := table.GetDatum(n/2, 0); err == nil {
+		t.Errorf("Expected an error reading past the last row")
+	}
+}
+
+func isEven(row tableview.TableViewRow) bool {
+	return row[0].(int64)%2 == 0
+}
+
+func TestDelete(t *testing.T) {
+	db := setup(t)
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows in the columns, in a segment and in the insert store
+	n_rows := 3*MERGE_SIZE + 10
+	table.merge_mu.Lock()
+	for i := 0; i < n_rows; i++ {
+		if err := table.Insert([]interface{}{int64(i), int64(2 * i)}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 2*MERGE_SIZE {
+			table.merge_mu.Unlock()
+			if err := table.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			table.merge_mu.Lock()
+		}
+	}
+	table.merge_mu.Unlock()
+
+	n, err := table.Delete(isEven)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != n_rows/2 {
+		t.Errorf("Expected %d rows deleted, got %d", n_rows/2, n)
+	}
+	checkOddRows(t, table, n_rows)
+
+	// deleting them again does nothing
+	if n, err := table.Delete(isEven); err != nil || n != 0 {
+		t.Errorf("Expected no rows deleted, got %d (%v)", n, err)
+	}
+
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkOddRows(t, table, n_rows)
+	checkOddRows(t, mustLoad(t, db, TEST_TABLE_NAME), n_rows)
+}
+
+func TestCompactionDropsDeletedRows(t *testing.T) {
+	db := setup(t)
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := table.Insert([]interface{}{int64(i), int64(2 * i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := table.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// three runs per column, then a fourth which merges them
+	insert(0, 3*MERGE_SIZE)
+	if _, err := table.Delete(isEven); err != nil {
+		t.Fatal(err)
+	}
+	if n := table.columns[0].GetSize(); n != 3*MERGE_SIZE {
+		t.Errorf("Expected the deleted rows to stay until compacted, got %d rows", n)
+	}
+	insert(3*MERGE_SIZE, 4*MERGE_SIZE)
+	if _, err := table.Delete(func(row tableview.TableViewRow) bool {
+		return row[0].(int64) >= 3*MERGE_SIZE && isEven(row)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkOddRows(t, table, 4*MERGE_SIZE)
+	if n := table.columns[0].GetSize(); n != 3*MERGE_SIZE/2+MERGE_SIZE {
+		t.Errorf("Expected %d rows left in the columns, got %d", 3*MERGE_SIZE/2+MERGE_SIZE, n)
+	}
+	if table.N_entries != 3*MERGE_SIZE/2+MERGE_SIZE || table.deletes.n_deleted != MERGE_SIZE/2 {
+		t.Errorf("Unexpected %d entries with %d deleted", table.N_entries, table.deletes.n_deleted)
+	}
+	checkOddRows(t, mustLoad(t, db, TEST_TABLE_NAME), 4*MERGE_SIZE)
+}
+
+func TestDeleteVectorSplice(t *testing.T) {
+	d := (&deleteVector{}).with([]int{1, 5, 6, 20, 30})
+
+	// drop 5 and 6 from [4, 10), which is replaced by 4 rows
+	spliced := d.splice(4, 10, 4)
+	for pos := 0; pos < 40; pos++ {
+		expected := pos == 1 || pos == 18 || pos == 28
+		if spliced.isDeleted(pos) != expected {
+			t.Errorf("Expected %d to be deleted: %t", pos, expected)
+		}
+	}
+	if spliced.n_deleted != 3 {
+		t.Errorf("Expected %d deleted, got %d", 3, spliced.n_deleted)
+	}
+	if d.n_deleted != 5 || !d.isDeleted(5) {
+		t.Errorf("Splice changed the original delete vector")
+	}
+
+	if pos := spliced.position(1); pos != 2 {
+		t.Errorf("Expected row %d at position %d, got %d", 1, 2, pos)
+	}
+	if pos := spliced.position(40); pos != 43 {
+		t.Errorf("Expected row %d at position %d, got %d", 40, 43, pos)
+	}
+}
+
+func TestFailedInsertKeepsMergeDeletes(t *testing.T) {
+	_, table := walSetup(t, 10)
+
+	// the vector a merge writes before it commits, while inserts carry on
+	table.merge_mu.Lock()
+	defer table.merge_mu.Unlock()
+	updated := (&deleteVector{}).with([]int{3})
+	if err := updated.write(table.deletesTmpPath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Insert([]interface{}{int64(10), "20"}); err == nil {
+		t.Fatal("Expected a string in an int64 column to be refused")
+	}
+	if _, err := os.Stat(table.deletesTmpPath()); err != nil {
+		t.Errorf("Expected the merge's delete vector to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,331 @@
+package table
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jinpan/stuffdb/column"
+	"github.com/jinpan/stuffdb/database"
+	"github.com/jinpan/stuffdb/tableview"
+	"github.com/jinpan/stuffdb/writestore"
+)
+
+/*
+Inserts land in the insert store.  Once it holds MERGE_SIZE rows it is sealed:
+its file is renamed to a segment and a fresh insert store takes further
+inserts.  The tuple mover, a goroutine that runs while there are sealed
+segments, merges them into the columns oldest first.  A table's rows are the
+rows of its columns, followed by those of its segments, followed by those of
+its insert store; a merge commits under the table's lock, so a scan, which
+reads a snapshot taken under the same lock, always sees each row exactly
+once.
+*/
+
+// A sealed insert store waiting for the tuple mover
+type segment struct {
+	seq   int
+	name  string // the segment's file, relative to the table's directory
+	store *writestore.InsertStore
+}
+
+// The sealed segments of a table, oldest first
+func loadSegments(t *Table) ([]*segment, error) {
+	files, err := ioutil.ReadDir(t.db.TablePath(t.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []*segment
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), database.SEGMENT_PREFIX) {
+			continue
+		}
+		var seq, n_entries int
+		_, err := fmt.Sscanf(strings.TrimPrefix(fi.Name(), database.SEGMENT_PREFIX), "%d_%d", &seq, &n_entries)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected file %s in table %s", fi.Name(), t.Name)
+		}
+		segments = append(segments, &segment{
+			seq:   seq,
+			name:  fi.Name(),
+			store: writestore.Open(filepath.Join(t.db.TablePath(t.Name), fi.Name()), t.Name, t.Schema, n_entries),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+	return segments, nil
+}
+
+// Seal the insert store as a segment for the tuple mover and start a new
+// insert store.  Called with t.mu held.
+func (t *Table) seal() error {
+	seq := 0
+	if len(t.segments) > 0 {
+		seq = t.segments[len(t.segments)-1].seq + 1
+	}
+	filename := t.db.SegmentPath(t.Name, seq, t.insert_store.GetLen())
+	sealed := t.insert_store
+	if err := sealed.Move(filename); err != nil {
+		return err
+	}
+	t.segments = append(t.segments, &segment{
+		seq:   seq,
+		name:  filepath.Base(filename),
+		store: sealed,
+	})
+	t.wakeMover()
+
+	is, err := writestore.NewInsertStore(t.db, t.Name, t.Schema)
+	if err != nil {
+		return err
+	}
+	t.insert_store = is
+	return database.SyncDir(t.db.TablePath(t.Name))
+}
+
+// Start the tuple mover, unless it is already running or has nothing to do.
+// Called with t.mu held.
+func (t *Table) wakeMover() {
+	if t.moving || len(t.segments) == 0 {
+		return
+	}
+	t.moving = true
+	go t.moveSegments()
+}
+
+// The tuple mover: merge segments into the columns until none are left.  An
+// error stops the mover, leaving the segment in place, and is reported by the
+// next Flush.
+func (t *Table) moveSegments() {
+	for {
+		t.merge_mu.Lock()
+		more, err := t.moveSegment()
+		t.merge_mu.Unlock()
+
+		if err != nil || !more {
+			t.mu.Lock()
+			t.moving = false
+			if err != nil {
+				t.mover_err = err
+			} else {
+				t.wakeMover() // in case a segment was sealed just now
+			}
+			t.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Merge the oldest segment into the columns.  Returns false if there was none.
+// Called with t.merge_mu held.
+func (t *Table) moveSegment() (bool, error) {
+	t.mu.RLock()
+	if len(t.segments) == 0 {
+		t.mu.RUnlock()
+		return false, nil
+	}
+	seg := t.segments[0]
+	t.mu.RUnlock()
+
+	return true, t.merge(seg, nil, 0)
+}
+
+// Merge every sealed segment into the columns before returning, and report
+// any error the tuple mover or the removal of retired files ran into since
+// the last Flush.  A table should be flushed before its files are removed.
+func (t *Table) Flush() error {
+	t.merge_mu.Lock()
+	defer t.merge_mu.Unlock()
+
+	t.mu.Lock()
+	mover_err := t.mover_err
+	t.mover_err = nil
+	t.mu.Unlock()
+	t.pin_mu.Lock()
+	if mover_err == nil {
+		mover_err = t.gc_err
+	}
+	t.gc_err = nil
+	t.pin_mu.Unlock()
+
+	for {
+		more, err := t.moveSegment()
+		if err != nil {
+			return err
+		}
+		if !more {
+			return mover_err
+		}
+	}
+}
+
+// Move the rows of seg, if any, followed by n_rows rows from rows, into the
+// columns, dropping the deleted rows of the runs written.  The appends to
+// every column commit at once, so a crash leaves either the old or the new
+// columns.  Called with t.merge_mu held.
+func (t *Table) merge(seg *segment, rows <-chan []interface{}, n_rows int) error {
+	// only merges and deletes change the delete vector, and both hold
+	// t.merge_mu
+	t.mu.RLock()
+	deletes := t.deletes
+	t.mu.RUnlock()
+
+	var buffered tableview.TableViewRows
+	if seg != nil {
+		seg_view, err := seg.store.ReadAll(context.Background())
+		if err != nil {
+			return err
+		}
+		for rows := range seg_view.C {
+			buffered = append(buffered, rows...)
+		}
+		if err := seg_view.Err(); err != nil {
+			return err
+		}
+	}
+
+	if err := t.logIntent(MERGE_LOG, walRecord{Op: WAL_MERGE}); err != nil {
+		return err
+	}
+
+	chans := make([]chan interface{}, t.Schema.GetLen())
+	for i := 0; i < t.Schema.GetLen(); i++ {
+		chans[i] = make(chan interface{})
+	}
+	split_err := make(chan error, 1)
+	go func() {
+		defer func() {
+			for i := 0; i < t.Schema.GetLen(); i++ {
+				close(chans[i])
+			}
+		}()
+		for _, row := range buffered {
+			for j := 0; j < t.Schema.GetLen(); j++ {
+				chans[j] <- row[j]
+			}
+		}
+		for i := 0; i < n_rows; i++ {
+			row, ok := <-rows
+			if !ok {
+				split_err <- fmt.Errorf("Expected %d rows, got %d", n_rows, i)
+				return
+			}
+			if len(row) != t.Schema.GetLen() {
+				split_err <- fmt.Errorf("Row %d has %d values, expected %d", i, len(row), t.Schema.GetLen())
+				return
+			}
+			for j := 0; j < t.Schema.GetLen(); j++ {
+				chans[j] <- row[j]
+			}
+		}
+		split_err <- nil
+	}()
+
+	// write the new runs without holding the lock, so inserts and scans
+	// carry on meanwhile
+	// the rows of rows are new, so only the rows before them can be deleted
+	n_old := t.columns[0].GetSize() + len(buffered)
+	dropped := func(pos int) bool {
+		return pos < n_old && deletes.isDeleted(pos)
+	}
+	pendings := make([]*column.Pending, t.Schema.GetLen())
+	errs := make([]error, t.Schema.GetLen())
+	var wg sync.WaitGroup
+	for i := 0; i < t.Schema.GetLen(); i++ {
+		wg.Add(1)
+		go func(i int) {
+			pendings[i], errs[i] = t.columns[i].Prepare(chans[i], len(buffered)+n_rows, dropped)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	if err := <-split_err; err != nil {
+		errs = append([]error{err}, errs...)
+	}
+	for _, err := range errs {
+		if err != nil {
+			for _, pending := range pendings {
+				if pending != nil {
+					pending.Abort()
+				}
+			}
+			t.logDone(MERGE_LOG)
+			return err
+		}
+	}
+
+	// the rows after the ones rewritten move by the rows added and dropped
+	start, n_dropped := pendings[0].Start(), pendings[0].Dropped()
+	var updated *deleteVector
+	if deletes.n_deleted > 0 {
+		updated = deletes.splice(start, n_old, n_old-start-n_dropped+n_rows)
+		if err := updated.write(t.deletesTmpPath()); err != nil {
+			for _, pending := range pendings {
+				pending.Abort()
+			}
+			t.logDone(MERGE_LOG)
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// past this point, recovery finishes the merge
+	commit := walRecord{Op: WAL_MERGE_COMMIT, N_entries: t.N_entries + n_rows - n_dropped}
+	if seg != nil {
+		commit.Segment = seg.name
+	}
+	if err := t.logIntent(MERGE_LOG, commit); err != nil {
+		return err
+	}
+	for _, pending := range pendings {
+		pending.Retire()
+	}
+	commit.Op = WAL_MERGE_DELETED
+	if err := t.logIntent(MERGE_LOG, commit); err != nil {
+		return err
+	}
+	for _, pending := range pendings {
+		if err := pending.Promote(); err != nil {
+			return err
+		}
+	}
+	if seg != nil {
+		// renamed so that Load does not merge it again
+		t.segments = t.segments[1:]
+		if err := seg.store.Move(filepath.Join(t.db.TablePath(t.Name), seg.name+OBSOLETE_SUFFIX)); err != nil {
+			return err
+		}
+	}
+	if updated != nil {
+		if err := t.promoteDeletes(); err != nil {
+			return err
+		}
+		t.deletes = updated
+	}
+	if commit.N_entries != t.N_entries {
+		t.N_entries = commit.N_entries
+		if err := t.store(); err != nil {
+			return err
+		}
+	}
+
+	t.pin_mu.Lock()
+	t.version++
+	for _, pending := range pendings {
+		t.retire(pending.DeleteRetired)
+	}
+	if seg != nil {
+		t.retire(seg.store.Delete)
+	}
+	t.collectGarbage()
+	t.pin_mu.Unlock()
+	return t.logDone(MERGE_LOG)
+}
@@ -0,0 +1,104 @@
+package table
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestTupleMover(t *testing.T) {
+	db := setup(t)
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// scan while rows move from segments into the columns, checking that no
+	// row is missed or seen twice
+	n_rows := 3*MERGE_SIZE + 10
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		last_count := 0
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			tv := table.Scan(context.Background(), 0, 1)
+			row_count := 0
+			for rows := range tv.C {
+				for _, row := range rows {
+					if row[0] != int64(row_count) || row[1] != int64(2*row_count) {
+						t.Errorf("Unexpected row %v at %d", row, row_count)
+					}
+					row_count++
+				}
+			}
+			if err := tv.Err(); err != nil {
+				t.Error(err)
+			}
+			if row_count < last_count {
+				t.Errorf("Scan saw %d rows after an earlier scan saw %d", row_count, last_count)
+			}
+			last_count = row_count
+		}
+	}()
+
+	for i := 0; i < n_rows; i++ {
+		if err := table.Insert([]interface{}{int64(i), int64(2 * i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(table.segments) != 0 {
+		t.Errorf("Expected no segments after a flush, got %d", len(table.segments))
+	}
+	if n := table.columns[0].GetSize(); n != 3*MERGE_SIZE {
+		t.Errorf("Expected %d rows in the columns, got %d", 3*MERGE_SIZE, n)
+	}
+	// each merge appends a run to each column, leaving the rows in place
+	stats := table.CompactionStats()
+	if stats.Runs != 3*2 || stats.WriteAmplification() != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	checkRows(t, table, n_rows)
+	checkRows(t, mustLoad(t, db, TEST_TABLE_NAME), n_rows)
+	checkClean(t, db)
+}
+
+func TestLoadSegments(t *testing.T) {
+	db, table := walSetup(t, 10)
+
+	// seal segments without moving them, as if the process had stopped
+	// before the tuple mover got to them
+	table.merge_mu.Lock()
+	for i := 10; i < 2*MERGE_SIZE+10; i++ {
+		if err := table.Insert([]interface{}{int64(i), int64(2 * i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(table.segments) != 2 {
+		t.Fatalf("Expected %d segments, got %d", 2, len(table.segments))
+	}
+
+	recovered := mustLoad(t, db, TEST_TABLE_NAME)
+	checkRows(t, recovered, 2*MERGE_SIZE+10)
+	if err := recovered.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := recovered.columns[0].GetSize(); n != 2*MERGE_SIZE {
+		t.Errorf("Expected %d rows in the columns, got %d", 2*MERGE_SIZE, n)
+	}
+	checkRows(t, mustLoad(t, db, TEST_TABLE_NAME), 2*MERGE_SIZE+10)
+	checkClean(t, db)
+}
@@ -0,0 +1,475 @@
+package table
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jinpan/stuffdb/column"
+	"github.com/jinpan/stuffdb/settings"
+	"github.com/jinpan/stuffdb/tableview"
+	"github.com/jinpan/stuffdb/writestore"
+)
+
+const (
+	// a merged segment is renamed with this suffix until no snapshot reads it
+	OBSOLETE_SUFFIX = ".obsolete"
+)
+
+/*
+A snapshot pins a version of a table: the runs of its columns, its segments,
+the number of rows in its insert store and its delete vector, all taken at
+once under the table's lock.  Writers publish a new version under the same
+lock, so a snapshot never sees part of an insert or a merge.
+
+Inserts only append to the insert store, past the rows of any snapshot.  A
+merge retires the runs and the segment it replaces instead of deleting them,
+and bumps the table's version; the retired files are removed once every
+snapshot of an older version is released.  Load removes whatever retired
+files a crash left behind.
+*/
+type Snapshot struct {
+	table     *Table
+	version   int
+	columns   []*column.Snapshot
+	stores    []*writestore.InsertStore // the segments, then the insert store
+	lens      []int                     // the rows of each store in the snapshot
+	deletes   *deleteVector
+	n_entries int
+	released  bool
+}
+
+// Files retired by a merge, to be removed once no snapshot reads them
+type garbage struct {
+	retired int // the first version without the files
+	remove  func() error
+}
+
+// Pin the current version of the table.  The snapshot must be released once
+// it is no longer read.
+func (t *Table) Snapshot() *Snapshot {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.snapshot()
+}
+
+// Pin the current version of every table at once, so that the snapshots
+// reflect either all or none of the changes of a transaction.  The snapshots
+// are returned in the order of tables.
+func Snapshots(tables ...*Table) []*Snapshot {
+	ordered := lockOrder(tables)
+	for _, t := range ordered {
+		t.mu.RLock()
+	}
+	defer func() {
+		for _, t := range ordered {
+			t.mu.RUnlock()
+		}
+	}()
+
+	snapshots := make([]*Snapshot, len(tables))
+	for i, t := range tables {
+		snapshots[i] = t.snapshot()
+	}
+	return snapshots
+}
+
+// Called with t.mu held for reading
+func (t *Table) snapshot() *Snapshot {
+	s := &Snapshot{
+		table:     t,
+		columns:   make([]*column.Snapshot, len(t.columns)),
+		deletes:   t.deletes,
+		n_entries: t.N_entries,
+	}
+	for i, col := range t.columns {
+		s.columns[i] = col.Snapshot()
+	}
+	for _, seg := range t.segments {
+		s.stores = append(s.stores, seg.store)
+		s.lens = append(s.lens, seg.store.GetLen())
+	}
+	s.stores = append(s.stores, t.insert_store)
+	s.lens = append(s.lens, t.insert_store.GetLen())
+
+	t.pin_mu.Lock()
+	defer t.pin_mu.Unlock()
+	s.version = t.version
+	if t.pins == nil {
+		t.pins = make(map[int]int)
+	}
+	t.pins[t.version]++
+	return s
+}
+
+// Unpin the snapshot, letting the files only it reads be removed.  Safe to
+// repeat.
+func (s *Snapshot) Release() {
+	t := s.table
+	t.pin_mu.Lock()
+	defer t.pin_mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+	t.pins[s.version]--
+	if t.pins[s.version] == 0 {
+		delete(t.pins, s.version)
+	}
+	t.collectGarbage()
+}
+
+// Remove the files retired at the current version once no snapshot reads
+// them.  Called with t.mu and t.pin_mu held.
+func (t *Table) retire(remove func() error) {
+	t.garbage = append(t.garbage, garbage{retired: t.version, remove: remove})
+}
+
+// Remove the retired files that no snapshot reads any more.  An error is kept
+// for the next Flush.  Called with t.pin_mu held.
+func (t *Table) collectGarbage() {
+	oldest := t.version
+	for version := range t.pins {
+		if version < oldest {
+			oldest = version
+		}
+	}
+
+	kept := t.garbage[:0]
+	for _, g := range t.garbage {
+		if g.retired > oldest {
+			kept = append(kept, g)
+			continue
+		}
+		if err := g.remove(); err != nil {
+			if t.gc_err == nil {
+				t.gc_err = err
+			}
+			kept = append(kept, g)
+		}
+	}
+	t.garbage = kept
+}
+
+// Remove the segments that were retired when the process stopped
+func (t *Table) removeObsolete() error {
+	files, err := ioutil.ReadDir(t.db.TablePath(t.Name))
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), OBSOLETE_SUFFIX) {
+			if err := os.Remove(filepath.Join(t.db.TablePath(t.Name), fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The number of rows in the snapshot that are not deleted
+func (s *Snapshot) GetLen() int {
+	return s.n_entries - s.deletes.n_deleted
+}
+
+// Stream the given columns of every row in the snapshot.  Errors are reported
+// as for Table.Scan.
+func (s *Snapshot) Scan(ctx context.Context, columns ...int) *tableview.TableView {
+	return tableview.Rows(ctx, s.ScanBatches(ctx, columns...))
+}
+
+// Stream the given columns of every row in the snapshot, as batches holding
+// one vector per column.
+func (s *Snapshot) ScanBatches(ctx context.Context, columns ...int) *tableview.BatchView {
+	return s.scanBatches(ctx, true, columns, nil, nil)
+}
+
+// Stream the given columns of the rows in the snapshot whose value in column
+// col_idx lies in r, as batches holding one vector per column.  The zone maps
+// of the column's runs let the scan skip the blocks holding no such value,
+// and for a single value so do their Bloom filters.
+func (s *Snapshot) ScanWhere(ctx context.Context, col_idx int, r column.Range, columns ...int) *tableview.BatchView {
+	return s.scanBatches(ctx, true, columns, &condition{col_idx: col_idx, r: r}, nil)
+}
+
+// The i'th row's value in the given column, counting only the rows that are
+// not deleted, in scan order
+func (s *Snapshot) GetDatum(i int, col_idx int) (interface{}, error) {
+	t := s.table
+	if col_idx < 0 || col_idx >= len(s.columns) {
+		return nil, fmt.Errorf("Table %s has no column %d", t.Name, col_idx)
+	}
+	if i < 0 || i >= s.GetLen() {
+		return nil, fmt.Errorf("Table %s has no row %d", t.Name, i)
+	}
+
+	pos := s.deletes.position(i)
+	col := s.columns[col_idx]
+	if pos < col.GetSize() {
+		return col.GetDatum(pos)
+	}
+	pos -= col.GetSize()
+
+	for k, store := range s.stores {
+		if pos < s.lens[k] {
+			return readDatum(store, pos, col_idx)
+		}
+		pos -= s.lens[k]
+	}
+	return nil, fmt.Errorf("Table %s has no row %d", t.Name, i)
+}
+
+func readDatum(store *writestore.InsertStore, i int, col_idx int) (interface{}, error) {
+	row, err := store.ReadOne(i)
+	if err != nil {
+		return nil, err
+	}
+	return row[col_idx], nil
+}
+
+// Restricts a scan to the rows whose value in a column lies in a range, or
+// is one of a set of keys
+type condition struct {
+	col_idx int
+	r       column.Range
+	keys    map[interface{}]bool // if not nil, used instead of r
+}
+
+func (c *condition) matches(datum interface{}) bool {
+	if c.keys != nil {
+		return datum != nil && c.keys[datum]
+	}
+	return c.r.Contains(datum)
+}
+
+// Check the condition against the schema, and find the spans of the column
+// that may hold the rows meeting it
+func (c *condition) prune(s *Snapshot) ([]column.Span, error) {
+	t := s.table
+	if c.col_idx < 0 || c.col_idx >= len(s.columns) {
+		return nil, fmt.Errorf("Table %s has no column %d", t.Name, c.col_idx)
+	}
+	data_type := t.Schema.GetType(c.col_idx)
+	if c.keys == nil {
+		if err := c.r.Check(data_type); err != nil {
+			return nil, err
+		}
+		return s.columns[c.col_idx].Prune(c.r)
+	}
+
+	keys := make([]interface{}, 0, len(c.keys))
+	for key := range c.keys {
+		if err := column.Point(key).Check(data_type); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return s.columns[c.col_idx].PruneKeys(keys)
+}
+
+// Stream the given columns of every row in the snapshot, leaving out the
+// deleted rows if skip_deleted is set, and the rows not meeting where if
+// given.  done, if given, is called once the scan is over.
+func (s *Snapshot) scanBatches(
+	ctx context.Context,
+	skip_deleted bool,
+	columns []int,
+	where *condition,
+	done func(),
+) *tableview.BatchView {
+	t := s.table
+	bv := tableview.NewBatchView()
+
+	go func() {
+		defer close(bv.C)
+		if done != nil {
+			defer done()
+		}
+
+		if len(columns) == 0 {
+			bv.Fail(fmt.Errorf("Scan needs at least one column"))
+			return
+		}
+		for _, col_idx := range columns {
+			if col_idx < 0 || col_idx >= len(s.columns) {
+				bv.Fail(fmt.Errorf("Table %s has no column %d", t.Name, col_idx))
+				return
+			}
+		}
+
+		// the column of the condition is read along with the others, and the
+		// blocks it rules out are skipped in all of them
+		read := columns
+		where_idx := -1
+		var spans []column.Span
+		if where != nil {
+			var err error
+			if spans, err = where.prune(s); err != nil {
+				bv.Fail(err)
+				return
+			}
+			read = append(append([]int{}, columns...), where.col_idx)
+			where_idx = len(columns)
+		}
+
+		// stops the readers of the insert stores once the scan is over
+		scan_ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		deletes := s.deletes
+		if !skip_deleted {
+			deletes = &deleteVector{}
+		}
+		cols := make([]*tableview.ColumnView, len(read))
+		for idx, col_idx := range read {
+			if where != nil {
+				cols[idx] = s.columns[col_idx].ScanSpans(scan_ctx, spans)
+			} else {
+				cols[idx] = s.columns[col_idx].Scan(scan_ctx)
+			}
+		}
+		var buffered []*tableview.TableView
+		var open_err error
+		for k, store := range s.stores {
+			view, err := store.Read(scan_ctx, 0, s.lens[k])
+			if err != nil {
+				open_err = err
+				break
+			}
+			buffered = append(buffered, view)
+		}
+
+		if open_err != nil {
+			cancel()
+			for _, col := range cols {
+				for range col.C {
+				}
+			}
+			bv.Fail(open_err)
+			return
+		}
+
+		// on failure, let the remaining column scans run to completion and
+		// prefer their own errors, which are closer to the cause.  A
+		// cancelled scan shows up as misaligned columns, so report that first.
+		fail := func(err error) {
+			for _, col := range cols {
+				for range col.C {
+				}
+			}
+			if ctx_err := ctx.Err(); ctx_err != nil {
+				bv.Fail(ctx_err)
+				return
+			}
+			for _, col := range cols {
+				if col_err := col.Err(); col_err != nil {
+					err = col_err
+					break
+				}
+			}
+			bv.Fail(err)
+		}
+
+		pos := 0       // the position of the next row
+		next_span := 0 // the span holding it, if the scan has a condition
+		for vector0 := range cols[0].C {
+			// vectors do not straddle spans, so once a span is read the next
+			// vector starts the following one
+			if where != nil {
+				for next_span < len(spans) && pos >= spans[next_span].Hi {
+					next_span++
+				}
+				if next_span < len(spans) && pos < spans[next_span].Lo {
+					pos = spans[next_span].Lo
+				}
+			}
+
+			vectors := make([]*tableview.Vector, len(read))
+			vectors[0] = vector0
+			for col_idx := 1; col_idx < len(read); col_idx++ {
+				vector, ok := <-cols[col_idx].C
+				if !ok || vector.Len() != vector0.Len() {
+					fail(fmt.Errorf("Columns %d and %d of table %s are misaligned",
+						read[0], read[col_idx], t.Name))
+					return
+				}
+				vectors[col_idx] = vector
+			}
+
+			batch := &tableview.Batch{Vectors: vectors[:len(columns)]}
+			if where != nil || deletes.anyDeleted(pos, pos+vector0.Len()) {
+				batch.Sel = make([]int, 0, vector0.Len())
+				for k := 0; k < vector0.Len(); k++ {
+					if !deletes.isDeleted(pos+k) && (where == nil || where.matches(vectors[where_idx].Get(k))) {
+						batch.Sel = append(batch.Sel, k)
+					}
+				}
+			}
+			pos += vector0.Len()
+
+			if batch.Len() == 0 {
+				continue
+			}
+			if !bv.Send(ctx, batch) {
+				fail(ctx.Err())
+				return
+			}
+		}
+		for _, col := range cols {
+			if _, ok := <-col.C; ok {
+				fail(fmt.Errorf("Columns of table %s have different lengths", t.Name))
+				return
+			}
+			if err := col.Err(); err != nil {
+				bv.Fail(err)
+				return
+			}
+		}
+
+		// then the segments and the insert store, gathering their rows into
+		// batches.  Returning early cancels their readers.
+		pos = s.columns[read[0]].GetSize()
+		var batch *tableview.Batch
+		for _, view := range buffered {
+			for full_rows := range view.C {
+				for _, full_row := range full_rows {
+					pos++
+					if deletes.isDeleted(pos - 1) {
+						continue
+					}
+					if where != nil && !where.matches(full_row[where.col_idx]) {
+						continue
+					}
+					if batch == nil {
+						batch = t.newBatch(columns)
+					}
+					for col_idx, full_col_idx := range columns {
+						if err := batch.Vectors[col_idx].Append(full_row[full_col_idx]); err != nil {
+							bv.Fail(err)
+							return
+						}
+					}
+					if batch.Len() == settings.BatchSize {
+						if !bv.Send(ctx, batch) {
+							return
+						}
+						batch = nil
+					}
+				}
+			}
+			if err := view.Err(); err != nil {
+				bv.Fail(err)
+				return
+			}
+		}
+		if batch != nil {
+			bv.Send(ctx, batch)
+		}
+	}()
+
+	return bv
+}
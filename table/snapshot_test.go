@@ -0,0 +1,142 @@
+package table
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jinpan/stuffdb/database"
+)
+
+// The runs of the table's first column, and the obsolete segments of the
+// table
+func retirable(t *testing.T, db *database.Database) ([]string, []string) {
+	files, err := ioutil.ReadDir(db.ColumnPath(TEST_TABLE_NAME, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs []string
+	for _, fi := range files {
+		if strings.Contains(fi.Name(), ".") {
+			continue // kept next to a run, such as its zone map
+		}
+		runs = append(runs, filepath.Join(db.ColumnPath(TEST_TABLE_NAME, 0), fi.Name()))
+	}
+
+	files, err = ioutil.ReadDir(db.TablePath(TEST_TABLE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var obsolete []string
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), OBSOLETE_SUFFIX) {
+			obsolete = append(obsolete, fi.Name())
+		}
+	}
+	return runs, obsolete
+}
+
+// Insert rows (i, 2i) for i in [from, to), then merge them into the columns
+// but for the last n_buffered
+func insertMerged(t *testing.T, table *Table, from, to, n_buffered int) {
+	for i := from; i < to; i++ {
+		if err := table.Insert([]interface{}{int64(i), int64(2 * i)}); err != nil {
+			t.Fatal(err)
+		}
+		if i == to-n_buffered-1 {
+			if err := table.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	db := setup(t)
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three runs per column and a few rows in the insert store
+	n_rows := 3*MERGE_SIZE + 10
+	insertMerged(t, table, 0, n_rows, 10)
+	s := table.Snapshot()
+	runs, _ := retirable(t, db)
+
+	// a fourth run compacts the other three, and the insert store becomes a
+	// merged segment
+	insertMerged(t, table, n_rows, n_rows+MERGE_SIZE, 10)
+	if _, err := table.Delete(isEven); err != nil {
+		t.Fatal(err)
+	}
+	if stats := table.CompactionStats(); stats.Runs != 2 {
+		t.Fatalf("Expected a compacted run per column, got %d runs", stats.Runs)
+	}
+
+	// the snapshot reads the retired files
+	tv := s.Scan(context.Background(), 0, 1)
+	row_count := 0
+	for rows := range tv.C {
+		for _, row := range rows {
+			if row[0] != int64(row_count) || row[1] != int64(2*row_count) {
+				t.Fatalf("Unexpected row %v at %d", row, row_count)
+			}
+			row_count++
+		}
+	}
+	if err := tv.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if row_count != n_rows || s.GetLen() != n_rows {
+		t.Errorf("Expected %d rows, got %d (length %d)", n_rows, row_count, s.GetLen())
+	}
+	if datum, err := s.GetDatum(n_rows-1, 1); err != nil || datum != int64(2*(n_rows-1)) {
+		t.Errorf("Expected %d at row %d, got %v (%v)", 2*(n_rows-1), n_rows-1, datum, err)
+	}
+	for _, run := range runs {
+		if _, err := os.Stat(run); err != nil {
+			t.Errorf("Expected run %s to be kept for the snapshot: %v", run, err)
+		}
+	}
+	if _, obsolete := retirable(t, db); len(obsolete) != 1 {
+		t.Errorf("Expected %d obsolete segment, got %v", 1, obsolete)
+	}
+
+	// and releasing it removes them
+	s.Release()
+	s.Release()
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if runs, obsolete := retirable(t, db); len(runs) != 1 || len(obsolete) != 0 {
+		t.Errorf("Expected a single run and no obsolete segment, got %v and %v", runs, obsolete)
+	}
+	checkOddRows(t, table, n_rows+MERGE_SIZE)
+}
+
+func TestLoadRemovesRetiredFiles(t *testing.T) {
+	db := setup(t)
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stop with the files a snapshot pins still in place
+	insertMerged(t, table, 0, 3*MERGE_SIZE+10, 10)
+	table.Snapshot()
+	insertMerged(t, table, 3*MERGE_SIZE+10, 4*MERGE_SIZE+10, 10)
+	if runs, obsolete := retirable(t, db); len(runs) != 4 || len(obsolete) != 1 {
+		t.Fatalf("Expected the retired files to be kept, got %v and %v", runs, obsolete)
+	}
+
+	recovered := mustLoad(t, db, TEST_TABLE_NAME)
+	if runs, obsolete := retirable(t, db); len(runs) != 1 || len(obsolete) != 0 {
+		t.Errorf("Expected a single run and no obsolete segment, got %v and %v", runs, obsolete)
+	}
+	checkRows(t, recovered, 4*MERGE_SIZE+10)
+	checkClean(t, db)
+}
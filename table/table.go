@@ -1,242 +1,624 @@
 package table
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"path"
 	"sync"
 
 	"github.com/jinpan/stuffdb/column"
-	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/database"
 	"github.com/jinpan/stuffdb/schema"
 	"github.com/jinpan/stuffdb/settings"
 	"github.com/jinpan/stuffdb/tableview"
 	"github.com/jinpan/stuffdb/writestore"
 )
 
+const (
+	// the insert store is moved into the columns once it holds this many rows
+	MERGE_SIZE = 1024
+
+	// a bulk load writes the columns in runs of this many rows
+	BULK_RUN_SIZE = 16 * MERGE_SIZE
+)
+
+/*
+A table is safe for concurrent use by any number of goroutines.  Its state is
+guarded by a reader/writer lock: inserts, updates, deletes and the commit of a
+merge or a transaction take it for writing, briefly, while readers only take
+it for reading to pin a snapshot, and scan the snapshot without it.  So
+
+  - every write is atomic: a reader sees all of its rows or none of them,
+  - a scan or a GetDatum reads the table as of a single point in time, and
+    neither blocks nor is blocked by the writes made while it runs,
+  - the rows of an Insert are visible to every read that starts after it
+    returns, and
+  - concurrent writes are serialized in an unspecified order.
+
+Merges, deletes and updates also hold merge_mu for their whole length, as
+they rewrite rows that other writers could move.
+*/
 type Table struct {
 	Name         string         `json:"name"`
 	Schema       *schema.Schema `json:"schema"`
-	N_entries    int            `json:"n_entries"`
+	N_entries    int            `json:"n_entries"` // including deleted rows not yet dropped
+	db           *database.Database
 	columns      []*column.Column
+	segments     []*segment // sealed insert stores, oldest first
 	insert_store *writestore.InsertStore
+	deletes      *deleteVector
+
+	mu        sync.RWMutex // guards the fields above and the metadata file
+	merge_mu  sync.Mutex   // held for the whole of a merge
+	moving    bool         // whether the tuple mover is running
+	mover_err error
+	closed    bool // whether writes are refused
+
+	pin_mu  sync.Mutex  // guards the fields below; taken after mu
+	version int         // bumped whenever a merge retires files
+	pins    map[int]int // the number of snapshots of each version
+	garbage []garbage
+	gc_err  error
 }
 
-func NewTable(name string, schema *schema.Schema) *Table {
+// Create the table's directory and an empty table in it.  Tables are created
+// and opened through the catalog, which keeps a single handle on each: the
+// locks of a handle only guard against the writes made through it.
+func NewTable(db *database.Database, name string, schema *schema.Schema) (*Table, error) {
 	// initialize write store
-	filename := path.Join(
-		"/var",
-		"stuffdb",
-		name,
-	)
-
-	mkdir_err := os.MkdirAll(filename, 0700)
+	mkdir_err := os.MkdirAll(db.TablePath(name), 0700)
 	if mkdir_err != nil {
-		panic(mkdir_err.Error())
+		return nil, mkdir_err
 	}
-	is, is_err := writestore.NewInsertStore(name, schema)
+	is, is_err := writestore.NewInsertStore(db, name, schema)
 	if is_err != nil {
-		panic(is_err.Error())
+		return nil, is_err
 	}
 
 	columns := make([]*column.Column, schema.GetLen())
 	for i := 0; i < schema.GetLen(); i++ {
-		col := column.NewColumn(name, schema, i)
+		col, col_err := column.NewColumn(db, name, schema, i)
+		if col_err != nil {
+			return nil, col_err
+		}
 		columns[i] = col
 	}
 
 	return &Table{
 		Name:         name,
 		Schema:       schema,
+		db:           db,
 		columns:      columns,
 		N_entries:    0,
 		insert_store: is,
-	}
+		deletes:      &deleteVector{},
+	}, nil
 }
 
-func Load(name string) *Table {
-	filename := path.Join(
-		"/var",
-		"stuffdb",
-		name,
-		"metadata",
-	)
+// Open an existing table, recovering from a crash, and start the tuple mover
+// if it has segments to merge.  Like NewTable, only the catalog calls it.
+func Load(db *database.Database, name string) (*Table, error) {
+	t, err := open(db, name)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.wakeMover()
+	t.mu.Unlock()
+	return t, nil
+}
 
-	bytes, err := ioutil.ReadFile(filename)
+// Open an existing table, recovering from a crash, without starting the tuple
+// mover
+func open(db *database.Database, name string) (*Table, error) {
+	bytes, err := ioutil.ReadFile(db.MetadataPath(name))
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 	var t Table
-	json.Unmarshal(bytes, &t)
+	if err := json.Unmarshal(bytes, &t); err != nil {
+		return nil, fmt.Errorf("Unable to read metadata for table %s: %s", name, err.Error())
+	}
+	if t.Schema == nil {
+		return nil, fmt.Errorf("Metadata for table %s has no schema", name)
+	}
+	if err := t.Schema.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid schema for table %s: %s", name, err.Error())
+	}
 
-	t.Schema.Types = make([]datatypes.DatumType, t.Schema.GetLen())
-	for i := 0; i < t.Schema.GetLen(); i++ {
-		t.Schema.Types[i] = datatypes.INT64_TYPE
+	t.Name = name // the table may have been renamed since it was stored
+	t.db = db
+	if err := t.recover(); err != nil {
+		return nil, fmt.Errorf("Unable to recover table %s: %s", name, err.Error())
 	}
 
+	deletes, err := loadDeleteVector(db.DeletesPath(name))
+	if err != nil {
+		return nil, err
+	}
+	t.deletes = deletes
+
 	t.columns = make([]*column.Column, t.Schema.GetLen())
 	for i := 0; i < t.Schema.GetLen(); i++ {
-		t.columns[i] = column.Load(name, t.Schema, i)
+		col, col_err := column.Load(db, name, t.Schema, i)
+		if col_err != nil {
+			return nil, col_err
+		}
+		if i > 0 && col.GetSize() != t.columns[0].GetSize() {
+			return nil, fmt.Errorf("Columns of table %s have different lengths", name)
+		}
+		t.columns[i] = col
 	}
 
-	t.insert_store = writestore.Load(name, t.Schema, t.N_entries%1024)
+	segments, err := loadSegments(&t)
+	if err != nil {
+		return nil, err
+	}
+	t.segments = segments
 
-	return &t
+	// whatever the columns and segments do not hold is in the insert store
+	n_buffered := t.N_entries - t.columns[0].GetSize()
+	for _, seg := range t.segments {
+		n_buffered -= seg.store.GetLen()
+	}
+	if n_buffered < 0 {
+		return nil, fmt.Errorf("Table %s has %d entries but its columns and segments hold more",
+			name, t.N_entries)
+	}
+	t.insert_store = writestore.Load(db, name, t.Schema, n_buffered)
+	return &t, nil
 }
 
-func (t *Table) Store() {
-	filename := path.Join(
-		"/var",
-		"stuffdb",
-		t.Name,
-		"metadata",
-	)
+// Move the table's directory to that of the table name and carry on under
+// the new name.  Scans running at the time fail, as the files they read have
+// moved.
+func (t *Table) Rename(name string) error {
+	t.merge_mu.Lock()
+	defer t.merge_mu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.checkOpen(); err != nil {
+		return err
+	}
 
-	bytes, err := json.Marshal(t)
+	if err := os.Rename(t.db.TablePath(t.Name), t.db.TablePath(name)); err != nil {
+		return err
+	}
+	if err := database.SyncDir(t.db.GetRoot()); err != nil {
+		return err
+	}
+	// every file is now elsewhere, so open them anew
+	moved, err := open(t.db, name)
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+	t.Name = moved.Name
+	t.N_entries = moved.N_entries
+	t.columns = moved.columns
+	t.segments = moved.segments
+	t.insert_store = moved.insert_store
+	t.deletes = moved.deletes
+
+	// opening removed the retired files no snapshot can read any more
+	t.pin_mu.Lock()
+	t.garbage = nil
+	t.pin_mu.Unlock()
+
+	if err := t.store(); err != nil {
+		return err
+	}
+	t.wakeMover()
+	return nil
+}
+
+// Refuse writes from now on, and merge every sealed segment into the columns.
+// The table's files can be removed once Close returns.
+func (t *Table) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	return t.Flush()
+}
+
+// Called with t.mu held
+func (t *Table) checkOpen() error {
+	if t.closed {
+		return fmt.Errorf("Table %s is closed", t.Name)
 	}
-	err = ioutil.WriteFile(filename, bytes, 0600)
+	return nil
+}
+
+// Write the metadata to a temporary file and move it into place, so a crash
+// leaves either the old or the new metadata
+func (t *Table) Store() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.store()
+}
+
+// Called with t.mu held
+func (t *Table) store() error {
+	bytes, err := json.Marshal(t)
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+
+	tmp_filename := t.metadataTmpPath()
+	f, create_err := os.OpenFile(tmp_filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if create_err != nil {
+		return create_err
+	}
+	if _, write_err := f.Write(bytes); write_err != nil {
+		f.Close()
+		return write_err
 	}
+	if sync_err := f.Sync(); sync_err != nil {
+		f.Close()
+		return sync_err
+	}
+	if close_err := f.Close(); close_err != nil {
+		return close_err
+	}
+	if rename_err := os.Rename(tmp_filename, t.db.MetadataPath(t.Name)); rename_err != nil {
+		return rename_err
+	}
+	return database.SyncDir(t.db.TablePath(t.Name))
 }
 
-func (t *Table) Scan(columns ...int) tableview.TableView {
-	ch := make(tableview.TableView, settings.ChanSize)
+func (t *Table) metadataTmpPath() string {
+	return t.db.MetadataPath(t.Name) + ".tmp"
+}
 
-	go func() {
+// Stream the given columns of every row.  Errors, including invalid column
+// indices, are reported through the view's Err.  Cancelling ctx stops the scan
+// and releases its files.
+func (t *Table) Scan(ctx context.Context, columns ...int) *tableview.TableView {
+	return tableview.Rows(ctx, t.ScanBatches(ctx, columns...))
+}
 
-		cols := make([]chan []interface{}, len(columns))
+// Stream the given columns of every row, as batches holding one vector per
+// column.  Errors are reported as for Scan.  The scan reads a snapshot of the
+// table, so it is not affected by the writes made while it runs.
+func (t *Table) ScanBatches(ctx context.Context, columns ...int) *tableview.BatchView {
+	s := t.Snapshot()
+	return s.scanBatches(ctx, true, columns, nil, s.Release)
+}
 
-		for idx, col_idx := range columns {
-			cols[idx] = t.columns[col_idx].Scan()
+// Stream the given columns of the rows whose value in column col_idx lies in
+// r, as ScanBatches does.  The zone maps of the column's runs let the scan
+// skip the blocks holding no such value, so a selective range reads a
+// fraction of the table.  For a single value, such as column.Point(x), the
+// column's Bloom filters also skip the runs that do not hold it.
+func (t *Table) ScanWhere(ctx context.Context, col_idx int, r column.Range, columns ...int) *tableview.BatchView {
+	s := t.Snapshot()
+	return s.scanBatches(ctx, true, columns, &condition{col_idx: col_idx, r: r}, s.Release)
+}
+
+// Stream the given columns of the rows whose value in column col_idx is one
+// of the keys, as ScanBatches does, skipping the runs and blocks that the
+// column's Bloom filters and zone maps rule out
+func (t *Table) ScanKeys(ctx context.Context, col_idx int, keys []interface{}, columns ...int) *tableview.BatchView {
+	key_set := make(map[interface{}]bool, len(keys))
+	for _, key := range keys {
+		if key != nil {
+			key_set[key] = true
 		}
+	}
+	s := t.Snapshot()
+	return s.scanBatches(ctx, true, columns, &condition{col_idx: col_idx, keys: key_set}, s.Release)
+}
 
-		for cols0 := range cols[0] {
-			rows := make(tableview.TableViewRows, len(cols0))
+// Join the rows of build with the rows of the table whose value in column
+// col_idx equals theirs in column build_col, as tableview.EquiJoinBatches
+// does.  The output rows hold the columns of build followed by the given
+// columns of the table, which must include col_idx.  Build is read in full
+// first, and only the parts of the table that may hold its keys are scanned.
+func (t *Table) JoinBatches(
+	ctx context.Context,
+	build *tableview.BatchView,
+	build_col int,
+	col_idx int,
+	columns ...int,
+) *tableview.BatchView {
+	output := tableview.NewBatchView()
 
-			for row_idx, col_val := range cols0 {
-				rows[row_idx] = make(tableview.TableViewRow, len(columns))
-				rows[row_idx][0] = col_val
+	go func() {
+		defer close(output.C)
+
+		var batches []*tableview.Batch
+		var keys []interface{}
+		var build_err error
+		for batch := range build.C {
+			if build_col < 0 || build_col >= len(batch.Vectors) {
+				build_err = fmt.Errorf("Join column %d is not scanned", build_col)
+				continue // let the producer finish
 			}
-
-			for col_idx := 1; col_idx < len(columns); col_idx++ {
-				col := <-cols[col_idx]
-				for row_idx, col_val := range col {
-					rows[row_idx][col_idx] = col_val
-				}
+			batches = append(batches, batch)
+			for k := 0; k < batch.Len(); k++ {
+				keys = append(keys, batch.Vectors[build_col].Get(batch.Index(k)))
 			}
-
-			ch <- rows
+		}
+		if err := build.Err(); err != nil {
+			build_err = err
+		}
+		if build_err != nil {
+			output.Fail(build_err)
+			return
+		}
+		probe_col := -1
+		for idx, c := range columns {
+			if c == col_idx {
+				probe_col = idx
+			}
+		}
+		if probe_col < 0 {
+			output.Fail(fmt.Errorf("Join column %d of table %s is not scanned", col_idx, t.Name))
+			return
 		}
 
-		// consult the insert store
-		insert_view := t.insert_store.ReadAll()
-		for full_rows := range insert_view {
-			rows := make(tableview.TableViewRows, len(full_rows))
-			for row_idx, full_row := range full_rows {
-				rows[row_idx] = make(tableview.TableViewRow, len(columns))
-				for col_idx, full_col_idx := range columns {
-					rows[row_idx][col_idx] = full_row[full_col_idx]
+		// stops the probe once the join is over
+		join_ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		replayed := tableview.NewBatchView()
+		go func() {
+			defer close(replayed.C)
+			for _, batch := range batches {
+				if !replayed.Send(join_ctx, batch) {
+					return
 				}
 			}
-			ch <- rows
+		}()
+		joined := tableview.EquiJoinBatches(join_ctx, replayed, t.ScanKeys(join_ctx, col_idx, keys, columns...), build_col, probe_col)
+		for batch := range joined.C {
+			if !output.Send(ctx, batch) {
+				cancel()
+				for range joined.C {
+				}
+				return
+			}
+		}
+		if err := joined.Err(); err != nil {
+			output.Fail(err)
 		}
-
-		close(ch)
 	}()
 
-	return ch
+	return output
+}
+
+// An empty batch for the given columns
+func (t *Table) newBatch(columns []int) *tableview.Batch {
+	batch := &tableview.Batch{
+		Vectors: make([]*tableview.Vector, len(columns)),
+	}
+	for col_idx, full_col_idx := range columns {
+		batch.Vectors[col_idx] = tableview.NewVector(t.Schema.GetType(full_col_idx), settings.BatchSize)
+	}
+	return batch
 }
 
 func (t *Table) Insert(row []interface{}) error {
-	n_entries, insert_err := t.insert_store.Insert(row)
-	if insert_err != nil {
-		return insert_err
+	return t.insertRows([][]interface{}{row})
+}
+
+// Append rows to the insert store, sealing it for the tuple mover once it
+// holds MERGE_SIZE rows
+func (t *Table) insertRows(rows [][]interface{}) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.appendRows(rows, nil)
+}
+
+// Append rows to the insert store, and replace the delete vector with
+// updated, if given, in the same commit.  Called with t.mu held.
+func (t *Table) appendRows(rows [][]interface{}, updated *deleteVector) error {
+	op := WAL_INSERT
+	if updated != nil {
+		op = WAL_UPDATE
 	}
+	p, err := t.prepareAppend(walRecord{Op: op}, rows, updated)
+	if err != nil {
+		return err
+	}
+	t.N_entries = p.n_entries
+	if err := t.store(); err != nil {
+		t.N_entries -= len(rows)
+		t.abortAppend(p)
+		return err
+	}
+	return t.publishAppend(p)
+}
 
-	if n_entries == 1024 { // move the inserts from the insertstore to columns
-		fmt.Println("MERGING")
+// An append to the insert store that is written but not committed
+type pendingAppend struct {
+	offset     int64 // the size of the insert store before the append
+	n_buffered int
+	n_entries  int
+	updated    *deleteVector
+}
 
-		cache := make([][]interface{}, t.Schema.GetLen())
-		for i := 0; i < t.Schema.GetLen(); i++ {
-			cache[i] = make([]interface{}, 1024)
-		}
-		count := 0
-		for rows := range t.insert_store.ReadAll() {
-			for _, row := range rows {
-				for i := 0; i < t.Schema.GetLen(); i++ {
-					cache[i][count] = row[i]
-				}
-				count++
-			}
+// Log record, completed with the offset and the number of entries, then
+// write rows to the insert store and updated, if given, to the temporary
+// delete vector.  Nothing is committed.  Called with t.mu held.
+func (t *Table) prepareAppend(record walRecord, rows [][]interface{}, updated *deleteVector) (*pendingAppend, error) {
+	if err := t.checkOpen(); err != nil {
+		return nil, err
+	}
+	offset, err := t.insert_store.Size()
+	if err != nil {
+		return nil, err
+	}
+	p := &pendingAppend{
+		offset:     offset,
+		n_buffered: t.insert_store.GetLen(),
+		n_entries:  t.N_entries + len(rows),
+		updated:    updated,
+	}
+	record.Offset, record.N_entries = p.offset, p.n_entries
+	if updated != nil {
+		if err := updated.write(t.deletesTmpPath()); err != nil {
+			return nil, err
 		}
+	}
+	if err := t.logIntent(INSERT_LOG, record); err != nil {
+		return nil, err
+	}
 
-		for i := 0; i < t.Schema.GetLen(); i++ {
-			ch := make(chan interface{}, 1024)
-			go func(ch chan interface{}) {
-				for _, datum := range cache[i] {
-					ch <- datum
-				}
-				close(ch)
-			}(ch)
-			t.columns[i].Insert(ch, 1024)
-		}
+	if _, insert_err := t.insert_store.InsertRows(rows); insert_err != nil {
+		t.abortAppend(p)
+		return nil, insert_err
+	}
+	return p, nil
+}
 
-		t.insert_store.Clear()
+// Undo an append that was not committed.  Called with t.mu held.
+func (t *Table) abortAppend(p *pendingAppend) {
+	if err := t.insert_store.Truncate(p.offset, p.n_buffered); err != nil {
+		return // recovery will truncate it
 	}
+	// a merge may be writing its own vector to the same path
+	if p.updated != nil {
+		os.Remove(t.deletesTmpPath())
+	}
+	t.logDone(INSERT_LOG)
+}
 
-	t.N_entries++
-	t.Store()
+// Make a committed append visible, sealing the insert store for the tuple
+// mover once it holds MERGE_SIZE rows.  Called with t.mu held.
+func (t *Table) publishAppend(p *pendingAppend) error {
+	if p.updated != nil {
+		if err := t.promoteDeletes(); err != nil {
+			return err
+		}
+		t.deletes = p.updated
+	}
+	if err := t.logDone(INSERT_LOG); err != nil {
+		return err
+	}
 
+	if t.insert_store.GetLen() >= MERGE_SIZE {
+		return t.seal()
+	}
 	return nil
 }
 
-func (t *Table) BulkInsert(rows chan []interface{}, size int) {
-	// round off size
-	col_store_size := size / 1024 * 1024
-	// insert_store_size := size % 1024
-
-	chans := make([]chan interface{}, t.Schema.GetLen())
-	for i := 0; i < t.Schema.GetLen(); i++ {
-		chans[i] = make(chan interface{})
+// Load size rows into the table.  rows is drained even if loading fails.
+func (t *Table) BulkInsert(rows chan []interface{}, size int) error {
+	n_loaded, err := t.BulkLoad(rows)
+	if err == nil && n_loaded != size {
+		return fmt.Errorf("Expected %d rows, got %d", size, n_loaded)
 	}
-	go func() {
-		for i := 0; i < col_store_size; i++ {
-			row := <-rows
-			for j := 0; j < t.Schema.GetLen(); j++ {
-				chans[j] <- row[j]
+	return err
+}
+
+// Load every row from rows into the table, returning the number of rows
+// loaded.  rows is drained even if loading fails.
+func (t *Table) BulkLoad(rows <-chan []interface{}) (int, error) {
+	defer func() {
+		for range rows {
+		}
+	}()
+	return t.BulkLoadFrom(func() ([]interface{}, error) {
+		row, ok := <-rows
+		if !ok {
+			return nil, io.EOF
+		}
+		return row, nil
+	})
+}
+
+// Load the rows returned by next into the table, until next returns io.EOF
+// or fails.  Every BULK_RUN_SIZE rows go straight to the columns as one run,
+// after the rows buffered before them; of the rows left at the end, whole
+// multiples of MERGE_SIZE go to the columns too and the rest to the insert
+// store.  Returns the number of rows loaded, which stay loaded if loading
+// fails later on.
+func (t *Table) BulkLoadFrom(next func() ([]interface{}, error)) (int, error) {
+	n_loaded := 0
+	chunk := make([][]interface{}, 0, BULK_RUN_SIZE)
+	for {
+		row, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return n_loaded, err
+		}
+		chunk = append(chunk, row)
+		if len(chunk) == BULK_RUN_SIZE {
+			if err := t.bulkMerge(chunk); err != nil {
+				return n_loaded, err
 			}
+			n_loaded += len(chunk)
+			chunk = chunk[:0]
+		}
+	}
+
+	n_merged := len(chunk) / MERGE_SIZE * MERGE_SIZE
+	if n_merged > 0 {
+		if err := t.bulkMerge(chunk[:n_merged]); err != nil {
+			return n_loaded, err
 		}
-		for i := 0; i < t.Schema.GetLen(); i++ {
-			close(chans[i])
+		n_loaded += n_merged
+	}
+	if n_merged < len(chunk) {
+		if err := t.insertRows(chunk[n_merged:]); err != nil {
+			return n_loaded, err
 		}
-	}()
+	}
+	return n_loaded + len(chunk) - n_merged, nil
+}
 
-	var wg sync.WaitGroup
-	for i := 0; i < t.Schema.GetLen(); i++ {
-		wg.Add(1)
-		go func(i int) {
-			t.columns[i].Insert(chans[i], col_store_size)
-			wg.Done()
-		}(i)
+// Merge every buffered row into the columns, followed by rows
+func (t *Table) bulkMerge(rows [][]interface{}) error {
+	t.merge_mu.Lock()
+	defer t.merge_mu.Unlock()
+
+	t.mu.Lock()
+	err := t.checkOpen()
+	if err == nil && t.insert_store.GetLen() > 0 {
+		err = t.seal()
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return err
 	}
-	wg.Wait()
 
-	for row := range rows {
-		n_entries, insert_err := t.insert_store.Insert(row)
-		if insert_err != nil {
-			panic(insert_err.Error())
+	for {
+		more, err := t.moveSegment()
+		if err != nil {
+			return err
 		}
-		if n_entries > 1024 {
-			panic("Too many entries in the insert store")
+		if !more {
+			break
 		}
 	}
 
-	t.Store()
+	ch := make(chan []interface{})
+	go func() {
+		for _, row := range rows {
+			ch <- row
+		}
+		close(ch)
+	}()
+	defer func() {
+		for range ch {
+		}
+	}()
+	return t.merge(nil, ch, len(rows))
+}
+
+// The write counters of the table's columns, summed
+func (t *Table) CompactionStats() column.Stats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var stats column.Stats
+	for _, col := range t.columns {
+		stats = stats.Add(col.Stats())
+	}
+	return stats
 }
 
 func (t *Table) GetName() string {
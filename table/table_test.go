@@ -1,38 +1,49 @@
 package table
 
 import (
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jinpan/stuffdb/column"
+	"github.com/jinpan/stuffdb/database"
 	"github.com/jinpan/stuffdb/datatypes"
 	"github.com/jinpan/stuffdb/schema"
+	"github.com/jinpan/stuffdb/tableview"
 )
 
 const (
 	TEST_TABLE_NAME = "test_table"
 )
 
-var (
-	TEST_PATH = path.Join(
-		"/var",
-		"stuffdb",
-		TEST_TABLE_NAME,
-	)
-)
-
-func setup(t *testing.T) {
-	mkdir_err := os.MkdirAll(TEST_PATH, 0700)
+// A database in a fresh directory holding an empty table directory
+func setup(t *testing.T) *database.Database {
+	db, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkdir_err := os.MkdirAll(db.TablePath(TEST_TABLE_NAME), 0700)
 	if mkdir_err != nil {
-		t.Error(mkdir_err.Error())
+		t.Fatal(mkdir_err)
 	}
+	return db
 }
 
-func cleanup(t *testing.T) {
-	remove_err := os.RemoveAll(TEST_PATH)
-	if remove_err != nil {
-		t.Errorf(remove_err.Error())
+func mustLoad(t *testing.T, db *database.Database, name string) *Table {
+	table, err := Load(db, name)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return table
 }
 
 func makeSchema(t *testing.T) *schema.Schema {
@@ -52,21 +63,20 @@ func makeSchema(t *testing.T) *schema.Schema {
 		t.Errorf("expected no error here")
 	}
 	if schema.GetRowSizeBytes() != 16 {
-		t.Error("Expected row size to be 16 bytes, got %d", schema.GetRowSizeBytes())
+		t.Errorf("Expected row size to be 16 bytes, got %d", schema.GetRowSizeBytes())
 	}
 	return schema
 }
 
 func TestCreateTable(t *testing.T) {
-	setup(t)
-	defer cleanup(t)
+	db := setup(t)
 
 	table_name := "test_table"
 	s := makeSchema(t)
 
-	table := NewTable(table_name, s)
-	if table == nil {
-		t.Errorf("Unable to create new table")
+	table, err := NewTable(db, table_name, s)
+	if err != nil {
+		t.Fatalf("Unable to create new table: %s", err.Error())
 	}
 
 	n_tests := 5000
@@ -75,13 +85,13 @@ func TestCreateTable(t *testing.T) {
 		row := []interface{}{int64(i), int64(2 * i)}
 		insert_err := table.Insert(row)
 		if insert_err != nil {
-			t.Errorf(insert_err.Error())
+			t.Error(insert_err)
 		}
 
-		tv := table.Scan(0, 1)
+		tv := table.Scan(context.Background(), 0, 1)
 
 		row_count := 0
-		for rows := range tv {
+		for rows := range tv.C {
 			for _, row := range rows {
 				if len(row) != 2 {
 					t.Errorf("Expected data length to be 2, got %d", len(row))
@@ -100,18 +110,20 @@ func TestCreateTable(t *testing.T) {
 			t.Errorf("Expected %d rows, got %d", i+1, row_count)
 		}
 	}
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestLoad(t *testing.T) {
-	setup(t)
-	defer cleanup(t)
+	db := setup(t)
 
 	table_name := "test_table"
 	s := makeSchema(t)
 
-	table := NewTable(table_name, s)
-	if table == nil {
-		t.Errorf("Unable to create new table")
+	table, err := NewTable(db, table_name, s)
+	if err != nil {
+		t.Fatalf("Unable to create new table: %s", err.Error())
 	}
 
 	n_tests := 2000
@@ -120,13 +132,13 @@ func TestLoad(t *testing.T) {
 		row := []interface{}{int64(i), int64(2 * i)}
 		insert_err := table.Insert(row)
 		if insert_err != nil {
-			t.Errorf(insert_err.Error())
+			t.Error(insert_err)
 		}
 
-		tv := table.Scan(0, 1)
+		tv := table.Scan(context.Background(), 0, 1)
 
 		row_count := 0
-		for rows := range tv {
+		for rows := range tv.C {
 			for _, row := range rows {
 				if len(row) != 2 {
 					t.Errorf("Expected data length to be 2, got %d", len(row))
@@ -145,11 +157,15 @@ func TestLoad(t *testing.T) {
 			t.Errorf("Expected %d rows, got %d", i+1, row_count)
 		}
 
-		table2 := Load("test_table")
-		tv = table2.Scan(0, 1)
+		// the tuple mover must be done before the table is opened again
+		if err := table.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		table2 := mustLoad(t, db, "test_table")
+		tv = table2.Scan(context.Background(), 0, 1)
 
 		row_count = 0
-		for rows := range tv {
+		for rows := range tv.C {
 			for _, row := range rows {
 				if len(row) != 2 {
 					t.Errorf("Expected data length to be 2, got %d", len(row))
@@ -170,3 +186,705 @@ func TestLoad(t *testing.T) {
 		}
 	}
 }
+
+func TestMixedTypes(t *testing.T) {
+	db := setup(t)
+
+	s, err := schema.NewSchema(
+		[]string{"a", "b"},
+		[]datatypes.DatumType{datatypes.INT64_TYPE, datatypes.FLOAT64_TYPE},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := NewTable(db, TEST_TABLE_NAME, s)
+	if err != nil {
+		t.Fatalf("Unable to create new table: %s", err.Error())
+	}
+
+	n_rows := 2500
+	rows := make(chan []interface{})
+	go func() {
+		for i := 0; i < n_rows; i++ {
+			rows <- []interface{}{int64(i), float64(i) / 2}
+		}
+		close(rows)
+	}()
+	if err := table.BulkInsert(rows, n_rows); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tbl := range []*Table{table, mustLoad(t, db, TEST_TABLE_NAME)} {
+		row_count := 0
+		scan := tbl.Scan(context.Background(), 0, 1)
+		for rows := range scan.C {
+			for _, row := range rows {
+				if row[0] != int64(row_count) {
+					t.Errorf("Expected data[0] to be %d, got %v", row_count, row[0])
+				}
+				if row[1] != float64(row_count)/2 {
+					t.Errorf("Expected data[1] to be %f, got %v", float64(row_count)/2, row[1])
+				}
+				row_count++
+			}
+		}
+		if row_count != n_rows {
+			t.Errorf("Expected %d rows, got %d", n_rows, row_count)
+		}
+	}
+}
+
+func TestStringColumn(t *testing.T) {
+	db := setup(t)
+
+	s, err := schema.NewSchema(
+		[]string{"st", "name"},
+		[]datatypes.DatumType{datatypes.INT64_TYPE, datatypes.STRING_TYPE},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := NewTable(db, TEST_TABLE_NAME, s)
+	if err != nil {
+		t.Fatalf("Unable to create new table: %s", err.Error())
+	}
+
+	names := []string{"alaska", "", "california", "delaware"}
+	n_rows := 2100
+	rows := make(chan []interface{})
+	go func() {
+		for i := 0; i < n_rows; i++ {
+			rows <- []interface{}{int64(i), names[i%len(names)]}
+		}
+		close(rows)
+	}()
+	if err := table.BulkInsert(rows, n_rows); err != nil {
+		t.Fatal(err)
+	}
+
+	cond := func(x interface{}) bool {
+		return x.(string) == "california"
+	}
+	for _, tbl := range []*Table{table, mustLoad(t, db, TEST_TABLE_NAME)} {
+		row_count := 0
+		filtered := tableview.Filter(context.Background(), tbl.Scan(context.Background(), 0, 1), 1, cond)
+		for rows := range filtered.C {
+			for _, row := range rows {
+				if row[0].(int64)%int64(len(names)) != 2 {
+					t.Errorf("Unexpected row %v", row)
+				}
+				row_count++
+			}
+		}
+		if row_count != n_rows/len(names) {
+			t.Errorf("Expected %d rows, got %d", n_rows/len(names), row_count)
+		}
+	}
+}
+
+func TestNulls(t *testing.T) {
+	db := setup(t)
+
+	s, err := schema.NewNullableSchema(
+		[]string{"a", "b"},
+		[]datatypes.DatumType{datatypes.INT64_TYPE, datatypes.INT64_TYPE},
+		[]bool{false, true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := NewTable(db, TEST_TABLE_NAME, s)
+	if err != nil {
+		t.Fatalf("Unable to create new table: %s", err.Error())
+	}
+
+	// enough rows to move some through the insert store into the columns
+	n_rows := 1500
+	for i := 0; i < n_rows; i++ {
+		row := []interface{}{int64(i), int64(2 * i)}
+		if i%4 == 0 {
+			row[1] = nil
+		}
+		if insert_err := table.Insert(row); insert_err != nil {
+			t.Fatal(insert_err)
+		}
+	}
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tbl := range []*Table{table, mustLoad(t, db, TEST_TABLE_NAME)} {
+		row_count := 0
+		scan := tbl.Scan(context.Background(), 0, 1)
+		for rows := range scan.C {
+			for _, row := range rows {
+				if row_count%4 == 0 && row[1] != nil {
+					t.Errorf("Expected data[1] to be null, got %v", row[1])
+				}
+				if row_count%4 != 0 && row[1] != int64(2*row_count) {
+					t.Errorf("Expected data[1] to be %d, got %v", 2*row_count, row[1])
+				}
+				row_count++
+			}
+		}
+		if row_count != n_rows {
+			t.Errorf("Expected %d rows, got %d", n_rows, row_count)
+		}
+	}
+}
+
+func TestSeparateDatabases(t *testing.T) {
+	db1 := setup(t)
+	db2 := setup(t)
+
+	table1, err := NewTable(db1, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	table2, err := NewTable(db2, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if insert_err := table1.Insert([]interface{}{int64(1), int64(2)}); insert_err != nil {
+		t.Fatal(insert_err)
+	}
+	for i := 0; i < 3; i++ {
+		if insert_err := table2.Insert([]interface{}{int64(i), int64(i)}); insert_err != nil {
+			t.Fatal(insert_err)
+		}
+	}
+
+	if n := mustLoad(t, db1, TEST_TABLE_NAME).N_entries; n != 1 {
+		t.Errorf("Expected %d entries in the first database, got %d", 1, n)
+	}
+	if n := mustLoad(t, db2, TEST_TABLE_NAME).N_entries; n != 3 {
+		t.Errorf("Expected %d entries in the second database, got %d", 3, n)
+	}
+}
+
+func TestScanCorruptColumn(t *testing.T) {
+	db := setup(t)
+
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n_rows := 2048
+	rows := make(chan []interface{})
+	go func() {
+		for i := 0; i < n_rows; i++ {
+			rows <- []interface{}{int64(i), int64(2 * i)}
+		}
+		close(rows)
+	}()
+	if err := table.BulkInsert(rows, n_rows); err != nil {
+		t.Fatal(err)
+	}
+
+	// damage a byte of the second column's data, which is caught as it is
+	// scanned
+	col_file := filepath.Join(db.ColumnPath(TEST_TABLE_NAME, 1), fmt.Sprintf("0_0_%d", n_rows))
+	contents, err := ioutil.ReadFile(col_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents[len(contents)/2] ^= 1
+	if err := ioutil.WriteFile(col_file, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	isCorrupt := func(err error) bool {
+		var corrupt *column.CorruptionError
+		return errors.As(err, &corrupt) && corrupt.Table == TEST_TABLE_NAME && corrupt.Rank == 1 && corrupt.File == col_file
+	}
+
+	table2 := mustLoad(t, db, TEST_TABLE_NAME)
+	tv := table2.Scan(context.Background(), 0, 1)
+	for range tv.C {
+	}
+	if !isCorrupt(tv.Err()) {
+		t.Errorf("Expected an error naming the damaged column, got %v", tv.Err())
+	}
+
+	tv = table2.Scan(context.Background(), 0, 2)
+	for range tv.C {
+	}
+	if tv.Err() == nil {
+		t.Errorf("Expected an error scanning a column that does not exist")
+	}
+
+	// while a truncated file is caught as the table is loaded
+	if err := os.Truncate(col_file, int64(len(contents)/2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(db, TEST_TABLE_NAME); !isCorrupt(err) {
+		t.Errorf("Expected an error naming the truncated column, got %v", err)
+	}
+}
+
+func TestCompressedTable(t *testing.T) {
+	db := setup(t)
+	s, err := makeSchema(t).WithCompression(schema.CODEC_ZLIB, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewTable(db, TEST_TABLE_NAME, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n_rows := 4*MERGE_SIZE + 10
+	rows := make(chan []interface{})
+	go func() {
+		for i := 0; i < n_rows; i++ {
+			rows <- []interface{}{int64(i), int64(i%3) * 1e15}
+		}
+		close(rows)
+	}()
+	if err := table.BulkInsert(rows, n_rows); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := filepath.Glob(filepath.Join(db.ColumnPath(TEST_TABLE_NAME, 1), "*_*_*"))
+	if err != nil || len(runs) == 0 {
+		t.Fatalf("Expected runs, got %v (%v)", runs, err)
+	}
+	for _, run := range runs {
+		if filepath.Ext(run) != "" {
+			continue // a companion of the run
+		}
+		if codec, err := column.FileCodec(run); err != nil || codec != schema.CODEC_ZLIB {
+			t.Errorf("Expected %s to be compressed with %s, got %q (%v)", run, schema.CODEC_ZLIB, codec, err)
+		}
+	}
+
+	tv := mustLoad(t, db, TEST_TABLE_NAME).Scan(context.Background(), 0, 1)
+	row_count := 0
+	for rows := range tv.C {
+		for _, row := range rows {
+			if row[0] != int64(row_count) || row[1] != int64(row_count%3)*1e15 {
+				expected := []interface{}{int64(row_count), int64(row_count%3) * 1e15}
+				t.Fatalf("Expected %v, got %v", expected, row)
+			}
+			row_count++
+		}
+	}
+	if err := tv.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if row_count != n_rows {
+		t.Errorf("Expected %d rows, got %d", n_rows, row_count)
+	}
+}
+
+func TestBulkInsertShort(t *testing.T) {
+	db := setup(t)
+
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := make(chan []interface{})
+	go func() {
+		for i := 0; i < 1500; i++ {
+			rows <- []interface{}{int64(i), int64(i)}
+		}
+		close(rows)
+	}()
+	if err := table.BulkInsert(rows, 2048); err == nil {
+		t.Errorf("Expected an error bulk inserting fewer rows than promised")
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	db := setup(t)
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Insert([]interface{}{int64(0), int64(0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// two full runs, then a remainder split between the columns and the
+	// insert store, after the row already buffered
+	n_rows := 1 + 2*BULK_RUN_SIZE + MERGE_SIZE + 10
+	rows := make(chan []interface{})
+	go func() {
+		for i := 1; i < n_rows; i++ {
+			rows <- []interface{}{int64(i), int64(2 * i)}
+		}
+		close(rows)
+	}()
+	n_loaded, err := table.BulkLoad(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n_loaded != n_rows-1 {
+		t.Errorf("Expected %d rows loaded, got %d", n_rows-1, n_loaded)
+	}
+	if n := table.insert_store.GetLen(); n != 10 {
+		t.Errorf("Expected %d rows in the insert store, got %d", 10, n)
+	}
+	checkRows(t, table, n_rows)
+
+	// a failing source keeps the runs loaded before it failed
+	i := 0
+	n_loaded, err = table.BulkLoadFrom(func() ([]interface{}, error) {
+		if i == BULK_RUN_SIZE+5 {
+			return nil, fmt.Errorf("Source failed")
+		}
+		i++
+		return []interface{}{int64(n_rows + i - 1), int64(2 * (n_rows + i - 1))}, nil
+	})
+	if err == nil || n_loaded != BULK_RUN_SIZE {
+		t.Errorf("Expected %d rows loaded and an error, got %d (%v)", BULK_RUN_SIZE, n_loaded, err)
+	}
+	checkRows(t, table, n_rows+BULK_RUN_SIZE)
+
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, mustLoad(t, db, TEST_TABLE_NAME), n_rows+BULK_RUN_SIZE)
+}
+
+func TestAbandonedScan(t *testing.T) {
+	db := setup(t)
+
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n_rows := 16*1024 + 100
+	rows := make(chan []interface{})
+	go func() {
+		for i := 0; i < n_rows; i++ {
+			rows <- []interface{}{int64(i), int64(2 * i)}
+		}
+		close(rows)
+	}()
+	if err := table.BulkInsert(rows, n_rows); err != nil {
+		t.Fatal(err)
+	}
+
+	n_goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cond := func(x interface{}) bool {
+		return x.(int64)%2 == 0
+	}
+	tv := tableview.Filter(ctx, table.Scan(ctx, 0, 1), 0, cond)
+	if _, ok := <-tv.C; !ok {
+		t.Fatalf("Expected at least one batch: %v", tv.Err())
+	}
+	cancel() // abandon the scan without draining tv
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n_goroutines {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("Expected %d goroutines, have %d:\n%s",
+				n_goroutines, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for range tv.C {
+	}
+	if tv.Err() != context.Canceled {
+		t.Errorf("Expected %v, got %v", context.Canceled, tv.Err())
+	}
+}
+
+func TestScanBatches(t *testing.T) {
+	db := setup(t)
+
+	s, err := schema.NewNullableSchema(
+		[]string{"a", "b", "c"},
+		[]datatypes.DatumType{datatypes.INT64_TYPE, datatypes.FLOAT64_TYPE, datatypes.STRING_TYPE},
+		[]bool{false, true, false},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewTable(db, TEST_TABLE_NAME, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// some rows in the columns, the rest in the insert store
+	n_rows := 1024 + 100
+	rows := make(chan []interface{})
+	go func() {
+		for i := 0; i < n_rows; i++ {
+			row := []interface{}{int64(i), float64(i) / 2, fmt.Sprint(i)}
+			if i%5 == 0 {
+				row[1] = nil
+			}
+			rows <- row
+		}
+		close(rows)
+	}()
+	if err := table.BulkInsert(rows, n_rows); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	bv := table.ScanBatches(ctx, 2, 1)
+	row_count := 0
+	for batch := range bv.C {
+		if batch.Vectors[0].Type != datatypes.STRING_TYPE || batch.Vectors[1].Type != datatypes.FLOAT64_TYPE {
+			t.Fatalf("Unexpected vector types %s, %s", batch.Vectors[0].Type, batch.Vectors[1].Type)
+		}
+		for k := 0; k < batch.Len(); k++ {
+			idx := batch.Index(k)
+			if s := batch.Vectors[0].Strings[idx]; s != fmt.Sprint(row_count) {
+				t.Errorf("Expected %d, got %s", row_count, s)
+			}
+			if batch.Vectors[1].IsNull(idx) != (row_count%5 == 0) {
+				t.Errorf("Row %d has the wrong nullness", row_count)
+			}
+			if !batch.Vectors[1].IsNull(idx) && batch.Vectors[1].Float64s[idx] != float64(row_count)/2 {
+				t.Errorf("Expected %f, got %f", float64(row_count)/2, batch.Vectors[1].Float64s[idx])
+			}
+			row_count++
+		}
+	}
+	if err := bv.Err(); err != nil {
+		t.Error(err)
+	}
+	if row_count != n_rows {
+		t.Errorf("Expected %d rows, got %d", n_rows, row_count)
+	}
+}
+
+func TestScanWhere(t *testing.T) {
+	db := setup(t)
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows in the columns and in the insert store, with the even ones deleted
+	n_rows := 8*MERGE_SIZE + 10
+	rows := make(chan []interface{})
+	go func() {
+		for i := 0; i < n_rows; i++ {
+			rows <- []interface{}{int64(i), int64(2 * i)}
+		}
+		close(rows)
+	}()
+	if err := table.BulkInsert(rows, n_rows); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Delete(isEven); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rows above lo, read from the last block of the columns onwards
+	lo := n_rows - 100
+	r := column.Range{Lo: int64(lo), Lo_open: true}
+	s := table.Snapshot()
+	spans, err := s.columns[0].Prune(r)
+	s.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 1 || spans[0].Hi-spans[0].Lo > column.ZONE_BLOCK_SIZE {
+		t.Errorf("Expected to read a single block, got %v", spans)
+	}
+
+	bv := table.ScanWhere(context.Background(), 0, r, 1)
+	i := lo + 1
+	for batch := range bv.C {
+		for k := 0; k < batch.Len(); k++ {
+			if datum := batch.Vectors[0].Get(batch.Index(k)); datum != int64(2*i) {
+				t.Fatalf("Expected %d, got %v", 2*i, datum)
+			}
+			i += 2
+		}
+	}
+	if err := bv.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != n_rows+1 {
+		t.Errorf("Expected the rows up to %d, got up to %d", n_rows-1, i-2)
+	}
+
+	// a range that no row lies in, and one of the wrong type
+	for _, r := range []column.Range{{Hi: int64(0), Hi_open: true}, {Lo: "a"}} {
+		bv := table.ScanWhere(context.Background(), 0, r, 0, 1)
+		for batch := range bv.C {
+			if batch.Len() != 0 {
+				t.Errorf("Expected no rows in %v, got %v", r, batch.Rows())
+			}
+		}
+		if err := bv.Err(); (err != nil) != (r.Lo == "a") {
+			t.Errorf("Unexpected error for %v: %v", r, err)
+		}
+	}
+}
+
+func TestJoinBatches(t *testing.T) {
+	db := setup(t)
+	s, err := makeSchema(t).WithBloomFilters("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := NewTable(db, TEST_TABLE_NAME, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n_rows := 4*MERGE_SIZE + 10
+	rows := make(chan []interface{})
+	go func() {
+		for i := 0; i < n_rows; i++ {
+			rows <- []interface{}{int64(i), int64(2 * i)}
+		}
+		close(rows)
+	}()
+	if err := table.BulkInsert(rows, n_rows); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys in the columns, in the insert store and in neither
+	keys := []interface{}{int64(5), int64(3000), int64(n_rows - 1), int64(-1), nil}
+	join := func(col_idx int, columns ...int) (tableview.TableViewRows, error) {
+		build := tableview.NewBatchView()
+		go func() {
+			defer close(build.C)
+			batch := &tableview.Batch{Vectors: []*tableview.Vector{tableview.NewVector(datatypes.INT64_TYPE, len(keys))}}
+			for _, key := range keys {
+				batch.Vectors[0].Append(key)
+			}
+			build.Send(context.Background(), batch)
+		}()
+		var joined tableview.TableViewRows
+		bv := table.JoinBatches(context.Background(), build, 0, col_idx, columns...)
+		for batch := range bv.C {
+			joined = append(joined, batch.Rows()...)
+		}
+		return joined, bv.Err()
+	}
+
+	joined, err := join(0, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := tableview.TableViewRows{
+		{int64(5), int64(10), int64(5)},
+		{int64(3000), int64(6000), int64(3000)},
+		{int64(n_rows - 1), int64(2 * (n_rows - 1)), int64(n_rows - 1)},
+	}
+	if !reflect.DeepEqual(joined, expected) {
+		t.Errorf("Expected %v, got %v", expected, joined)
+	}
+	if _, err := join(0, 1); err == nil {
+		t.Errorf("Expected an error joining on a column that is not scanned")
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	db := setup(t)
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writer w inserts rows (a, 2a) for a in [w*WRITER_ROWS, (w+1)*WRITER_ROWS),
+	// one at a time or in bulk, while readers scan and store the table
+	const WRITER_ROWS = 1500
+	n_inserters, n_bulk := 4, 2
+	var writers, readers sync.WaitGroup
+	for w := 0; w < n_inserters+n_bulk; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			if w >= n_inserters {
+				rows := make(chan []interface{})
+				go func() {
+					for a := w * WRITER_ROWS; a < (w+1)*WRITER_ROWS; a++ {
+						rows <- []interface{}{int64(a), int64(2 * a)}
+					}
+					close(rows)
+				}()
+				if err := table.BulkInsert(rows, WRITER_ROWS); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			for a := w * WRITER_ROWS; a < (w+1)*WRITER_ROWS; a++ {
+				if err := table.Insert([]interface{}{int64(a), int64(2 * a)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	// the rows of each writer appear in the order it wrote them
+	checkScan := func() int {
+		last := make(map[int64]int64)
+		row_count := 0
+		tv := table.Scan(context.Background(), 0, 1)
+		for rows := range tv.C {
+			for _, row := range rows {
+				a := row[0].(int64)
+				if row[1] != 2*a {
+					t.Errorf("Unexpected row %v", row)
+				}
+				if prev, ok := last[a/WRITER_ROWS]; ok && prev >= a {
+					t.Errorf("Row %d after row %d", a, prev)
+				}
+				last[a/WRITER_ROWS] = a
+				row_count++
+			}
+		}
+		if err := tv.Err(); err != nil {
+			t.Error(err)
+		}
+		return row_count
+	}
+	done := make(chan struct{})
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			last_count := 0
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				row_count := checkScan()
+				if row_count < last_count {
+					t.Errorf("Scan saw %d rows after an earlier scan saw %d", row_count, last_count)
+				}
+				last_count = row_count
+				if n := table.GetLen(); n < row_count {
+					t.Errorf("Table has %d rows after a scan saw %d", n, row_count)
+				}
+				if err := table.Store(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	if err := table.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	n_rows := (n_inserters + n_bulk) * WRITER_ROWS
+	if row_count := checkScan(); row_count != n_rows || table.GetLen() != n_rows {
+		t.Errorf("Expected %d rows, got %d (length %d)", n_rows, row_count, table.GetLen())
+	}
+	if n := mustLoad(t, db, TEST_TABLE_NAME).GetLen(); n != n_rows {
+		t.Errorf("Expected %d rows once loaded, got %d", n_rows, n)
+	}
+}
@@ -0,0 +1,220 @@
+package table
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinpan/stuffdb/database"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+/*
+A transaction buffers inserts and deletes across the tables of a database and
+applies them all at once on commit.  Its deletes see the rows committed before
+it, not its own inserts.
+
+Commit locks every table it changes, in a fixed order, and appends to each
+table as an insert does, logging a WAL_TXN record that names the transaction.
+Once every append is written, creating the transaction's commit record in the
+database's root is the commit point for all of the tables at once; each table
+then stores its metadata and empties its log, and the commit record is
+removed.  Recovery of a table with a WAL_TXN record finishes the append if the
+commit record exists, and rolls it back otherwise.  A crash after the commit
+point may leave the commit record behind, which is harmless as transaction ids
+are never reused.
+
+The tables stay locked until every change is visible, and Snapshots locks
+them in the same order, so readers see either all or none of a transaction.
+*/
+type Transaction struct {
+	db      *database.Database
+	tables  []*Table // in order of first use
+	inserts map[*Table][][]interface{}
+	deletes map[*Table][]func(row tableview.TableViewRow) bool
+	done    bool
+}
+
+// distinguishes the transactions started in the same nanosecond
+var txn_seq int64
+
+func Begin(db *database.Database) *Transaction {
+	return &Transaction{
+		db:      db,
+		inserts: make(map[*Table][][]interface{}),
+		deletes: make(map[*Table][]func(row tableview.TableViewRow) bool),
+	}
+}
+
+func (tx *Transaction) use(t *Table) error {
+	if tx.done {
+		return fmt.Errorf("Transaction is already committed or rolled back")
+	}
+	if t.db.GetRoot() != tx.db.GetRoot() {
+		return fmt.Errorf("Table %s is not in database %s", t.Name, tx.db.GetRoot())
+	}
+	if _, ok := tx.inserts[t]; ok {
+		return nil
+	}
+	if _, ok := tx.deletes[t]; ok {
+		return nil
+	}
+	tx.tables = append(tx.tables, t)
+	return nil
+}
+
+// Insert row into the table when the transaction commits
+func (tx *Transaction) Insert(t *Table, row []interface{}) error {
+	if err := tx.use(t); err != nil {
+		return err
+	}
+	if len(row) != t.Schema.GetLen() {
+		return fmt.Errorf("Row has %d values, table %s has %d columns", len(row), t.Name, t.Schema.GetLen())
+	}
+	tx.inserts[t] = append(tx.inserts[t], row)
+	return nil
+}
+
+// Delete the rows of the table for which predicate returns true when the
+// transaction commits, as Table.Delete does
+func (tx *Transaction) Delete(t *Table, predicate func(row tableview.TableViewRow) bool) error {
+	if err := tx.use(t); err != nil {
+		return err
+	}
+	tx.deletes[t] = append(tx.deletes[t], predicate)
+	return nil
+}
+
+// Drop every change of the transaction
+func (tx *Transaction) Rollback() {
+	tx.done = true
+	tx.inserts = nil
+	tx.deletes = nil
+}
+
+// Apply every change of the transaction, or none of them if an error occurs
+// before the commit point.  An error after it is left for recovery to finish
+// the commit, as for an insert.
+func (tx *Transaction) Commit() error {
+	if tx.done {
+		return fmt.Errorf("Transaction is already committed or rolled back")
+	}
+	tx.done = true
+	ordered := lockOrder(tx.tables)
+
+	// merges move rows around, so keep them out until the deletes are stored
+	for _, t := range ordered {
+		t.merge_mu.Lock()
+		defer t.merge_mu.Unlock()
+	}
+	updated := make(map[*Table]*deleteVector)
+	for _, t := range ordered {
+		predicates := tx.deletes[t]
+		if len(predicates) == 0 {
+			continue
+		}
+		deletes, positions, _, err := t.findRows(func(row tableview.TableViewRow) bool {
+			for _, predicate := range predicates {
+				if predicate(row) {
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		if len(positions) > 0 {
+			updated[t] = deletes.with(positions)
+		}
+	}
+
+	var changed []*Table
+	for _, t := range ordered {
+		if len(tx.inserts[t]) > 0 || updated[t] != nil {
+			changed = append(changed, t)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	for _, t := range changed {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+	}
+	id := fmt.Sprintf("%d_%d", time.Now().UnixNano(), atomic.AddInt64(&txn_seq, 1))
+	pendings := make([]*pendingAppend, 0, len(changed))
+	abort := func() {
+		for i, p := range pendings {
+			changed[i].abortAppend(p)
+		}
+	}
+	for _, t := range changed {
+		p, err := t.prepareAppend(walRecord{Op: WAL_TXN, Txn: id}, tx.inserts[t], updated[t])
+		if err != nil {
+			abort()
+			return err
+		}
+		pendings = append(pendings, p)
+	}
+
+	if err := tx.writeCommitRecord(id); err != nil {
+		abort()
+		return err
+	}
+	for i, t := range changed {
+		t.N_entries = pendings[i].n_entries
+		if err := t.store(); err != nil {
+			return err
+		}
+		if err := t.publishAppend(pendings[i]); err != nil {
+			return err
+		}
+	}
+	return os.Remove(tx.db.TransactionPath(id))
+}
+
+// Durably create the commit record of transaction id
+func (tx *Transaction) writeCommitRecord(id string) error {
+	f, err := os.OpenFile(tx.db.TransactionPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if sync_err := f.Sync(); sync_err != nil {
+		f.Close()
+		return sync_err
+	}
+	if close_err := f.Close(); close_err != nil {
+		return close_err
+	}
+	return database.SyncDir(tx.db.GetRoot())
+}
+
+// Whether transaction id committed, given that it was started
+func committed(db *database.Database, id string) (bool, error) {
+	_, err := os.Stat(db.TransactionPath(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// The tables without duplicates, in the order in which their locks are taken
+// whenever several are held at once
+func lockOrder(tables []*Table) []*Table {
+	var ordered []*Table
+	seen := make(map[*Table]bool)
+	for _, t := range tables {
+		if !seen[t] {
+			seen[t] = true
+			ordered = append(ordered, t)
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].db.TablePath(ordered[i].Name) < ordered[j].db.TablePath(ordered[j].Name)
+	})
+	return ordered
+}
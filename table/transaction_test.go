@@ -0,0 +1,244 @@
+package table
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/jinpan/stuffdb/database"
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+const (
+	OTHER_TABLE_NAME = "other_table"
+)
+
+// Two empty tables in a fresh database
+func txnSetup(t *testing.T) (*database.Database, *Table, *Table) {
+	db := setup(t)
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTable(db, OTHER_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, table, other
+}
+
+// Insert rows (i, 2i) for i in [from, to) into both tables in one transaction
+func insertBoth(db *database.Database, table, other *Table, from, to int) error {
+	tx := Begin(db)
+	for i := from; i < to; i++ {
+		if err := tx.Insert(table, []interface{}{int64(i), int64(2 * i)}); err != nil {
+			return err
+		}
+		if err := tx.Insert(other, []interface{}{int64(i), int64(2 * i)}); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func TestTransaction(t *testing.T) {
+	db, table, other := txnSetup(t)
+
+	n_rows := MERGE_SIZE + 10
+	if err := insertBoth(db, table, other, 0, n_rows); err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, table, n_rows)
+	checkRows(t, other, n_rows)
+
+	// deletes in one table and inserts in the other
+	tx := Begin(db)
+	if err := tx.Delete(table, isEven); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Insert(other, []interface{}{int64(n_rows), int64(2 * n_rows)}); err != nil {
+		t.Fatal(err)
+	}
+	if table.GetLen() != n_rows || other.GetLen() != n_rows {
+		t.Errorf("Expected no change before the commit")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkOddRows(t, table, n_rows)
+	checkRows(t, other, n_rows+1)
+
+	// a transaction is used once
+	if err := tx.Commit(); err == nil {
+		t.Errorf("Expected an error committing twice")
+	}
+	if err := tx.Insert(table, []interface{}{int64(0), int64(0)}); err == nil {
+		t.Errorf("Expected an error using a committed transaction")
+	}
+
+	// and a rolled back one changes nothing
+	tx = Begin(db)
+	if err := tx.Delete(other, isEven); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if err := tx.Commit(); err == nil {
+		t.Errorf("Expected an error committing a rolled back transaction")
+	}
+	checkRows(t, other, n_rows+1)
+
+	for _, table := range []*Table{table, other} {
+		if err := table.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkOddRows(t, mustLoad(t, db, TEST_TABLE_NAME), n_rows)
+	checkRows(t, mustLoad(t, db, OTHER_TABLE_NAME), n_rows+1)
+	checkClean(t, db)
+}
+
+func TestTransactionRollsBackOnError(t *testing.T) {
+	db, table, other := txnSetup(t)
+	if err := insertBoth(db, table, other, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	// the row for other_table fails once the rows for test_table are written
+	tx := Begin(db)
+	if err := tx.Delete(table, isEven); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Insert(table, []interface{}{int64(10), int64(20)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Insert(other, []interface{}{int64(10), "20"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Fatalf("Expected the commit to fail")
+	}
+
+	checkRows(t, table, 10)
+	checkRows(t, other, 10)
+	checkClean(t, db)
+	if err := insertBoth(db, table, other, 10, 20); err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, mustLoad(t, db, TEST_TABLE_NAME), 20)
+	checkRows(t, mustLoad(t, db, OTHER_TABLE_NAME), 20)
+}
+
+func TestRecoverTransaction(t *testing.T) {
+	for _, commit := range []bool{false, true} {
+		db, table, other := txnSetup(t)
+		if err := insertBoth(db, table, other, 0, 10); err != nil {
+			t.Fatal(err)
+		}
+
+		// crash with the appends to both tables written, and the commit record
+		// written or not
+		id := "crashed"
+		for _, table := range []*Table{table, other} {
+			updated := table.deletes.with([]int{0})
+			if _, err := table.prepareAppend(walRecord{Op: WAL_TXN, Txn: id}, [][]interface{}{{int64(10), int64(20)}}, updated); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if commit {
+			if err := Begin(db).writeCommitRecord(id); err != nil {
+				t.Fatal(err)
+			}
+			// one of the tables stored its metadata before the crash
+			table.N_entries++
+			if err := table.Store(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, name := range []string{TEST_TABLE_NAME, OTHER_TABLE_NAME} {
+			recovered := mustLoad(t, db, name)
+			if !commit {
+				checkRows(t, recovered, 10)
+				continue
+			}
+			// the first row is deleted and the new one is last
+			if recovered.N_entries != 11 || recovered.GetLen() != 10 {
+				t.Errorf("%s: expected the transaction to be finished, got %d rows (%d entries)",
+					name, recovered.GetLen(), recovered.N_entries)
+			}
+			if datum, err := recovered.GetDatum(9, 0); err != nil || datum != int64(10) {
+				t.Errorf("%s: expected the inserted row last, got %v (%v)", name, datum, err)
+			}
+		}
+		checkClean(t, db)
+	}
+}
+
+func TestTransactionIsAtomicForReaders(t *testing.T) {
+	db, table, other := txnSetup(t)
+
+	// every transaction inserts into both tables, every tenth also deletes
+	// from both, and readers taking snapshots of both always see the same rows
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			snapshots := Snapshots(table, other)
+			counts := make([]int, len(snapshots))
+			for i, s := range snapshots {
+				tv := s.Scan(context.Background(), 0)
+				for rows := range tv.C {
+					counts[i] += len(rows)
+				}
+				if err := tv.Err(); err != nil {
+					t.Error(err)
+				}
+				s.Release()
+			}
+			if counts[0] != counts[1] {
+				t.Errorf("Snapshots saw %d and %d rows", counts[0], counts[1])
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		tx := Begin(db)
+		for _, table := range []*Table{table, other} {
+			if err := tx.Insert(table, []interface{}{int64(i), int64(2 * i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i%10 == 9 {
+			n := int64(i)
+			for _, table := range []*Table{other, table} {
+				if err := tx.Delete(table, func(row tableview.TableViewRow) bool {
+					return row[0].(int64) == n-5
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if table.GetLen() != 180 || other.GetLen() != 180 {
+		t.Errorf("Expected %d rows in both tables, got %d and %d", 180, table.GetLen(), other.GetLen())
+	}
+	for _, table := range []*Table{table, other} {
+		if err := table.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package table
+
+import (
+	"fmt"
+
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+// Set the columns in assignments, which maps column indices to new values, in
+// every row for which predicate returns true, given the values of all of the
+// row's columns.  Returns the number of rows updated.
+//
+// An update deletes the rows and inserts their new versions in one commit, so
+// updated rows move to the end of the scan order, and compaction drops the
+// old versions like any deleted rows.
+func (t *Table) Update(predicate func(row tableview.TableViewRow) bool, assignments map[int]interface{}) (int, error) {
+	for col_idx := range assignments {
+		if col_idx < 0 || col_idx >= t.Schema.GetLen() {
+			return 0, fmt.Errorf("Table %s has no column %d", t.Name, col_idx)
+		}
+	}
+
+	// merges move rows around, so keep them out until the update is stored
+	t.merge_mu.Lock()
+	defer t.merge_mu.Unlock()
+
+	deletes, positions, rows, err := t.findRows(predicate)
+	if err != nil || len(positions) == 0 {
+		return 0, err
+	}
+	updated_rows := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		for col_idx, value := range assignments {
+			row[col_idx] = value
+		}
+		updated_rows[i] = row
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.appendRows(updated_rows, deletes.with(positions)); err != nil {
+		return 0, err
+	}
+	return len(rows), nil
+}
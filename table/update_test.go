@@ -0,0 +1,103 @@
+package table
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jinpan/stuffdb/tableview"
+)
+
+func TestUpdate(t *testing.T) {
+	db, table := walSetup(t, 2*MERGE_SIZE+100)
+
+	// rows in the columns and in the insert store
+	n, err := table.Update(func(row tableview.TableViewRow) bool {
+		return row[0].(int64)%100 == 0
+	}, map[int]interface{}{1: int64(-1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 22 {
+		t.Errorf("Expected %d rows updated, got %d", 22, n)
+	}
+
+	check := func(table *Table) {
+		tv := table.Scan(context.Background(), 0, 1)
+		var rows tableview.TableViewRows
+		for chunk := range tv.C {
+			rows = append(rows, chunk...)
+		}
+		if err := tv.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 2*MERGE_SIZE+100 || table.GetLen() != len(rows) {
+			t.Fatalf("Expected %d rows, got %d (length %d)", 2*MERGE_SIZE+100, len(rows), table.GetLen())
+		}
+
+		// the updated rows come last
+		for k, row := range rows {
+			i := row[0].(int64)
+			if k < len(rows)-22 && (i%100 == 0 || row[1] != 2*i) {
+				t.Errorf("Unexpected row %v at %d", row, k)
+			}
+			if k >= len(rows)-22 && (i%100 != 0 || row[1] != int64(-1)) {
+				t.Errorf("Unexpected updated row %v at %d", row, k)
+			}
+		}
+	}
+	check(table)
+	check(mustLoad(t, db, TEST_TABLE_NAME))
+
+	if _, err := table.Update(func(row tableview.TableViewRow) bool {
+		return true
+	}, map[int]interface{}{1: "two"}); err == nil {
+		t.Errorf("Expected an error setting an int64 column to a string")
+	}
+	if _, err := table.Update(func(row tableview.TableViewRow) bool {
+		return true
+	}, map[int]interface{}{2: int64(0)}); err == nil {
+		t.Errorf("Expected an error setting a column that does not exist")
+	}
+	check(mustLoad(t, db, TEST_TABLE_NAME))
+}
+
+func TestRecoverUpdate(t *testing.T) {
+	for _, committed := range []bool{false, true} {
+		db, table := walSetup(t, 10)
+
+		// crash in the middle of updating row 3
+		offset, err := table.insert_store.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := table.deletes.with([]int{3}).write(table.deletesTmpPath()); err != nil {
+			t.Fatal(err)
+		}
+		record := walRecord{Op: WAL_UPDATE, Offset: offset, N_entries: 11}
+		if err := table.logIntent(INSERT_LOG, record); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := table.insert_store.Insert([]interface{}{int64(3), int64(-1)}); err != nil {
+			t.Fatal(err)
+		}
+		if committed {
+			table.N_entries++
+			if err := table.Store(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		recovered := mustLoad(t, db, TEST_TABLE_NAME)
+		checkClean(t, db)
+		if n := recovered.GetLen(); n != 10 {
+			t.Errorf("Expected %d rows, got %d", 10, n)
+		}
+		datum, err := recovered.GetDatum(9, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if committed && datum != int64(-1) || !committed && datum != int64(18) {
+			t.Errorf("Unexpected last row value %v (committed: %t)", datum, committed)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package table
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jinpan/stuffdb/column"
+	"github.com/jinpan/stuffdb/database"
+)
+
+/*
+Every operation that changes more than one file of a table first records its
+intent in a write-ahead log, one JSON record per line, and the log is emptied
+once the operation is done.  After a crash, recover reads the records of the
+interrupted operations and either rolls them back or finishes them.  Inserts
+and merges run concurrently, so each has its own log.
+
+An insert appends rows to the insert store and then stores the metadata,
+which is the commit point: the insert record holds the size of the insert
+store before the append and the number of entries once committed, so
+recovery truncates the insert store unless the metadata already counts the
+new rows.  An update is an insert that also deletes the rows it replaces: it
+writes the new delete vector to a temporary file before its record, and
+recovery moves it into place if the insert committed.  The appends of a
+transaction are logged as WAL_TXN records naming the transaction, and commit
+when its commit record is created, whatever the metadata says.
+
+A merge appends to every column through column.Pending.  WAL_MERGE marks its
+start, WAL_MERGE_COMMIT its commit point once every new run is written, and
+WAL_MERGE_DELETED that the runs they replace are gone and only renames remain.  The
+commit record holds the number of entries after the merge, and the sealed
+segment whose rows the merge moved into the columns, if any.  A merge that
+moves rows writes the shifted delete vector to a temporary file before its
+commit point, and recovery moves it into place along with the new runs.
+*/
+const (
+	INSERT_LOG = "insert"
+	MERGE_LOG  = "merge"
+
+	WAL_INSERT        = "insert"
+	WAL_UPDATE        = "update"
+	WAL_TXN           = "txn"
+	WAL_MERGE         = "merge"
+	WAL_MERGE_COMMIT  = "merge_commit"
+	WAL_MERGE_DELETED = "merge_deleted"
+)
+
+type walRecord struct {
+	Op        string `json:"op"`
+	Offset    int64  `json:"offset,omitempty"`
+	N_entries int    `json:"n_entries"`
+	Segment   string `json:"segment,omitempty"`
+	Txn       string `json:"txn,omitempty"`
+}
+
+// Durably append a record to one of the table's logs
+func (t *Table) logIntent(log string, record walRecord) error {
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, open_err := os.OpenFile(t.db.WALPath(t.Name, log), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if open_err != nil {
+		return open_err
+	}
+	if _, write_err := f.Write(append(bytes, '\n')); write_err != nil {
+		f.Close()
+		return write_err
+	}
+	if sync_err := f.Sync(); sync_err != nil {
+		f.Close()
+		return sync_err
+	}
+	return f.Close()
+}
+
+// Empty a log once the operation it describes is complete
+func (t *Table) logDone(log string) error {
+	err := os.Truncate(t.db.WALPath(t.Name, log), 0)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// The records of one of the table's logs.  A torn final record, from a crash
+// while it was being written, is ignored as its operation never started.
+func readWAL(db *database.Database, name string, log string) ([]walRecord, error) {
+	data, err := ioutil.ReadFile(db.WALPath(name, log))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.Split(data, []byte{'\n'})
+	lines = lines[:len(lines)-1] // either empty or torn
+	records := make([]walRecord, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal(line, &records[i]); err != nil {
+			return nil, fmt.Errorf("Corrupt %s log for table %s: %s", log, name, err.Error())
+		}
+	}
+	return records, nil
+}
+
+// The last record of one of the table's logs, which describes the operation
+// that was in progress
+func (t *Table) lastIntent(log string) (walRecord, error) {
+	records, err := readWAL(t.db, t.Name, log)
+	if err != nil || len(records) == 0 {
+		return walRecord{}, err
+	}
+	return records[len(records)-1], nil
+}
+
+// Bring the table's files back to a consistent state after a crash, finishing
+// or rolling back the operations recorded in its logs.  t holds the metadata
+// as read from disk; its columns and insert stores are not loaded yet.
+func (t *Table) recover() error {
+	os.Remove(t.metadataTmpPath())
+	if err := t.removeObsolete(); err != nil {
+		return err
+	}
+
+	merged, err := t.recoverMerge()
+	if err != nil {
+		return err
+	}
+	updated, err := t.recoverInsert()
+	if err != nil {
+		return err
+	}
+	// a delete vector left over by an operation that did not commit
+	if !merged && !updated {
+		os.Remove(t.deletesTmpPath())
+	}
+
+	// a crash right after sealing the insert store leaves no insert store
+	active := t.db.InsertBufferPath(t.Name)
+	if _, err := os.Stat(active); os.IsNotExist(err) {
+		f, create_err := os.OpenFile(active, os.O_CREATE|os.O_EXCL, 0700)
+		if create_err != nil {
+			return create_err
+		}
+		return f.Close()
+	}
+	return nil
+}
+
+// Finish or roll back the merge in the merge log, reporting whether it was
+// committed
+func (t *Table) recoverMerge() (bool, error) {
+	last, err := t.lastIntent(MERGE_LOG)
+	if err != nil {
+		return false, err
+	}
+	merged := false
+	switch last.Op {
+	case WAL_MERGE_COMMIT:
+		for i := 0; i < t.Schema.GetLen(); i++ {
+			if err := column.DeleteReplaced(t.db, t.Name, i); err != nil {
+				return false, err
+			}
+		}
+		fallthrough
+	case WAL_MERGE_DELETED:
+		merged = true
+		for i := 0; i < t.Schema.GetLen(); i++ {
+			if err := column.PromotePending(t.db, t.Name, i); err != nil {
+				return false, err
+			}
+		}
+		if last.Segment != "" {
+			err := os.Remove(filepath.Join(t.db.TablePath(t.Name), last.Segment))
+			if err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+		}
+		// the rows dropped by the merge shift the deletes after them
+		if err := t.recoverDeletes(); err != nil {
+			return false, err
+		}
+		t.N_entries = last.N_entries
+		if err := t.store(); err != nil {
+			return false, err
+		}
+	case WAL_MERGE, "":
+		// nothing was committed; only stray new runs can be left over
+	default:
+		return false, fmt.Errorf("Unknown operation %q in the merge log of table %s", last.Op, t.Name)
+	}
+
+	for i := 0; i < t.Schema.GetLen(); i++ {
+		if err := column.DiscardPending(t.db, t.Name, i); err != nil {
+			return false, err
+		}
+	}
+	return merged, t.logDone(MERGE_LOG)
+}
+
+// Move the delete vector of a committed operation into place, unless that
+// was done already
+func (t *Table) recoverDeletes() error {
+	if _, err := os.Stat(t.deletesTmpPath()); os.IsNotExist(err) {
+		return nil
+	}
+	return t.promoteDeletes()
+}
+
+// Finish or roll back the append in the insert log, reporting whether it
+// committed a delete vector
+func (t *Table) recoverInsert() (bool, error) {
+	last, err := t.lastIntent(INSERT_LOG)
+	if err != nil {
+		return false, err
+	}
+	updated := false
+	switch last.Op {
+	case WAL_INSERT, WAL_UPDATE:
+		if t.N_entries != last.N_entries { // never committed
+			if err := os.Truncate(t.db.InsertBufferPath(t.Name), last.Offset); err != nil {
+				return false, err
+			}
+		} else if last.Op == WAL_UPDATE {
+			updated = true
+			if err := t.recoverDeletes(); err != nil {
+				return false, err
+			}
+		}
+	case WAL_TXN:
+		ok, err := committed(t.db, last.Txn)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			if err := os.Truncate(t.db.InsertBufferPath(t.Name), last.Offset); err != nil {
+				return false, err
+			}
+			break
+		}
+		updated = true
+		if t.N_entries != last.N_entries {
+			t.N_entries = last.N_entries
+			if err := t.store(); err != nil {
+				return false, err
+			}
+		}
+		if err := t.recoverDeletes(); err != nil {
+			return false, err
+		}
+	case "":
+	default:
+		return false, fmt.Errorf("Unknown operation %q in the insert log of table %s", last.Op, t.Name)
+	}
+	return updated, t.logDone(INSERT_LOG)
+}
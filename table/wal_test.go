@@ -0,0 +1,270 @@
+package table
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jinpan/stuffdb/column"
+	"github.com/jinpan/stuffdb/database"
+)
+
+// A stored table holding rows (i, 2i) for i < n_rows
+func walSetup(t *testing.T, n_rows int) (*database.Database, *Table) {
+	db := setup(t)
+
+	table, err := NewTable(db, TEST_TABLE_NAME, makeSchema(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := make(chan []interface{})
+	go func() {
+		for i := 0; i < n_rows; i++ {
+			rows <- []interface{}{int64(i), int64(2 * i)}
+		}
+		close(rows)
+	}()
+	if err := table.BulkInsert(rows, n_rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Store(); err != nil {
+		t.Fatal(err)
+	}
+	return db, table
+}
+
+// Check that the table holds rows (i, 2i) for i < n_rows, and nothing else
+func checkRows(t *testing.T, table *Table, n_rows int) {
+	tv := table.Scan(context.Background(), 0, 1)
+	row_count := 0
+	for rows := range tv.C {
+		for _, row := range rows {
+			if row[0] != int64(row_count) || row[1] != int64(2*row_count) {
+				t.Errorf("Unexpected row %v at %d", row, row_count)
+			}
+			row_count++
+		}
+	}
+	if err := tv.Err(); err != nil {
+		t.Error(err)
+	}
+	if row_count != n_rows || table.N_entries != n_rows {
+		t.Errorf("Expected %d rows, got %d (%d entries)", n_rows, row_count, table.N_entries)
+	}
+}
+
+// Check that no temporary file or log record was left behind
+func checkClean(t *testing.T, db *database.Database) {
+	filepath.Walk(db.TablePath(TEST_TABLE_NAME), func(path string, fi os.FileInfo, err error) error {
+		if strings.Contains(fi.Name(), column.TMP_SUFFIX) || strings.HasSuffix(fi.Name(), ".tmp") {
+			t.Errorf("Stray file %s", path)
+		}
+		return nil
+	})
+	for _, log := range []string{INSERT_LOG, MERGE_LOG} {
+		if records, err := readWAL(db, TEST_TABLE_NAME, log); err != nil || len(records) != 0 {
+			t.Errorf("Expected an empty %s log, got %v (%v)", log, records, err)
+		}
+	}
+}
+
+func TestRecoverUncommittedInsert(t *testing.T) {
+	db, table := walSetup(t, 1030)
+
+	// crash after appending a row but before storing the metadata
+	offset, err := table.insert_store.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.logIntent(INSERT_LOG, walRecord{Op: WAL_INSERT, Offset: offset, N_entries: 1031}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.insert_store.Insert([]interface{}{int64(-1), int64(-1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := mustLoad(t, db, TEST_TABLE_NAME)
+	checkClean(t, db)
+	checkRows(t, recovered, 1030)
+
+	// the insert store is usable afterwards
+	if err := recovered.Insert([]interface{}{int64(1030), int64(2060)}); err != nil {
+		t.Fatal(err)
+	}
+	checkRows(t, mustLoad(t, db, TEST_TABLE_NAME), 1031)
+}
+
+func TestRecoverCommittedInsert(t *testing.T) {
+	db, table := walSetup(t, 10)
+
+	// crash after storing the metadata but before emptying the log
+	offset, err := table.insert_store.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.logIntent(INSERT_LOG, walRecord{Op: WAL_INSERT, Offset: offset, N_entries: 11}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.insert_store.Insert([]interface{}{int64(10), int64(20)}); err != nil {
+		t.Fatal(err)
+	}
+	table.N_entries++
+	if err := table.Store(); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := mustLoad(t, db, TEST_TABLE_NAME)
+	checkClean(t, db)
+	checkRows(t, recovered, 11)
+}
+
+// Seal the table's insert store and run a merge of the segment, dropping the
+// deleted rows, stopping as if the process had crashed once the merge log
+// reaches stage.  In the middle of a step, only the first column has been
+// processed.
+func crashMerge(t *testing.T, table *Table, stage string) {
+	// never released, which keeps the tuple mover out of the way
+	table.merge_mu.Lock()
+	table.mu.Lock()
+	if err := table.seal(); err != nil {
+		t.Fatal(err)
+	}
+	table.mu.Unlock()
+	seg := table.segments[0]
+
+	if err := table.logIntent(MERGE_LOG, walRecord{Op: WAL_MERGE}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buffered [][]interface{}
+	seg_view, err := seg.store.ReadAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows := range seg_view.C {
+		for _, row := range rows {
+			buffered = append(buffered, row)
+		}
+	}
+
+	n_old := table.columns[0].GetSize() + len(buffered)
+	pendings := make([]*column.Pending, len(table.columns))
+	for i, col := range table.columns {
+		ch := make(chan interface{})
+		go func(i int) {
+			for _, row := range buffered {
+				ch <- row[i]
+			}
+			close(ch)
+		}(i)
+		if pendings[i], err = col.Prepare(ch, len(buffered), table.deletes.isDeleted); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start, n_dropped := pendings[0].Start(), pendings[0].Dropped()
+	if table.deletes.n_deleted > 0 {
+		updated := table.deletes.splice(start, n_old, n_old-start-n_dropped)
+		if err := updated.write(table.deletesTmpPath()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stage == WAL_MERGE {
+		return
+	}
+
+	commit := walRecord{Op: WAL_MERGE_COMMIT, N_entries: table.N_entries - n_dropped, Segment: seg.name}
+	if err := table.logIntent(MERGE_LOG, commit); err != nil {
+		t.Fatal(err)
+	}
+	pendings[0].Retire()
+	if err := pendings[0].DeleteRetired(); err != nil {
+		t.Fatal(err)
+	}
+	if stage == WAL_MERGE_COMMIT {
+		return
+	}
+
+	for _, pending := range pendings[1:] {
+		pending.Retire()
+	}
+	commit.Op = WAL_MERGE_DELETED
+	if err := table.logIntent(MERGE_LOG, commit); err != nil {
+		t.Fatal(err)
+	}
+	if err := pendings[0].Promote(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverMerge(t *testing.T) {
+	for _, stage := range []string{WAL_MERGE, WAL_MERGE_COMMIT, WAL_MERGE_DELETED} {
+		db, table := walSetup(t, 2048+700)
+		crashMerge(t, table, stage)
+
+		recovered := mustLoad(t, db, TEST_TABLE_NAME)
+		checkRows(t, recovered, 2048+700)
+
+		// an uncommitted merge leaves the segment for the tuple mover
+		if err := recovered.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		checkClean(t, db)
+		if n := recovered.columns[0].GetSize(); n != 2048+700 {
+			t.Errorf("%s: expected %d rows in the columns, got %d", stage, 2048+700, n)
+		}
+		if len(recovered.segments) != 0 || recovered.insert_store.GetLen() != 0 {
+			t.Errorf("%s: expected no buffered rows", stage)
+		}
+
+		// the table is usable afterwards
+		for i := 2048 + 700; i < 4096+10; i++ {
+			if err := recovered.Insert([]interface{}{int64(i), int64(2 * i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := recovered.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		checkRows(t, mustLoad(t, db, TEST_TABLE_NAME), 4096+10)
+	}
+}
+
+func TestRecoverMergeDroppingDeletes(t *testing.T) {
+	for _, stage := range []string{WAL_MERGE, WAL_MERGE_COMMIT, WAL_MERGE_DELETED} {
+		db, table := walSetup(t, 2048+700)
+		if _, err := table.Delete(isEven); err != nil {
+			t.Fatal(err)
+		}
+		crashMerge(t, table, stage)
+
+		// the delete vector matches the runs, whether or not the merge
+		// dropped the rows
+		recovered := mustLoad(t, db, TEST_TABLE_NAME)
+		checkOddRows(t, recovered, 2048+700)
+		if err := recovered.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		checkClean(t, db)
+		checkOddRows(t, mustLoad(t, db, TEST_TABLE_NAME), 2048+700)
+	}
+}
+
+func TestRecoverTornLog(t *testing.T) {
+	db, _ := walSetup(t, 10)
+
+	// a stray run and half a record, as if the process died writing them
+	stray := filepath.Join(db.ColumnPath(TEST_TABLE_NAME, 1), "16"+column.TMP_SUFFIX)
+	if err := ioutil.WriteFile(stray, make([]byte, 16*8), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(db.WALPath(TEST_TABLE_NAME, MERGE_LOG), []byte(`{"op":"mer`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := mustLoad(t, db, TEST_TABLE_NAME)
+	checkClean(t, db)
+	checkRows(t, recovered, 10)
+}
@@ -0,0 +1,472 @@
+package tableview
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jinpan/stuffdb/datatypes"
+	"github.com/jinpan/stuffdb/settings"
+)
+
+/*
+A run of values of a single column, stored unboxed.  Only the slice matching
+Type is used.  Nulls is nil when no value is null; otherwise Nulls[k] is set
+when value k is null, and the slice holds a zero value in its place.
+
+An int64 vector read from a dictionary encoded column may instead hold its
+values as Codes into Dict, value k being Dict[Codes[k]], with Int64s nil.  The
+vectors read from one run share its Dict, which is sorted, so operators can
+evaluate a predicate once per dictionary entry and then work on the codes.
+*/
+type Vector struct {
+	Type     datatypes.DatumType
+	Int64s   []int64
+	Float64s []float64
+	Strings  []string
+	Nulls    []bool
+
+	Dict  []int64
+	Codes []uint8
+}
+
+func NewVector(data_type datatypes.DatumType, capacity int) *Vector {
+	v := &Vector{Type: data_type}
+	switch data_type {
+	case datatypes.INT64_TYPE:
+		v.Int64s = make([]int64, 0, capacity)
+	case datatypes.FLOAT64_TYPE:
+		v.Float64s = make([]float64, 0, capacity)
+	case datatypes.STRING_TYPE:
+		v.Strings = make([]string, 0, capacity)
+	}
+	return v
+}
+
+func (v *Vector) Len() int {
+	switch v.Type {
+	case datatypes.INT64_TYPE:
+		if v.Codes != nil {
+			return len(v.Codes)
+		}
+		return len(v.Int64s)
+	case datatypes.FLOAT64_TYPE:
+		return len(v.Float64s)
+	case datatypes.STRING_TYPE:
+		return len(v.Strings)
+	default:
+		return 0
+	}
+}
+
+func (v *Vector) IsNull(k int) bool {
+	return v.Nulls != nil && v.Nulls[k]
+}
+
+// The k'th value boxed, or nil if it is null
+func (v *Vector) Get(k int) interface{} {
+	if v.IsNull(k) {
+		return nil
+	}
+	switch v.Type {
+	case datatypes.INT64_TYPE:
+		return v.Int64(k)
+	case datatypes.FLOAT64_TYPE:
+		return v.Float64s[k]
+	case datatypes.STRING_TYPE:
+		return v.Strings[k]
+	default:
+		return nil
+	}
+}
+
+// The k'th value of an int64 vector, which is 0 if it is null
+func (v *Vector) Int64(k int) int64 {
+	if v.Codes != nil {
+		if v.IsNull(k) {
+			return 0
+		}
+		return v.Dict[v.Codes[k]]
+	}
+	return v.Int64s[k]
+}
+
+// Whether the int64 vector is dictionary encoded
+func (v *Vector) IsEncoded() bool {
+	return v.Codes != nil
+}
+
+// Replace the codes of a dictionary encoded vector by the values they stand for
+func (v *Vector) Decode() {
+	if v.Codes == nil {
+		return
+	}
+	v.Int64s = make([]int64, len(v.Codes))
+	for k := range v.Codes {
+		v.Int64s[k] = v.Int64(k)
+	}
+	v.Dict, v.Codes = nil, nil
+}
+
+// Append a boxed value, which must be nil or of the vector's type
+func (v *Vector) Append(datum interface{}) error {
+	v.Decode()
+	n := v.Len()
+	if datum == nil {
+		if v.Nulls == nil {
+			v.Nulls = make([]bool, n)
+		}
+		v.Nulls = append(v.Nulls, true)
+	} else if v.Nulls != nil {
+		v.Nulls = append(v.Nulls, false)
+	}
+
+	ok := true
+	switch v.Type {
+	case datatypes.INT64_TYPE:
+		var value int64
+		if datum != nil {
+			value, ok = datum.(int64)
+		}
+		v.Int64s = append(v.Int64s, value)
+	case datatypes.FLOAT64_TYPE:
+		var value float64
+		if datum != nil {
+			value, ok = datum.(float64)
+		}
+		v.Float64s = append(v.Float64s, value)
+	case datatypes.STRING_TYPE:
+		var value string
+		if datum != nil {
+			value, ok = datum.(string)
+		}
+		v.Strings = append(v.Strings, value)
+	default:
+		return fmt.Errorf("Invalid data type %s", v.Type)
+	}
+	if !ok {
+		v.truncate(n)
+		return fmt.Errorf("Vector holds %s, got %T", v.Type, datum)
+	}
+	return nil
+}
+
+// Append the k'th value of o, which must have the same type, without boxing it
+func (v *Vector) AppendFrom(o *Vector, k int) {
+	v.Decode()
+	if o.IsNull(k) || v.Nulls != nil {
+		if v.Nulls == nil {
+			v.Nulls = make([]bool, v.Len())
+		}
+		v.Nulls = append(v.Nulls, o.IsNull(k))
+	}
+	switch v.Type {
+	case datatypes.INT64_TYPE:
+		v.Int64s = append(v.Int64s, o.Int64(k))
+	case datatypes.FLOAT64_TYPE:
+		v.Float64s = append(v.Float64s, o.Float64s[k])
+	case datatypes.STRING_TYPE:
+		v.Strings = append(v.Strings, o.Strings[k])
+	}
+}
+
+func (v *Vector) truncate(n int) {
+	if v.Nulls != nil {
+		v.Nulls = v.Nulls[:n]
+	}
+	switch v.Type {
+	case datatypes.INT64_TYPE:
+		v.Int64s = v.Int64s[:n]
+	case datatypes.FLOAT64_TYPE:
+		v.Float64s = v.Float64s[:n]
+	case datatypes.STRING_TYPE:
+		v.Strings = v.Strings[:n]
+	}
+}
+
+/*
+A batch of rows stored column by column.  Every vector has the same length.
+Sel lists, in increasing order, the positions in the vectors of the rows that
+belong to the batch, so that filters can drop rows without copying any data.
+A nil Sel selects every position.
+*/
+type Batch struct {
+	Vectors []*Vector
+	Sel     []int
+}
+
+// The number of rows in the batch
+func (b *Batch) Len() int {
+	if b.Sel != nil {
+		return len(b.Sel)
+	}
+	if len(b.Vectors) == 0 {
+		return 0
+	}
+	return b.Vectors[0].Len()
+}
+
+// The position in the vectors of the k'th row of the batch
+func (b *Batch) Index(k int) int {
+	if b.Sel != nil {
+		return b.Sel[k]
+	}
+	return k
+}
+
+// The batch as boxed rows
+func (b *Batch) Rows() TableViewRows {
+	rows := make(TableViewRows, b.Len())
+	for k := range rows {
+		idx := b.Index(k)
+		rows[k] = make(TableViewRow, len(b.Vectors))
+		for col_idx, v := range b.Vectors {
+			rows[k][col_idx] = v.Get(idx)
+		}
+	}
+	return rows
+}
+
+// A stream of batches, following the same protocol as TableView
+type BatchView struct {
+	C chan *Batch
+	status
+}
+
+func NewBatchView() *BatchView {
+	return &BatchView{
+		C: make(chan *Batch, settings.ChanSize),
+	}
+}
+
+// Send a batch, unless ctx is cancelled first.  Returns false, having
+// recorded ctx's error, if the producer should stop.
+func (bv *BatchView) Send(ctx context.Context, batch *Batch) bool {
+	select {
+	case bv.C <- batch:
+		return true
+	case <-ctx.Done():
+		bv.Fail(ctx.Err())
+		return false
+	}
+}
+
+// Adapt a stream of batches to a stream of rows
+func Rows(ctx context.Context, bv *BatchView) *TableView {
+	output := NewTableView()
+
+	go func() {
+		defer close(output.C)
+
+		for batch := range bv.C {
+			if batch.Len() == 0 {
+				continue
+			}
+			if !output.Send(ctx, batch.Rows()) {
+				return
+			}
+		}
+		if err := bv.Err(); err != nil {
+			output.Fail(err)
+		}
+	}()
+
+	return output
+}
+
+// Keep the rows of each batch for which keep returns true, by narrowing the
+// batch's selection
+func filterBatches(ctx context.Context, bv *BatchView, keep func(b *Batch, idx int) bool) *BatchView {
+	output := NewBatchView()
+
+	go func() {
+		defer close(output.C)
+
+		for batch := range bv.C {
+			sel := make([]int, 0, batch.Len())
+			for k := 0; k < batch.Len(); k++ {
+				if idx := batch.Index(k); keep(batch, idx) {
+					sel = append(sel, idx)
+				}
+			}
+			if len(sel) == 0 {
+				continue
+			}
+			if !output.Send(ctx, &Batch{Vectors: batch.Vectors, Sel: sel}) {
+				return
+			}
+		}
+		if err := bv.Err(); err != nil {
+			output.Fail(err)
+		}
+	}()
+
+	return output
+}
+
+// Keep the rows whose int64 column col_idx satisfies cond.  As in SQL, a null
+// never satisfies a condition.  On dictionary encoded vectors cond is called
+// once per dictionary entry rather than once per row.
+func FilterInt64(ctx context.Context, bv *BatchView, col_idx int, cond func(int64) bool) *BatchView {
+	var dict []int64 // the dictionary that matches was worked out for
+	var matches []bool
+	return filterBatches(ctx, bv, func(b *Batch, idx int) bool {
+		v := b.Vectors[col_idx]
+		if v.IsNull(idx) {
+			return false
+		}
+		if !v.IsEncoded() {
+			return cond(v.Int64s[idx])
+		}
+		if !sameDict(v.Dict, dict) {
+			dict = v.Dict
+			matches = make([]bool, len(dict))
+			for code, value := range dict {
+				matches[code] = cond(value)
+			}
+		}
+		return matches[v.Codes[idx]]
+	})
+}
+
+// Whether two dictionaries are the same slice, as for the vectors of one run
+func sameDict(a, b []int64) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// Keep the rows whose float64 column col_idx satisfies cond.  As in SQL, a
+// null never satisfies a condition.
+func FilterFloat64(ctx context.Context, bv *BatchView, col_idx int, cond func(float64) bool) *BatchView {
+	return filterBatches(ctx, bv, func(b *Batch, idx int) bool {
+		v := b.Vectors[col_idx]
+		return !v.IsNull(idx) && cond(v.Float64s[idx])
+	})
+}
+
+// Keep the rows whose string column col_idx satisfies cond.  As in SQL, a
+// null never satisfies a condition.
+func FilterString(ctx context.Context, bv *BatchView, col_idx int, cond func(string) bool) *BatchView {
+	return filterBatches(ctx, bv, func(b *Batch, idx int) bool {
+		v := b.Vectors[col_idx]
+		return !v.IsNull(idx) && cond(v.Strings[idx])
+	})
+}
+
+// Count the rows holding each value of column col_idx, counting the nulls
+// under nil, once bv is done.  On dictionary encoded vectors the codes are
+// counted, and a value is boxed once per dictionary entry.
+func GroupCount(bv *BatchView, col_idx int) (map[interface{}]int, error) {
+	counts := make(map[interface{}]int)
+	var dict []int64 // the dictionary that code_counts counts codes of
+	var code_counts []int
+	flush := func() {
+		for code, n := range code_counts {
+			if n > 0 {
+				counts[dict[code]] += n
+			}
+		}
+	}
+
+	for batch := range bv.C {
+		v := batch.Vectors[col_idx]
+		for k := 0; k < batch.Len(); k++ {
+			idx := batch.Index(k)
+			if !v.IsEncoded() || v.IsNull(idx) {
+				counts[v.Get(idx)]++
+				continue
+			}
+			if !sameDict(v.Dict, dict) {
+				flush()
+				dict = v.Dict
+				code_counts = make([]int, len(dict))
+			}
+			code_counts[v.Codes[idx]]++
+		}
+	}
+	flush()
+	if err := bv.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// EquiJoin on batches.  The output rows hold the columns of bv1 followed by
+// those of bv2, and come out in batches of at most settings.BatchSize rows.
+func EquiJoinBatches(ctx context.Context, bv1, bv2 *BatchView, col_idx1, col_idx2 int) *BatchView {
+	output := NewBatchView()
+
+	// a row of one of the inputs
+	type ref struct {
+		batch *Batch
+		idx   int
+	}
+
+	go func() {
+		defer close(output.C)
+
+		bv1_map := make(map[interface{}][]ref)
+		for batch := range bv1.C {
+			v := batch.Vectors[col_idx1]
+			for k := 0; k < batch.Len(); k++ {
+				idx := batch.Index(k)
+				if key := v.Get(idx); key != nil {
+					bv1_map[key] = append(bv1_map[key], ref{batch, idx})
+				}
+			}
+		}
+		if err := bv1.Err(); err != nil {
+			output.Fail(err)
+			for range bv2.C { // let the other producer finish
+			}
+			return
+		}
+
+		var out *Batch
+		flush := func() bool {
+			if out == nil || out.Len() == 0 {
+				return true
+			}
+			ok := output.Send(ctx, out)
+			out = nil
+			return ok
+		}
+		for batch := range bv2.C {
+			v := batch.Vectors[col_idx2]
+			for k := 0; k < batch.Len(); k++ {
+				idx := batch.Index(k)
+				key := v.Get(idx)
+				if key == nil {
+					continue
+				}
+				for _, match := range bv1_map[key] {
+					if out == nil {
+						out = &Batch{}
+						for _, v1 := range match.batch.Vectors {
+							out.Vectors = append(out.Vectors, NewVector(v1.Type, settings.BatchSize))
+						}
+						for _, v2 := range batch.Vectors {
+							out.Vectors = append(out.Vectors, NewVector(v2.Type, settings.BatchSize))
+						}
+					}
+					n1 := len(match.batch.Vectors)
+					for col_idx, v1 := range match.batch.Vectors {
+						out.Vectors[col_idx].AppendFrom(v1, match.idx)
+					}
+					for col_idx, v2 := range batch.Vectors {
+						out.Vectors[n1+col_idx].AppendFrom(v2, idx)
+					}
+					if out.Len() == settings.BatchSize && !flush() {
+						return
+					}
+				}
+			}
+		}
+		if !flush() {
+			return
+		}
+		if err := bv2.Err(); err != nil {
+			output.Fail(err)
+		}
+	}()
+
+	return output
+}
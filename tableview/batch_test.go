@@ -0,0 +1,186 @@
+package tableview
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/jinpan/stuffdb/datatypes"
+)
+
+func TestVectorAppend(t *testing.T) {
+	v := NewVector(datatypes.INT64_TYPE, 4)
+	for _, datum := range []interface{}{int64(1), int64(2), nil, int64(4)} {
+		if err := v.Append(datum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.Append("five"); err == nil {
+		t.Errorf("Expected an error appending a string to an int64 vector")
+	}
+
+	if v.Len() != 4 {
+		t.Fatalf("Expected %d values, got %d", 4, v.Len())
+	}
+	for k, expected := range []interface{}{int64(1), int64(2), nil, int64(4)} {
+		if v.Get(k) != expected {
+			t.Errorf("Expected %v at %d, got %v", expected, k, v.Get(k))
+		}
+	}
+	if !v.IsNull(2) || v.IsNull(0) {
+		t.Errorf("Wrong nulls %v", v.Nulls)
+	}
+}
+
+func TestFilterBatches(t *testing.T) {
+	n_batches := 10
+
+	input := NewBatchView()
+	go func() {
+		defer close(input.C)
+
+		for i := 0; i < n_batches; i++ {
+			a := NewVector(datatypes.INT64_TYPE, 100)
+			b := NewVector(datatypes.STRING_TYPE, 100)
+			for k := 0; k < 100; k++ {
+				a.Append(int64(i*100 + k))
+				if k%7 == 0 {
+					b.Append(nil)
+				} else {
+					b.Append("x")
+				}
+			}
+			input.C <- &Batch{Vectors: []*Vector{a, b}}
+		}
+	}()
+
+	ctx := context.Background()
+	multiple_of_3 := FilterInt64(ctx, input, 0, func(x int64) bool {
+		return x%3 == 0
+	})
+	non_null := FilterString(ctx, multiple_of_3, 1, func(x string) bool {
+		return true
+	})
+
+	output_count := 0
+	output := Rows(ctx, non_null)
+	for rows := range output.C {
+		for _, row := range rows {
+			i := row[0].(int64)
+			if i%3 != 0 || i%100%7 == 0 || row[1] != "x" {
+				t.Errorf("Unexpected row %v", row)
+			}
+			output_count++
+		}
+	}
+	if err := output.Err(); err != nil {
+		t.Error(err)
+	}
+
+	expected := 0
+	for i := 0; i < n_batches*100; i++ {
+		if i%3 == 0 && i%100%7 != 0 {
+			expected++
+		}
+	}
+	if output_count != expected {
+		t.Errorf("Expected %d outputs, got %d", expected, output_count)
+	}
+}
+
+func TestDictionaryEncodedVectors(t *testing.T) {
+	dict := []int64{-5, 7, 10}
+	input := NewBatchView()
+	go func() {
+		defer close(input.C)
+		// two encoded batches sharing the dictionary, then a plain one
+		for i := 0; i < 2; i++ {
+			input.C <- &Batch{Vectors: []*Vector{{
+				Type:  datatypes.INT64_TYPE,
+				Dict:  dict,
+				Codes: []uint8{0, 1, 2, 1, 0},
+				Nulls: []bool{false, false, false, false, true},
+			}}}
+		}
+		plain := NewVector(datatypes.INT64_TYPE, 2)
+		plain.Append(int64(7))
+		plain.Append(int64(8))
+		input.C <- &Batch{Vectors: []*Vector{plain}}
+	}()
+
+	calls := 0
+	filtered := FilterInt64(context.Background(), input, 0, func(x int64) bool {
+		calls++
+		return x > 0
+	})
+	counts, err := GroupCount(filtered, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[interface{}]int{int64(7): 5, int64(10): 2, int64(8): 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected counts %v, got %v", expected, counts)
+	}
+	if calls != len(dict)+2 {
+		t.Errorf("Expected the condition to be evaluated once per entry, got %d calls", calls)
+	}
+
+	v := &Vector{Type: datatypes.INT64_TYPE, Dict: dict, Codes: []uint8{2, 0}}
+	if err := v.Append(int64(3)); err != nil {
+		t.Fatal(err)
+	}
+	if v.IsEncoded() || !reflect.DeepEqual(v.Int64s, []int64{10, -5, 3}) {
+		t.Errorf("Expected appending to decode the vector, got %+v", v)
+	}
+}
+
+func TestEquiJoinBatches(t *testing.T) {
+	keys1 := NewVector(datatypes.INT64_TYPE, 3)
+	names1 := NewVector(datatypes.STRING_TYPE, 3)
+	for i, name := range []string{"a", "b", "c"} {
+		keys1.Append(int64(i))
+		names1.Append(name)
+	}
+	keys1.Append(nil)
+	names1.Append("null")
+	input1 := NewBatchView()
+	input1.C <- &Batch{Vectors: []*Vector{keys1, names1}, Sel: []int{0, 2, 3}}
+	close(input1.C)
+
+	keys2 := NewVector(datatypes.INT64_TYPE, 4)
+	values2 := NewVector(datatypes.FLOAT64_TYPE, 4)
+	for _, key := range []interface{}{int64(0), int64(1), int64(2), int64(2), nil} {
+		keys2.Append(key)
+		values2.Append(1.5)
+	}
+	input2 := NewBatchView()
+	input2.C <- &Batch{Vectors: []*Vector{keys2, values2}}
+	close(input2.C)
+
+	ctx := context.Background()
+	output := Rows(ctx, EquiJoinBatches(ctx, input1, input2, 0, 0))
+	var joined TableViewRows
+	for rows := range output.C {
+		joined = append(joined, rows...)
+	}
+	if err := output.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// b is not selected, and the null keys match nothing
+	expected := TableViewRows{
+		{int64(0), "a", int64(0), 1.5},
+		{int64(2), "c", int64(2), 1.5},
+		{int64(2), "c", int64(2), 1.5},
+	}
+	if len(joined) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, joined)
+	}
+	for k := range expected {
+		for l := range expected[k] {
+			if joined[k][l] != expected[k][l] {
+				t.Errorf("Expected %v, got %v", expected[k], joined[k])
+			}
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package tableview
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"testing"
+)
 
 func TestFilter(t *testing.T) {
 	filter_func := func(x interface{}) bool {
@@ -9,21 +13,21 @@ func TestFilter(t *testing.T) {
 
 	n_records := 10000
 
-	input := make(TableView)
-	output := Filter(input, 1, filter_func)
+	input := NewTableView()
+	output := Filter(context.Background(), input, 1, filter_func)
 
 	go func() {
-		defer close(input)
+		defer close(input.C)
 
 		for i := int64(0); i < int64(n_records); i++ {
-			input <- TableViewRows{
+			input.C <- TableViewRows{
 				TableViewRow{0, int64(i)},
 			}
 		}
 	}()
 
 	output_count := 0
-	for rows := range output {
+	for rows := range output.C {
 		for _, row := range rows {
 			if !filter_func(row[1]) {
 				t.Errorf("%s should have failed", row[1])
@@ -35,4 +39,73 @@ func TestFilter(t *testing.T) {
 	if output_count != n_records/3+1 {
 		t.Errorf("Expected %d outputs, got %d", n_records/3+1, output_count)
 	}
+	if err := output.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEquiJoinNulls(t *testing.T) {
+	input1 := NewTableView()
+	input1.C <- TableViewRows{
+		TableViewRow{int64(1), "a"},
+		TableViewRow{nil, "b"},
+	}
+	close(input1.C)
+
+	input2 := NewTableView()
+	input2.C <- TableViewRows{
+		TableViewRow{int64(1), "c"},
+		TableViewRow{nil, "d"},
+	}
+	close(input2.C)
+
+	output_count := 0
+	for rows := range EquiJoin(context.Background(), input1, input2, 0, 0).C {
+		for _, row := range rows {
+			if row[1] != "a" || row[3] != "c" {
+				t.Errorf("Unexpected join output %v", row)
+			}
+			output_count++
+		}
+	}
+
+	if output_count != 1 {
+		t.Errorf("Expected %d outputs, got %d", 1, output_count)
+	}
+}
+
+func TestFilterPropagatesError(t *testing.T) {
+	input := NewTableView()
+	input.C <- TableViewRows{TableViewRow{int64(1)}}
+	input.Fail(fmt.Errorf("disk on fire"))
+	close(input.C)
+
+	output := Filter(context.Background(), input, 0, func(interface{}) bool { return true })
+	for range output.C {
+	}
+	if err := output.Err(); err == nil || err.Error() != "disk on fire" {
+		t.Errorf("Expected the input's error, got %v", err)
+	}
+}
+
+func TestEquiJoinPropagatesError(t *testing.T) {
+	input1 := NewTableView()
+	input1.Fail(fmt.Errorf("disk on fire"))
+	close(input1.C)
+
+	input2 := NewTableView()
+	go func() {
+		defer close(input2.C)
+		for i := 0; i < 1000; i++ {
+			input2.C <- TableViewRows{TableViewRow{int64(i)}}
+		}
+	}()
+
+	output := EquiJoin(context.Background(), input1, input2, 0, 0)
+	for range output.C {
+		t.Errorf("Expected no output from a failed join")
+	}
+	if err := output.Err(); err == nil {
+		t.Errorf("Expected the join to fail")
+	}
 }
@@ -1,58 +1,167 @@
 package tableview
 
-import "github.com/jinpan/stuffdb/settings"
+import (
+	"context"
+	"sync"
+
+	"github.com/jinpan/stuffdb/settings"
+)
 
 type TableViewRow []interface{}
 type TableViewRows []TableViewRow
 
-type TableView (chan TableViewRows)
+/*
+A stream of rows.  The producer sends batches on C and closes it when it is
+done.  A producer that stops early because something went wrong records the
+error with Fail before closing C, so consumers should check Err once C is
+drained.
+
+Producers take a context and give up, closing C, once it is cancelled.  A
+consumer that wants to stop reading early cancels the context instead of
+abandoning C, which would leave the producer blocked forever.
+*/
+type TableView struct {
+	C chan TableViewRows
+	status
+}
+
+// A stream of the data of a single column, in vectors
+type ColumnView struct {
+	C chan *Vector
+	status
+}
+
+type status struct {
+	mu  sync.Mutex
+	err error
+}
+
+func NewTableView() *TableView {
+	return &TableView{
+		C: make(chan TableViewRows, settings.ChanSize),
+	}
+}
+
+func NewColumnView() *ColumnView {
+	return &ColumnView{
+		C: make(chan *Vector, settings.ChanSize),
+	}
+}
 
-type ColumnView (chan interface{})
+// Send a batch of rows, unless ctx is cancelled first.  Returns false, having
+// recorded ctx's error, if the producer should stop.
+func (tv *TableView) Send(ctx context.Context, rows TableViewRows) bool {
+	select {
+	case tv.C <- rows:
+		return true
+	case <-ctx.Done():
+		tv.Fail(ctx.Err())
+		return false
+	}
+}
+
+// Send a vector of column data, unless ctx is cancelled first.  Returns
+// false, having recorded ctx's error, if the producer should stop.
+func (cv *ColumnView) Send(ctx context.Context, data *Vector) bool {
+	select {
+	case cv.C <- data:
+		return true
+	case <-ctx.Done():
+		cv.Fail(ctx.Err())
+		return false
+	}
+}
 
-func Filter(tv TableView, col_idx int, cond func(interface{}) bool) TableView {
-	output := make(TableView, settings.ChanSize)
+// Record why the stream ended early.  Only the first error is kept.
+func (s *status) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// The error that ended the stream, if any.  Only meaningful once the stream
+// has been drained.
+func (s *status) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Keep the rows whose col_idx'th datum satisfies cond.  Nulls are passed to
+// cond as nil, so cond decides whether a null matches.  tv should be produced
+// under ctx, so that cancelling ctx stops the whole pipeline.
+func Filter(ctx context.Context, tv *TableView, col_idx int, cond func(interface{}) bool) *TableView {
+	output := NewTableView()
 
 	go func() {
-		defer close(output)
+		defer close(output.C)
 
-		for rows := range tv {
+		for rows := range tv.C {
 			result := make(TableViewRows, 0, len(rows))
 			for _, row := range rows {
 				if cond(row[col_idx]) {
 					result = append(result, row)
 				}
 			}
-			output <- result
+			if !output.Send(ctx, result) {
+				return
+			}
+		}
+		if err := tv.Err(); err != nil {
+			output.Fail(err)
 		}
 	}()
 
 	return output
 }
 
-// General equijoin on unsorted, assume everything fits in memory for now
-func EquiJoin(tv1, tv2 TableView, col_idx1, col_idx2 int) TableView {
-	output := make(TableView, settings.ChanSize)
+// General equijoin on unsorted, assume everything fits in memory for now.
+// As in SQL, a null key never equals anything, including another null.  Both
+// inputs should be produced under ctx.
+func EquiJoin(ctx context.Context, tv1, tv2 *TableView, col_idx1, col_idx2 int) *TableView {
+	output := NewTableView()
 
 	go func() {
-		defer close(output)
+		defer close(output.C)
 
 		tv1_map := make(map[interface{}][]TableViewRow)
 
-		for rows := range tv1 {
+		for rows := range tv1.C {
 			for _, row := range rows {
+				if row[col_idx1] == nil {
+					continue
+				}
 				tv1_map[row[col_idx1]] = append(tv1_map[row[col_idx1]], row)
 			}
 		}
+		if err := tv1.Err(); err != nil {
+			output.Fail(err)
+			for range tv2.C { // let the other producer finish
+			}
+			return
+		}
 
-		for rows2 := range tv2 {
+		for rows2 := range tv2.C {
 			for _, row2 := range rows2 {
+				if row2[col_idx2] == nil {
+					continue
+				}
 				if rows1 := tv1_map[row2[col_idx2]]; rows1 != nil {
 					for _, row1 := range rows1 {
-						output <- TableViewRows{append(row1, row2...)}
+						if !output.Send(ctx, TableViewRows{append(row1, row2...)}) {
+							return
+						}
 					}
 				}
 			}
 		}
+		if err := tv2.Err(); err != nil {
+			output.Fail(err)
+		}
 	}()
 
 	return output
@@ -1,15 +1,18 @@
 package writestore
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
-	"path"
+	"sync"
 
+	"github.com/jinpan/stuffdb/database"
 	"github.com/jinpan/stuffdb/datatypes"
 	"github.com/jinpan/stuffdb/schema"
-	"github.com/jinpan/stuffdb/settings"
 	"github.com/jinpan/stuffdb/tableview"
 )
 
@@ -20,18 +23,21 @@ const (
 type InsertStore struct {
 	tablename string
 	schema    *schema.Schema
+
+	// guarded by mu, as readers of a table's snapshots may read the insert
+	// store while it takes inserts or is moved
+	mu        sync.Mutex
 	n_entries int
 	filename  string
 }
 
-func NewInsertStore(tablename string, schema *schema.Schema) (*InsertStore, error) {
+func NewInsertStore(
+	db *database.Database,
+	tablename string,
+	schema *schema.Schema,
+) (*InsertStore, error) {
 	// initialize insert store
-	filename := path.Join(
-		"/var",
-		"stuffdb",
-		tablename,
-		"insert_buffer",
-	)
+	filename := db.InsertBufferPath(tablename)
 
 	f, create_err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL, 0700)
 	if create_err != nil {
@@ -50,146 +56,335 @@ func NewInsertStore(tablename string, schema *schema.Schema) (*InsertStore, erro
 	}, nil
 }
 
-func Load(tablename string, s *schema.Schema, n_entries int) *InsertStore {
-	filename := path.Join(
-		"/var",
-		"stuffdb",
-		tablename,
-		"insert_buffer",
-	)
+func Load(db *database.Database, tablename string, s *schema.Schema, n_entries int) *InsertStore {
+	return Open(db.InsertBufferPath(tablename), tablename, s, n_entries)
+}
 
-	is := InsertStore{
+// Open the insert store file filename, holding n_entries rows
+func Open(filename string, tablename string, s *schema.Schema, n_entries int) *InsertStore {
+	return &InsertStore{
 		tablename: tablename,
 		schema:    s,
 		n_entries: n_entries,
 		filename:  filename,
 	}
+}
+
+// Move the insert store's file to filename.  Readers already under way carry
+// on with the moved file.
+func (w *InsertStore) Move(filename string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := os.Rename(w.filename, filename); err != nil {
+		return err
+	}
+	w.filename = filename
+	return nil
+}
 
-	return &is
+func (w *InsertStore) Delete() error {
+	return os.Remove(w.getFilename())
+}
+
+func (w *InsertStore) getFilename() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.filename
 }
 
 func (w *InsertStore) Clear() error {
-	rm_err := os.Remove(w.filename)
-	if rm_err != nil {
-		return rm_err
+	return w.Truncate(0, 0)
+}
+
+// The size of the insert store file in bytes
+func (w *InsertStore) Size() (int64, error) {
+	fi, err := os.Stat(w.getFilename())
+	if err != nil {
+		return -1, err
 	}
-	f, create_err := os.OpenFile(w.filename, os.O_CREATE|os.O_EXCL, 0700)
-	if create_err != nil {
-		return create_err
+	return fi.Size(), nil
+}
+
+// Cut the insert store file back to offset bytes, holding n_entries rows.
+// This undoes inserts that were never committed.
+func (w *InsertStore) Truncate(offset int64, n_entries int) error {
+	f, open_err := os.OpenFile(w.getFilename(), os.O_RDWR, 0700)
+	if open_err != nil {
+		return open_err
 	}
-	close_err := f.Close()
-	if close_err != nil {
+	if truncate_err := f.Truncate(offset); truncate_err != nil {
+		f.Close()
+		return truncate_err
+	}
+	if sync_err := f.Sync(); sync_err != nil {
+		f.Close()
+		return sync_err
+	}
+	if close_err := f.Close(); close_err != nil {
 		return close_err
 	}
 
-	w.n_entries = 0
+	w.mu.Lock()
+	w.n_entries = n_entries
+	w.mu.Unlock()
 	return nil
 }
 
+func (w *InsertStore) GetLen() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.n_entries
+}
+
 func (w *InsertStore) Insert(row []interface{}) (int, error) {
-	f, open_err := os.OpenFile(w.filename, os.O_RDWR|os.O_APPEND, 0700)
+	return w.InsertRows([][]interface{}{row})
+}
+
+// Append the rows and flush the file once they are all written.  On error
+// some of the rows may have been written; the caller truncates them away.
+func (w *InsertStore) InsertRows(rows [][]interface{}) (int, error) {
+	f, open_err := os.OpenFile(w.getFilename(), os.O_RDWR|os.O_APPEND, 0700)
 	if open_err != nil {
 		return -1, open_err
 	}
 	defer f.Close()
 
-	return w.n_entries, w.insert(f, row)
+	for _, row := range rows {
+		if err := w.insert(f, row); err != nil {
+			return w.GetLen(), err
+		}
+	}
+	return w.GetLen(), f.Sync()
 }
 
+// Rows are appended back to back.  Fixed size datums are written as their
+// little-endian encoding; strings are written as a little-endian uint32 byte
+// length followed by the bytes, so rows of a schema with string columns vary
+// in size and can only be located by decoding from the start.
+//
+// If the schema has nullable columns, every row starts with a null bitmap of
+// nullBitmapBytes bytes where bit i (least significant bit first) is set when
+// column i is null.  A null is still written as a zero value (or an empty
+// string) so that fixed size rows stay fixed size.
 func (w *InsertStore) insert(f *os.File, row []interface{}) error {
 	if len(row) != w.schema.GetLen() {
 		return fmt.Errorf("Size mismatch between schema size and data size")
 	}
 	buf := new(bytes.Buffer)
+	if w.schema.HasNullable() {
+		null_bitmap := make([]byte, w.nullBitmapBytes())
+		for i, datum := range row {
+			if datum == nil {
+				null_bitmap[i/8] |= 1 << uint(i%8)
+			}
+		}
+		buf.Write(null_bitmap)
+	}
 	for i, datum := range row {
+		if datum == nil {
+			if !w.schema.IsNullable(i) {
+				return fmt.Errorf("Column %s is not nullable", w.schema.GetName(i))
+			}
+			datum = zeroValue(w.schema.GetType(i))
+		}
 		switch w.schema.GetType(i) {
 		case datatypes.INT64_TYPE:
-			if err := binary.Write(buf, binary.LittleEndian, datum.(int64)); err != nil {
+			value, ok := datum.(int64)
+			if !ok {
+				return w.typeError(i, datum)
+			}
+			if err := binary.Write(buf, binary.LittleEndian, value); err != nil {
 				return err
 			}
 		case datatypes.FLOAT64_TYPE:
-			if err := binary.Write(buf, binary.LittleEndian, datum.(float64)); err != nil {
+			value, ok := datum.(float64)
+			if !ok {
+				return w.typeError(i, datum)
+			}
+			if err := binary.Write(buf, binary.LittleEndian, value); err != nil {
 				return err
 			}
+		case datatypes.STRING_TYPE:
+			str, ok := datum.(string)
+			if !ok {
+				return w.typeError(i, datum)
+			}
+			if err := binary.Write(buf, binary.LittleEndian, uint32(len(str))); err != nil {
+				return err
+			}
+			buf.WriteString(str)
 		default:
 			return fmt.Errorf("Invalid data type")
 		}
 	}
+	expected_bytes := buf.Len()
 	n_bytes, write_err := f.Write(buf.Bytes())
 	if write_err != nil {
 		return write_err
 	}
-	if n_bytes != w.schema.GetRowSizeBytes() {
+	if n_bytes != expected_bytes {
 		return fmt.Errorf("Expected to write %d bytes, wrote %d bytes",
-			w.schema.GetRowSizeBytes(), n_bytes)
+			expected_bytes, n_bytes)
 	}
+	w.mu.Lock()
 	w.n_entries++
+	w.mu.Unlock()
 
 	return nil
 }
 
-func (w *InsertStore) ReadAll() tableview.TableView {
-	tv, read_err := w.Read(0, w.n_entries)
-	if read_err != nil {
-		panic(read_err.Error())
-	}
+func (w *InsertStore) ReadAll(ctx context.Context) (*tableview.TableView, error) {
+	return w.Read(ctx, 0, w.GetLen())
+}
 
-	return tv
+// Read row i
+func (w *InsertStore) ReadOne(i int) (tableview.TableViewRow, error) {
+	tv, err := w.Read(context.Background(), i, i+1)
+	if err != nil {
+		return nil, err
+	}
+	var rows tableview.TableViewRows
+	for chunk := range tv.C {
+		rows = append(rows, chunk...)
+	}
+	if err := tv.Err(); err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 {
+		return nil, fmt.Errorf("Expected to read 1 row, got %d", len(rows))
+	}
+	return rows[0], nil
 }
 
-func (w *InsertStore) Read(i, j int) (tableview.TableView, error) {
-	if i < 0 || i > w.n_entries {
+// Read rows [i, j).  The reader gives up once ctx is cancelled.
+func (w *InsertStore) Read(ctx context.Context, i, j int) (*tableview.TableView, error) {
+	// open the file under the lock, so that it cannot be moved in between
+	w.mu.Lock()
+	n_entries, filename := w.n_entries, w.filename
+	if i < 0 || i > n_entries {
+		w.mu.Unlock()
 		return nil, fmt.Errorf("Invalid start position")
 	}
-	if j < 0 || j > w.n_entries {
+	if j < 0 || j > n_entries {
+		w.mu.Unlock()
 		return nil, fmt.Errorf("Invalid end position")
 	}
 	if j < i {
+		w.mu.Unlock()
 		return nil, fmt.Errorf("End position (%d) must be after start position (%d)", j, i)
 	}
-
-	f, open_err := os.OpenFile(w.filename, os.O_RDONLY, 0400)
+	f, open_err := os.OpenFile(filename, os.O_RDONLY, 0400)
+	w.mu.Unlock()
 	if open_err != nil {
-		panic(open_err.Error())
+		return nil, open_err
 	}
 
-	ch := make(tableview.TableView, settings.ChanSize)
-	go w.read(f, i, j, ch) // takes care of closing the file when done
-	return ch, nil
+	tv := tableview.NewTableView()
+	go w.read(ctx, f, i, j, tv) // takes care of closing the file when done
+	return tv, nil
 }
 
-func (w *InsertStore) read(f *os.File, i, j int, ch tableview.TableView) {
+func (w *InsertStore) read(ctx context.Context, f *os.File, i, j int, tv *tableview.TableView) {
 	defer func() {
-		close(ch)
-		close_err := f.Close()
-		if close_err != nil {
-			panic(close_err.Error())
+		if close_err := f.Close(); close_err != nil {
+			tv.Fail(close_err)
 		}
+		close(tv.C)
 	}()
 
-	buf := make([]byte, w.schema.GetRowSizeBytes())
+	skip := i
+	if w.schema.IsFixedSize() { // jump straight to the first row
+		row_size_bytes := w.nullBitmapBytes() + w.schema.GetRowSizeBytes()
+		if _, seek_err := f.Seek(int64(i*row_size_bytes), io.SeekStart); seek_err != nil {
+			tv.Fail(seek_err)
+			return
+		}
+		skip = 0
+	}
+	reader := bufio.NewReader(f)
 
+	for k := 0; k < skip; k++ {
+		if _, err := w.readRow(reader); err != nil {
+			tv.Fail(fmt.Errorf("Unable to read row %d of %s: %s", k, f.Name(), err.Error()))
+			return
+		}
+	}
 	for k := i; k < j; k++ {
-		_, file_read_err := f.ReadAt(buf, int64(k*w.schema.GetRowSizeBytes()))
-		if file_read_err != nil {
-			panic(file_read_err)
+		row, err := w.readRow(reader)
+		if err != nil {
+			tv.Fail(fmt.Errorf("Unable to read row %d of %s: %s", k, f.Name(), err.Error()))
+			return
 		}
-		reader := bytes.NewReader(buf)
-
-		data := make([]interface{}, w.schema.GetLen())
-		for l := 0; l < len(data); l++ {
-			switch w.schema.GetType(l) {
-			case datatypes.INT64_TYPE:
-				var datum int64
-				bin_read_err := binary.Read(reader, binary.LittleEndian, &datum)
-				if bin_read_err != nil {
-					panic(bin_read_err.Error())
-				}
-				data[l] = datum
-			default:
-				panic("Invalid data type")
+		if !tv.Send(ctx, tableview.TableViewRows{row}) {
+			return
+		}
+	}
+}
+
+func (w *InsertStore) readRow(reader io.Reader) (tableview.TableViewRow, error) {
+	null_bitmap := make([]byte, w.nullBitmapBytes())
+	if _, read_err := io.ReadFull(reader, null_bitmap); read_err != nil {
+		return nil, read_err
+	}
+
+	data := make(tableview.TableViewRow, w.schema.GetLen())
+	for l := 0; l < len(data); l++ {
+		switch w.schema.GetType(l) {
+		case datatypes.INT64_TYPE:
+			var datum int64
+			if err := binary.Read(reader, binary.LittleEndian, &datum); err != nil {
+				return nil, err
+			}
+			data[l] = datum
+		case datatypes.FLOAT64_TYPE:
+			var datum float64
+			if err := binary.Read(reader, binary.LittleEndian, &datum); err != nil {
+				return nil, err
 			}
+			data[l] = datum
+		case datatypes.STRING_TYPE:
+			var str_len uint32
+			if err := binary.Read(reader, binary.LittleEndian, &str_len); err != nil {
+				return nil, err
+			}
+			str := make([]byte, str_len)
+			if _, read_err := io.ReadFull(reader, str); read_err != nil {
+				return nil, read_err
+			}
+			data[l] = string(str)
+		default:
+			return nil, fmt.Errorf("Invalid data type")
+		}
+		if len(null_bitmap) > 0 && null_bitmap[l/8]&(1<<uint(l%8)) != 0 {
+			data[l] = nil
 		}
-		ch <- tableview.TableViewRows{data}
 	}
+	return data, nil
+}
+
+// The size of the null bitmap at the start of each row
+func (w *InsertStore) nullBitmapBytes() int {
+	if !w.schema.HasNullable() {
+		return 0
+	}
+	return (w.schema.GetLen() + 7) / 8
+}
+
+// The placeholder written in place of a null
+func zeroValue(data_type datatypes.DatumType) interface{} {
+	switch data_type {
+	case datatypes.INT64_TYPE:
+		return int64(0)
+	case datatypes.FLOAT64_TYPE:
+		return float64(0)
+	case datatypes.STRING_TYPE:
+		return ""
+	default:
+		return nil
+	}
+}
+
+func (w *InsertStore) typeError(i int, datum interface{}) error {
+	return fmt.Errorf("Column %s holds %s, got %T", w.schema.GetName(i), w.schema.GetType(i), datum)
 }
@@ -1,10 +1,12 @@
 package writestore
 
 import (
+	"context"
 	"os"
-	"path"
+	"strings"
 	"testing"
 
+	"github.com/jinpan/stuffdb/database"
 	"github.com/jinpan/stuffdb/datatypes"
 	"github.com/jinpan/stuffdb/schema"
 )
@@ -13,26 +15,17 @@ const (
 	TEST_TABLE_NAME = "test_table"
 )
 
-var (
-	TEST_PATH = path.Join(
-		"/var",
-		"stuffdb",
-		TEST_TABLE_NAME,
-	)
-)
-
-func setup(t *testing.T) {
-	mkdir_err := os.MkdirAll(TEST_PATH, 0700)
-	if mkdir_err != nil {
-		t.Errorf(mkdir_err.Error())
+// A database in a fresh directory holding an empty table directory
+func setup(t *testing.T) *database.Database {
+	db, err := database.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func cleanup(t *testing.T) {
-	remove_err := os.RemoveAll(TEST_PATH)
-	if remove_err != nil {
-		t.Errorf(remove_err.Error())
+	mkdir_err := os.MkdirAll(db.TablePath(TEST_TABLE_NAME), 0700)
+	if mkdir_err != nil {
+		t.Fatal(mkdir_err)
 	}
+	return db
 }
 
 func makeSchema(t *testing.T) *schema.Schema {
@@ -52,19 +45,18 @@ func makeSchema(t *testing.T) *schema.Schema {
 		t.Errorf("expected no error here")
 	}
 	if schema.GetRowSizeBytes() != 16 {
-		t.Error("Expected row size to be 16 bytes, got %d", schema.GetRowSizeBytes())
+		t.Errorf("Expected row size to be 16 bytes, got %d", schema.GetRowSizeBytes())
 	}
 	return schema
 }
 
 func TestCreate(t *testing.T) {
-	setup(t)
-	defer cleanup(t)
+	db := setup(t)
 
 	schema := makeSchema(t)
-	insert_store, create_err := NewInsertStore("test_table", schema)
+	insert_store, create_err := NewInsertStore(db, "test_table", schema)
 	if create_err != nil {
-		t.Errorf(create_err.Error())
+		t.Error(create_err)
 	}
 	if insert_store == nil {
 		t.Errorf("Insert store should not be null")
@@ -72,13 +64,12 @@ func TestCreate(t *testing.T) {
 }
 
 func TestWriteRead(t *testing.T) {
-	setup(t)
-	defer cleanup(t)
+	db := setup(t)
 
 	schema := makeSchema(t)
-	insert_store, create_err := NewInsertStore("test_table", schema)
+	insert_store, create_err := NewInsertStore(db, "test_table", schema)
 	if create_err != nil {
-		t.Errorf(create_err.Error())
+		t.Error(create_err)
 	}
 	if insert_store == nil {
 		t.Errorf("Insert store should not be null")
@@ -92,7 +83,7 @@ func TestWriteRead(t *testing.T) {
 		}
 		n_entries, insert_err := insert_store.Insert(data)
 		if insert_err != nil {
-			t.Errorf(insert_err.Error())
+			t.Error(insert_err)
 		}
 		if n_entries != i+1 {
 			t.Errorf("Incorrect number of entries in the insert store")
@@ -100,11 +91,11 @@ func TestWriteRead(t *testing.T) {
 	}
 
 	count := 0
-	ch, read_err := insert_store.Read(0, n_records-1)
+	ch, read_err := insert_store.Read(context.Background(), 0, n_records-1)
 	if read_err != nil {
-		t.Errorf(read_err.Error())
+		t.Error(read_err)
 	}
-	for rows := range ch {
+	for rows := range ch.C {
 		for _, record := range rows {
 			if record[0].(int64) != int64(count) {
 				t.Errorf("Expected %d, got %d", count, record[0].(int64))
@@ -113,10 +104,198 @@ func TestWriteRead(t *testing.T) {
 				t.Errorf("Expected %d, got %d", 2*count, record[0].(int64))
 			}
 			if len(record) != schema.GetLen() {
-				t.Errorf("Expected a length of %d, got %d", schema.GetLen, len(record))
+				t.Errorf("Expected a length of %d, got %d", schema.GetLen(), len(record))
 			}
 			count++
 		}
 	}
 
 }
+
+func TestWriteReadString(t *testing.T) {
+	db := setup(t)
+
+	schema, err := schema.NewSchema(
+		[]string{"a", "b", "c"},
+		[]datatypes.DatumType{datatypes.STRING_TYPE, datatypes.INT64_TYPE, datatypes.FLOAT64_TYPE},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert_store, create_err := NewInsertStore(db, "test_table", schema)
+	if create_err != nil {
+		t.Fatal(create_err)
+	}
+
+	n_records := 100
+	for i := 0; i < n_records; i++ {
+		data := []interface{}{
+			strings.Repeat("s", i),
+			int64(i),
+			float64(i) / 2,
+		}
+		if _, insert_err := insert_store.Insert(data); insert_err != nil {
+			t.Error(insert_err)
+		}
+	}
+
+	count := 10
+	ch, read_err := insert_store.Read(context.Background(), 10, n_records)
+	if read_err != nil {
+		t.Fatal(read_err)
+	}
+	for rows := range ch.C {
+		for _, record := range rows {
+			if record[0].(string) != strings.Repeat("s", count) {
+				t.Errorf("Expected %d characters, got %q", count, record[0].(string))
+			}
+			if record[1].(int64) != int64(count) {
+				t.Errorf("Expected %d, got %d", count, record[1].(int64))
+			}
+			if record[2].(float64) != float64(count)/2 {
+				t.Errorf("Expected %f, got %f", float64(count)/2, record[2].(float64))
+			}
+			count++
+		}
+	}
+	if count != n_records {
+		t.Errorf("Expected to end at %d, ended at %d", n_records, count)
+	}
+}
+
+func TestWriteReadNulls(t *testing.T) {
+	db := setup(t)
+
+	schema, err := schema.NewNullableSchema(
+		[]string{"a", "b", "c"},
+		[]datatypes.DatumType{datatypes.INT64_TYPE, datatypes.STRING_TYPE, datatypes.FLOAT64_TYPE},
+		[]bool{false, true, true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert_store, create_err := NewInsertStore(db, "test_table", schema)
+	if create_err != nil {
+		t.Fatal(create_err)
+	}
+
+	if _, insert_err := insert_store.Insert([]interface{}{nil, "x", 1.0}); insert_err == nil {
+		t.Errorf("Expected an error inserting null into a non nullable column")
+	}
+
+	expected := [][]interface{}{
+		{int64(0), nil, 1.5},
+		{int64(1), "x", nil},
+		{int64(2), nil, nil},
+		{int64(3), "", 0.0},
+	}
+	for _, row := range expected {
+		if _, insert_err := insert_store.Insert(row); insert_err != nil {
+			t.Fatal(insert_err)
+		}
+	}
+
+	count := 1
+	ch, read_err := insert_store.Read(context.Background(), 1, len(expected))
+	if read_err != nil {
+		t.Fatal(read_err)
+	}
+	for rows := range ch.C {
+		for _, record := range rows {
+			for l := range record {
+				if record[l] != expected[count][l] {
+					t.Errorf("Row %d: expected %v, got %v", count, expected[count], record)
+				}
+			}
+			count++
+		}
+	}
+	if count != len(expected) {
+		t.Errorf("Expected to end at %d, ended at %d", len(expected), count)
+	}
+}
+
+func TestWrongType(t *testing.T) {
+	db := setup(t)
+
+	insert_store, create_err := NewInsertStore(db, "test_table", makeSchema(t))
+	if create_err != nil {
+		t.Fatal(create_err)
+	}
+	if _, insert_err := insert_store.Insert([]interface{}{int64(1), "two"}); insert_err == nil {
+		t.Errorf("Expected an error inserting a string into an int64 column")
+	}
+}
+
+func TestInsertRows(t *testing.T) {
+	db := setup(t)
+
+	insert_store, create_err := NewInsertStore(db, "test_table", makeSchema(t))
+	if create_err != nil {
+		t.Fatal(create_err)
+	}
+	rows := make([][]interface{}, 100)
+	for i := range rows {
+		rows[i] = []interface{}{int64(i), int64(-i)}
+	}
+	n_entries, insert_err := insert_store.InsertRows(rows)
+	if insert_err != nil {
+		t.Fatal(insert_err)
+	}
+	if n_entries != len(rows) {
+		t.Errorf("Expected %d entries, got %d", len(rows), n_entries)
+	}
+
+	tv, read_err := insert_store.ReadAll(context.Background())
+	if read_err != nil {
+		t.Fatal(read_err)
+	}
+	count := 0
+	for chunk := range tv.C {
+		for _, record := range chunk {
+			if record[0].(int64) != int64(count) || record[1].(int64) != int64(-count) {
+				t.Errorf("Expected row %d to be [%d %d], got %v", count, count, -count, record)
+			}
+			count++
+		}
+	}
+	if count != len(rows) {
+		t.Errorf("Expected %d rows, got %d", len(rows), count)
+	}
+
+	if _, insert_err := insert_store.InsertRows([][]interface{}{{int64(1), int64(2)}, {int64(3), "four"}}); insert_err == nil {
+		t.Errorf("Expected an error inserting a string into an int64 column")
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	db := setup(t)
+
+	insert_store, create_err := NewInsertStore(db, "test_table", makeSchema(t))
+	if create_err != nil {
+		t.Fatal(create_err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, insert_err := insert_store.Insert([]interface{}{int64(i), int64(i)}); insert_err != nil {
+			t.Fatal(insert_err)
+		}
+	}
+	if err := os.Truncate(insert_store.filename, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	ch, read_err := insert_store.ReadAll(context.Background())
+	if read_err != nil {
+		t.Fatal(read_err)
+	}
+	count := 0
+	for rows := range ch.C {
+		count += len(rows)
+	}
+	if count != 6 {
+		t.Errorf("Expected %d whole rows before the truncation, got %d", 6, count)
+	}
+	if ch.Err() == nil {
+		t.Errorf("Expected an error reading a truncated insert store")
+	}
+}